@@ -0,0 +1,203 @@
+package cmd
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/khelechy/consolidate/internal/common"
+	"github.com/khelechy/consolidate/internal/storage"
+	"github.com/spf13/cobra"
+)
+
+// auditCmd represents the audit command
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Make the history tamper-evident",
+	Long: `In audit mode every logged command is hashed together with the entry before
+it, so editing, removing or reordering entries breaks the chain. With --sign
+each entry is also signed with an Ed25519 key kept on this host.
+
+Commands removed by 'clean' leave signed tombstones, so deliberate deletions
+can be told apart from tampering.`,
+}
+
+// auditEnableCmd represents the audit enable command
+var auditEnableCmd = &cobra.Command{
+	Use:   "enable",
+	Short: "Turn on audit mode",
+	Long: `Turn on audit mode. Commands already in the history are added to the chain.
+
+With --sign, a signing key is created at $` + common.AuditKeyFileVar + ` (default
+~/.consolidate/audit_ed25519) if it does not exist, and every entry must be
+signed from then on.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		signed, _ := cmd.Flags().GetBool("sign")
+
+		store, err := common.OpenDB()
+		if err != nil {
+			fmt.Printf("Error initializing database: %v\n", err)
+			os.Exit(1)
+		}
+		defer store.Close()
+		if store.Audit() != nil {
+			fmt.Println("Audit mode is already on.")
+			return
+		}
+
+		var key ed25519.PrivateKey
+		if signed {
+			path, err := common.GetAuditKeyPath()
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			key, err = common.LoadAuditKey(path)
+			if errors.Is(err, fs.ErrNotExist) {
+				key, err = common.GenerateAuditKey(path)
+				if err == nil {
+					fmt.Printf("Created audit key %s\n", path)
+				}
+			}
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+
+		if err := store.EnableAudit(key); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Audit mode is on.")
+		if key != nil {
+			fmt.Printf("Public key: %s\n", hex.EncodeToString(key.Public().(ed25519.PublicKey)))
+		}
+	},
+}
+
+// auditVerifyCmd represents the audit verify command
+var auditVerifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Check the history for tampering",
+	Long: `Walk the audit chain and report entries that were edited, removed without a
+tombstone, reordered, inserted outside the chain or badly signed.
+
+Signatures are checked against keys kept outside the database: the ones given
+with --key, or else this host's signing key and the keys added with 'audit
+trust'. When there are any, every entry must be signed by one of them. With
+--head, the chain must also contain that hash, as printed by an earlier
+verify, so a chain rebuilt from scratch is caught.
+
+Exits with status 1 if any problem is found.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		asJSON, _ := cmd.Flags().GetBool("json")
+		keyArgs, _ := cmd.Flags().GetStringArray("key")
+		head, _ := cmd.Flags().GetString("head")
+
+		trust := storage.AuditTrust{Head: strings.TrimSpace(head)}
+		for _, arg := range keyArgs {
+			public, err := common.ParseAuditPublicKey(arg)
+			if err != nil {
+				fmt.Printf("Error: invalid --key: %v\n", err)
+				os.Exit(1)
+			}
+			trust.Keys = append(trust.Keys, public)
+		}
+		if len(trust.Keys) == 0 {
+			keys, err := common.TrustedAuditKeys()
+			if err != nil {
+				fmt.Printf("Error loading trusted keys: %v\n", err)
+				os.Exit(1)
+			}
+			trust.Keys = keys
+		}
+
+		store, err := common.OpenDB()
+		if err != nil {
+			fmt.Printf("Error initializing database: %v\n", err)
+			os.Exit(1)
+		}
+		defer store.Close()
+		if len(trust.Keys) == 0 {
+			if settings := store.Audit(); settings != nil && settings.Signed {
+				fmt.Println("Error: the history is signed but no key is trusted: pass --key or run 'consolidate audit trust'")
+				os.Exit(1)
+			}
+		}
+
+		report, err := store.VerifyAudit(trust)
+		if err != nil {
+			fmt.Printf("Error verifying history: %v\n", err)
+			os.Exit(1)
+		}
+
+		if asJSON {
+			printJSON(report)
+		} else {
+			for _, p := range report.Problems {
+				switch {
+				case p.Seq > 0 && p.ID > 0:
+					fmt.Printf("Entry %d (ID %d): %s\n", p.Seq, p.ID, p.Message)
+				case p.Seq > 0:
+					fmt.Printf("Entry %d: %s\n", p.Seq, p.Message)
+				case p.ID == 0:
+					fmt.Println(p.Message)
+				default:
+					fmt.Printf("ID %d: %s\n", p.ID, p.Message)
+				}
+			}
+			if len(report.Problems) > 0 {
+				fmt.Println()
+			}
+			fmt.Printf("%d entries, %d deleted by clean, %d problems\n", report.Entries, report.Deleted, len(report.Problems))
+			if report.Head != "" {
+				fmt.Printf("Head: %s\n", report.Head)
+			}
+		}
+		if len(report.Problems) > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+// auditTrustCmd represents the audit trust command
+var auditTrustCmd = &cobra.Command{
+	Use:   "trust [public-key]",
+	Short: "Accept entries signed by another host's key",
+	Long: `Add the hex encoded public key of another host to the trusted keys, so that
+entries it signed verify. 'consolidate audit enable --sign' prints the public
+key of a host.
+
+Trusted keys are kept in ~/.consolidate/audit_trusted_keys, one per line,
+outside the database they vouch for.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		public, err := common.ParseAuditPublicKey(args[0])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		if err := common.TrustAuditKey(public); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Trusted key %s\n", storage.AuditKeyID(public))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(auditCmd)
+	auditCmd.AddCommand(auditEnableCmd, auditVerifyCmd, auditTrustCmd)
+	auditEnableCmd.Flags().Bool("sign", false, "Sign every entry with this host's Ed25519 key")
+	auditVerifyCmd.Flags().Bool("json", false, "Print the report as JSON")
+	auditVerifyCmd.Flags().StringArray("key", nil, "Trust only this hex encoded public key (repeatable)")
+	auditVerifyCmd.Flags().String("head", "", "Require the chain to contain this head hash")
+}
@@ -20,23 +20,30 @@ var cleanCmd = &cobra.Command{
 		toStr, _ := cmd.Flags().GetString("to")
 		all, _ := cmd.Flags().GetBool("all")
 		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		metaPairs, _ := cmd.Flags().GetStringArray("meta")
 
-		_, err := common.InitAndGetDB()
+		store, err := common.OpenDB()
 		if err != nil {
 			fmt.Printf("Error initializing database: %v\n", err)
 			os.Exit(1)
 		}
+		defer store.Close()
 
-		// Validate flags - cannot use --all with --from or --to
-		if all && (fromStr != "" || toStr != "") {
-			fmt.Printf("Error: cannot use --all with --from or --to flags\n")
+		// Validate flags - cannot use --all with --from, --to or --meta
+		if all && (fromStr != "" || toStr != "" || len(metaPairs) > 0) {
+			fmt.Printf("Error: cannot use --all with --from, --to or --meta flags\n")
+			os.Exit(1)
+		}
+		meta, err := common.ParseMeta(metaPairs)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
 			os.Exit(1)
 		}
 
 		// Parse datetime ranges
 		var fromTime, toTime *time.Time
 		if fromStr != "" {
-			ft, err := parseDateTime(fromStr, true) // true for from (start of day)
+			ft, err := common.ParseDateTime(fromStr, true) // true for from (start of day)
 			if err != nil {
 				fmt.Printf("Error parsing from datetime: %v\n", err)
 				os.Exit(1)
@@ -44,7 +51,7 @@ var cleanCmd = &cobra.Command{
 			fromTime = &ft
 		}
 		if toStr != "" {
-			tt, err := parseDateTime(toStr, false) // false for to (end of day)
+			tt, err := common.ParseDateTime(toStr, false) // false for to (end of day)
 			if err != nil {
 				fmt.Printf("Error parsing to datetime: %v\n", err)
 				os.Exit(1)
@@ -53,7 +60,13 @@ var cleanCmd = &cobra.Command{
 		}
 
 		// Perform the clean operation
-		deleted, err := storage.CleanHistory(fromTime, toTime, all, dryRun)
+		deleted, err := store.CleanCommands(storage.CleanCriteria{
+			From:   fromTime,
+			To:     toTime,
+			Meta:   meta,
+			All:    all,
+			DryRun: dryRun,
+		})
 		if err != nil {
 			fmt.Printf("Error cleaning history: %v\n", err)
 			os.Exit(1)
@@ -71,27 +84,7 @@ func init() {
 	rootCmd.AddCommand(cleanCmd)
 	cleanCmd.Flags().String("from", "", "Start datetime (RFC3339 or YYYY-MM-DD, e.g., 2023-01-01 or 2023-01-01T00:00:00Z)")
 	cleanCmd.Flags().String("to", "", "End datetime (RFC3339 or YYYY-MM-DD, e.g., 2023-12-31 or 2023-12-31T23:59:59Z)")
+	cleanCmd.Flags().StringArray("meta", nil, "Only delete commands with this metadata key=value (repeatable; all must match)")
 	cleanCmd.Flags().Bool("all", false, "Delete all commands from history")
 	cleanCmd.Flags().Bool("dry-run", false, "Show what would be deleted without actually deleting")
 }
-
-// parseDateTime parses a datetime string, accepting both RFC3339 and date-only formats
-func parseDateTime(input string, isFrom bool) (time.Time, error) {
-	// First try RFC3339 format
-	if t, err := time.Parse(time.RFC3339, input); err == nil {
-		return t, nil
-	}
-
-	// If that fails, try date-only format (YYYY-MM-DD)
-	if t, err := time.Parse("2006-01-02", input); err == nil {
-		if isFrom {
-			// For --from, use start of day
-			return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC), nil
-		} else {
-			// For --to, use end of day
-			return time.Date(t.Year(), t.Month(), t.Day(), 23, 59, 59, 999999999, time.UTC), nil
-		}
-	}
-
-	return time.Time{}, fmt.Errorf("invalid datetime format: %s (use RFC3339 or YYYY-MM-DD)", input)
-}
@@ -0,0 +1,158 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"github.com/khelechy/consolidate/internal/common"
+	"github.com/khelechy/consolidate/internal/storage"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+// dbCmd represents the db command
+var dbCmd = &cobra.Command{
+	Use:   "db",
+	Short: "Manage the history database",
+}
+
+// dbEncryptCmd represents the db encrypt command
+var dbEncryptCmd = &cobra.Command{
+	Use:   "encrypt",
+	Short: "Encrypt the history database",
+	Long: `Encrypt the command text, working directories, metadata, recorded environment
+variables, git roots and remotes, notes and snippets in the history database
+with XChaCha20-Poly1305. Timestamps, exit codes, hosts, users, shells, git
+branches and commits, and tags stay readable.
+
+The key is derived from a passphrase with Argon2id, or with --key-file it is a
+random key kept in a file, which is created if it does not exist. Shell hooks
+cannot answer a prompt: they use the key cached in $XDG_RUNTIME_DIR (or
+$` + common.KeyCacheVar + `) once the passphrase was entered in this session, a
+key file, or $` + common.PassphraseVar + ` or $` + common.KeyCommandVar + `.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		keyFile, _ := cmd.Flags().GetBool("key-file")
+
+		store, err := common.OpenDB()
+		if err != nil {
+			fmt.Printf("Error initializing database: %v\n", err)
+			os.Exit(1)
+		}
+		defer store.Close()
+		if store.Encryption() != nil {
+			fmt.Println("The database is already encrypted.")
+			return
+		}
+
+		kdf := storage.KDFArgon2id
+		var secret []byte
+		if keyFile {
+			kdf = storage.KDFKeyFile
+			path, err := common.GetKeyFilePath()
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			secret, err = common.ReadKeyFile(path)
+			if errors.Is(err, fs.ErrNotExist) {
+				secret, err = common.GenerateKeyFile(path)
+				if err == nil {
+					fmt.Printf("Created key file %s\n", path)
+				}
+			}
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+		} else {
+			secret, err = common.ReadPassphrase(true)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+
+		settings, err := storage.NewEncryptionSettings(kdf)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if err := store.EncryptDatabase(settings, secret); err != nil {
+			fmt.Printf("Error encrypting database: %v\n", err)
+			os.Exit(1)
+		}
+
+		if kdf == storage.KDFArgon2id {
+			if err := common.CacheKey(settings, secret); err != nil {
+				fmt.Printf("Error caching key: %v\n", err)
+			}
+		}
+
+		dbPath, _ := common.GetDBPath()
+		fmt.Printf("Encrypted %s\n", dbPath)
+		fmt.Println("Copies and backups made before now still hold the history in plaintext.")
+	},
+}
+
+// dbMergeCmd represents the db merge command
+var dbMergeCmd = &cobra.Command{
+	Use:   "merge [other.db]",
+	Short: "Import the history of another database",
+	Long: `Import the commands of another consolidate database, such as one copied from an
+old machine, into this one. Databases of any older version are read as they are.
+
+Commands already here, matched by their ID or by timestamp, command, session and
+host, are skipped, so merging the same file twice adds nothing. Session IDs that
+are already in use here get a suffix. Encrypted databases cannot be merged;
+sync with them instead.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+		if _, err := os.Stat(args[0]); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		store, err := common.OpenDB()
+		if err != nil {
+			fmt.Printf("Error initializing database: %v\n", err)
+			os.Exit(1)
+		}
+		defer store.Close()
+
+		opts := storage.MergeOptions{DryRun: dryRun}
+		if term.IsTerminal(int(os.Stderr.Fd())) {
+			opts.Progress = func(done, total int) {
+				fmt.Fprintf(os.Stderr, "\rRead %d of %d commands", done, total)
+				if done == total {
+					fmt.Fprintln(os.Stderr)
+				}
+			}
+		}
+		result, err := store.MergeDatabase(args[0], opts)
+		if err != nil {
+			fmt.Printf("Error merging database: %v\n", err)
+			os.Exit(1)
+		}
+
+		verb := "Added"
+		if dryRun {
+			verb = "Would add"
+		}
+		fmt.Printf("%s %d of %d commands (%d duplicates)\n", verb, result.Added, result.Read, result.Duplicates)
+		if result.RemappedSessions > 0 {
+			fmt.Printf("Renamed %d sessions whose IDs were already in use\n", result.RemappedSessions)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(dbCmd)
+	dbCmd.AddCommand(dbEncryptCmd)
+	dbCmd.AddCommand(dbMergeCmd)
+	dbMergeCmd.Flags().Bool("dry-run", false, "Show what would be imported without writing anything")
+	dbEncryptCmd.Flags().Bool("key-file", false, "Use a random key kept in $"+common.KeyFileVar+" (default ~/.consolidate/key) instead of a passphrase")
+}
@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/khelechy/consolidate/internal/common"
+	"github.com/khelechy/consolidate/pkg/history"
+	"github.com/spf13/cobra"
+)
+
+// hereCmd represents the here command
+var hereCmd = &cobra.Command{
+	Use:   "here",
+	Short: "Show commands run in the current directory",
+	Long: `Display the commands run in the current directory, ranked by frecency:
+commands run often and recently come first. Repeated commands are collapsed
+into one line unless --all is given.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		limit, _ := cmd.Flags().GetInt("limit")
+		recursive, _ := cmd.Flags().GetBool("recursive")
+		all, _ := cmd.Flags().GetBool("all")
+
+		cwd, err := os.Getwd()
+		if err != nil {
+			fmt.Printf("Error getting current directory: %v\n", err)
+			os.Exit(1)
+		}
+
+		output, err := common.GetOutputOptions(cmd)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		store, err := common.OpenStore()
+		if err != nil {
+			fmt.Printf("Error initializing database: %v\n", err)
+			os.Exit(1)
+		}
+		defer store.Close()
+
+		stopPager := common.StartPager(output)
+		defer stopPager()
+
+		filter := history.Query{
+			Limit:    limit,
+			Dir:      cwd,
+			Subtree:  recursive,
+			Frecency: true,
+		}
+
+		if !all {
+			summaries, err := store.Frecent(cmd.Context(), filter)
+			if err != nil {
+				stopPager()
+				fmt.Fprintf(os.Stderr, "Error fetching commands: %v\n", err)
+				os.Exit(1)
+			}
+			if len(summaries) == 0 {
+				fmt.Println("No commands run here.")
+				return
+			}
+			if err := common.PrintSummaries(summaries, output); err != nil {
+				stopPager()
+				fmt.Fprintf(os.Stderr, "Error printing commands: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+
+		commands, err := store.Query(cmd.Context(), filter)
+		if err != nil {
+			stopPager()
+			fmt.Fprintf(os.Stderr, "Error fetching commands: %v\n", err)
+			os.Exit(1)
+		}
+		if len(commands) == 0 {
+			fmt.Println("No commands run here.")
+			return
+		}
+		if err := common.PrintCommands(commands, output); err != nil {
+			stopPager()
+			fmt.Fprintf(os.Stderr, "Error printing commands: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(hereCmd)
+	hereCmd.Flags().Int("limit", 20, "Maximum number of commands to display")
+	hereCmd.Flags().Bool("json", false, "Output in JSON format")
+	common.AddOutputFlags(hereCmd)
+	hereCmd.Flags().BoolP("recursive", "r", false, "Include commands run in subdirectories")
+	hereCmd.Flags().Bool("all", false, "Show every run instead of collapsing repeated commands")
+	hereCmd.Flags().Bool("unique", true, "Collapse repeated commands, showing how often and when each was last used")
+	hereCmd.Flags().MarkDeprecated("unique", "repeated commands are collapsed by default; use --all to show every run")
+}
@@ -1,11 +1,17 @@
 package cmd
 
 import (
+	"cmp"
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"time"
 
 	"github.com/khelechy/consolidate/internal/common"
-	"github.com/khelechy/consolidate/internal/storage"
+	"github.com/khelechy/consolidate/pkg/history"
 	"github.com/spf13/cobra"
 )
 
@@ -13,20 +19,79 @@ import (
 var historyCmd = &cobra.Command{
 	Use:   "history",
 	Short: "Display command history",
-	Long:  `Display all logged commands in chronological order (recent to oldest).`,
+	Long: `Display all logged commands in reverse chronological order (recent to oldest),
+or oldest first with --reverse. Use --offset or --before-id to page back
+through older commands.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		limit, _ := cmd.Flags().GetInt("limit")
-		jsonOutput, _ := cmd.Flags().GetBool("json")
+		unique, _ := cmd.Flags().GetBool("unique")
+		follow, _ := cmd.Flags().GetBool("follow")
+		interval, _ := cmd.Flags().GetDuration("interval")
 
-		_, err := common.InitAndGetDB()
+		if follow && unique {
+			fmt.Printf("Error: cannot use --follow with --unique\n")
+			os.Exit(1)
+		}
+		if follow && interval <= 0 {
+			fmt.Printf("Error: --interval must be positive\n")
+			os.Exit(1)
+		}
+
+		filter, err := common.GetFilter(cmd)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		output, err := common.GetOutputOptions(cmd)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		store, err := common.OpenStore()
 		if err != nil {
 			fmt.Printf("Error initializing database: %v\n", err)
 			os.Exit(1)
 		}
+		defer store.Close()
 
-		commands, err := storage.SearchCommands("", limit) // Empty query to get all
+		if follow {
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			if err := followHistory(ctx, store, filter, output, interval); err != nil {
+				fmt.Printf("Error following history: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+
+		// Following never ends, so it cannot go through a pager
+		stopPager := common.StartPager(output)
+		defer stopPager()
+
+		if unique {
+			summaries, err := store.Unique(cmd.Context(), filter)
+			if err != nil {
+				stopPager()
+				fmt.Fprintf(os.Stderr, "Error fetching history: %v\n", err)
+				os.Exit(1)
+			}
+			if len(summaries) == 0 {
+				fmt.Println("No commands in history.")
+				return
+			}
+			if err := common.PrintSummaries(summaries, output); err != nil {
+				stopPager()
+				fmt.Fprintf(os.Stderr, "Error printing commands: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+
+		commands, err := store.Query(cmd.Context(), filter)
 		if err != nil {
-			fmt.Printf("Error fetching history: %v\n", err)
+			stopPager()
+			fmt.Fprintf(os.Stderr, "Error fetching history: %v\n", err)
 			os.Exit(1)
 		}
 
@@ -35,8 +100,9 @@ var historyCmd = &cobra.Command{
 			return
 		}
 
-		if err := common.PrintCommands(commands, jsonOutput); err != nil {
-			fmt.Printf("Error printing commands: %v\n", err)
+		if err := common.PrintCommands(commands, output); err != nil {
+			stopPager()
+			fmt.Fprintf(os.Stderr, "Error printing commands: %v\n", err)
 			os.Exit(1)
 		}
 	},
@@ -46,4 +112,75 @@ func init() {
 	rootCmd.AddCommand(historyCmd)
 	historyCmd.Flags().Int("limit", 100, "Maximum number of commands to display")
 	historyCmd.Flags().Bool("json", false, "Output in JSON format")
+	common.AddOutputFlags(historyCmd)
+	common.AddFilterFlags(historyCmd)
+	historyCmd.Flags().BoolP("follow", "f", false, "Keep running and print commands as they are logged from any shell")
+	historyCmd.Flags().Duration("interval", time.Second, "How often to check for new commands with --follow")
+	historyCmd.Flags().Bool("unique", false, "Collapse repeated commands, with counts, first and last use, last exit code and directories")
+}
+
+// followHistory prints the commands matching the filter, oldest first, then
+// polls for newly logged ones until the context is canceled. Paging options
+// such as --offset and --before-id only apply to the commands printed first.
+func followHistory(ctx context.Context, store *history.Store, filter history.Query, output common.OutputOptions, interval time.Duration) error {
+	// Rows are only ever appended, so the newest ID is a cursor for
+	// everything logged since. It is taken before the first page, which may
+	// leave newer commands out (--offset, --before-id, --limit 0) that are
+	// not new and must not be replayed.
+	newest, err := store.Query(ctx, history.Query{Limit: 1})
+	if err != nil {
+		return err
+	}
+	cursor := filter.AfterID
+	if len(newest) > 0 && newest[0].ID > cursor {
+		cursor = newest[0].ID
+	}
+
+	recent, err := store.Query(ctx, filter)
+	if err != nil {
+		return err
+	}
+	slices.SortFunc(recent, func(a, b history.Command) int { return cmp.Compare(a.ID, b.ID) })
+	if err := common.PrintCommandStream(recent, output); err != nil {
+		return err
+	}
+	if len(recent) > 0 && recent[len(recent)-1].ID > cursor {
+		cursor = recent[len(recent)-1].ID
+	}
+	// The table header is only printed once, at the top
+	output.NoHeader = true
+
+	filter.AfterID = cursor
+	filter.BeforeID = 0
+	filter.Offset = 0
+	filter.Reverse = true
+	filter.Limit = 1000
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		for {
+			commands, err := store.Query(ctx, filter)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
+			if err := common.PrintCommandStream(commands, output); err != nil {
+				return err
+			}
+			if len(commands) > 0 {
+				filter.AfterID = commands[len(commands)-1].ID
+			}
+			if len(commands) < filter.Limit {
+				break
+			}
+		}
+	}
 }
@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/khelechy/consolidate/internal/common"
+	"github.com/khelechy/consolidate/pkg/history"
+)
+
+func TestFollowHistoryPrintsNewCommands(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		filter history.Query
+	}{
+		{"offset", history.Query{Limit: 2, Offset: 2}},
+		{"before-id", history.Query{Limit: 2, BeforeID: 3}},
+		{"reverse", history.Query{Limit: 2, Reverse: true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			store, err := history.Open(filepath.Join(t.TempDir(), "history.bolt"), history.Options{Backend: history.BackendBolt})
+			if err != nil {
+				t.Fatalf("Open failed: %v", err)
+			}
+			defer store.Close()
+			for _, command := range []string{"one", "two", "three", "four"} {
+				if err := store.Save(ctx, history.Command{Command: command}); err != nil {
+					t.Fatalf("Save failed: %v", err)
+				}
+			}
+
+			r, w, err := os.Pipe()
+			if err != nil {
+				t.Fatalf("Pipe failed: %v", err)
+			}
+			stdout := os.Stdout
+			os.Stdout = w
+			defer func() { os.Stdout = stdout }()
+
+			done := make(chan error, 1)
+			go func() {
+				done <- followHistory(ctx, store, tc.filter, common.OutputOptions{JSON: true}, 10*time.Millisecond)
+				w.Close()
+			}()
+			lines := make(chan string)
+			go func() {
+				scanner := bufio.NewScanner(r)
+				for scanner.Scan() {
+					var cmd history.Command
+					json.Unmarshal(scanner.Bytes(), &cmd)
+					lines <- cmd.Command
+				}
+				close(lines)
+			}()
+
+			var printed []string
+			next := func() {
+				select {
+				case line, ok := <-lines:
+					if ok {
+						printed = append(printed, line)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("Timed out after printing %q", printed)
+				}
+			}
+			next()
+			next()
+			if err := store.Save(ctx, history.Command{Command: "five"}); err != nil {
+				t.Fatalf("Save failed: %v", err)
+			}
+			next()
+
+			cancel()
+			if err := <-done; err != nil {
+				t.Errorf("followHistory failed: %v", err)
+			}
+			if len(printed) != 3 || printed[0] != "one" || printed[1] != "two" || printed[2] != "five" {
+				t.Errorf("Expected the first page and then the new command, got %q", printed)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runBashHook runs the given lines in an interactive bash with the hook
+// sourced and HISTFILE holding history, and returns the logged commands.
+func runBashHook(t *testing.T, history, input string) []string {
+	t.Helper()
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is not installed")
+	}
+	hook, err := filepath.Abs(filepath.Join("scripts", "hook.sh"))
+	if err != nil {
+		t.Fatalf("Abs failed: %v", err)
+	}
+
+	dir := t.TempDir()
+	logged := filepath.Join(dir, "logged")
+	bin := filepath.Join(dir, "consolidate")
+	// Stands in for consolidate log, writing the decoded command line
+	fake := "#!/bin/bash\nprintf '%s\\n' \"$(printf '%s' \"$2\" | base64 -d)\" >> " + logged + "\n"
+	if err := os.WriteFile(bin, []byte(fake), 0755); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	rc := filepath.Join(dir, "rc")
+	if err := os.WriteFile(rc, []byte("CONSOLIDATE_BIN="+bin+"\nsource "+hook+"\n"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	histfile := filepath.Join(dir, "history")
+	if err := os.WriteFile(histfile, []byte(history), 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	bash := exec.Command("bash", "--rcfile", rc, "-i")
+	bash.Dir = dir
+	bash.Env = append(os.Environ(), "HOME="+dir, "HISTFILE="+histfile, "PROMPT_COMMAND=")
+	bash.Stdin = strings.NewReader(input)
+	if out, err := bash.CombinedOutput(); err != nil {
+		t.Fatalf("bash failed: %v\n%s", err, out)
+	}
+
+	data, err := os.ReadFile(logged)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestBashHookSkipsPreviousSession(t *testing.T) {
+	logged := runBashHook(t, "previous-session-cmd\n", "echo one\n\necho two\nexit\n")
+	if len(logged) != 2 || logged[0] != "echo one" || logged[1] != "echo two" {
+		t.Errorf("Expected only the commands of this session, got %q", logged)
+	}
+}
+
+func TestBashHookEmptyHistory(t *testing.T) {
+	logged := runBashHook(t, "", "echo one\nexit\n")
+	if len(logged) != 1 || logged[0] != "echo one" {
+		t.Errorf("Expected the first command logged, got %q", logged)
+	}
+}
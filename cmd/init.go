@@ -6,6 +6,7 @@ import (
 
 	"github.com/khelechy/consolidate/internal/common"
 	"github.com/khelechy/consolidate/internal/storage"
+	"github.com/khelechy/consolidate/pkg/history"
 	"github.com/spf13/cobra"
 )
 
@@ -20,13 +21,24 @@ var initCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
-		dbPath, err := common.GetDBPath()
+		dbPath, err := common.GetStorePath()
 		if err != nil {
 			fmt.Printf("Error getting database path: %v\n", err)
 			os.Exit(1)
 		}
 
-		if err := storage.InitDB(dbPath); err != nil {
+		if common.GetBackend() == history.BackendSQLite {
+			var s *storage.Store
+			if s, err = storage.Open(dbPath); err == nil {
+				err = s.Close()
+			}
+		} else {
+			var store *history.Store
+			if store, err = common.OpenStore(); err == nil {
+				err = store.Close()
+			}
+		}
+		if err != nil {
 			fmt.Printf("Error initializing database: %v\n", err)
 			os.Exit(1)
 		}
@@ -2,12 +2,16 @@ package cmd
 
 import (
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/khelechy/consolidate/internal/common"
+	"github.com/khelechy/consolidate/internal/gitinfo"
 	"github.com/khelechy/consolidate/internal/storage"
+	"github.com/khelechy/consolidate/pkg/history"
 	"github.com/spf13/cobra"
 )
 
@@ -18,16 +22,31 @@ var logCmd = &cobra.Command{
 	Long:  `Manually log a command to the consolidate history database.`,
 	Args:  cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
+		// The shell hooks run log with stderr hidden, so a passphrase prompt
+		// would hang the shell; a missing key is reported instead, and every
+		// message goes to stderr to stay out of the user's terminal
+		common.Interactive = false
+
 		command := args[0]
 		sessionID, _ := cmd.Flags().GetString("session")
 		cwd, _ := cmd.Flags().GetString("cwd")
 		exitCodeStr, _ := cmd.Flags().GetString("exit-code")
 		metadata, _ := cmd.Flags().GetString("metadata")
+		metaPairs, _ := cmd.Flags().GetStringArray("meta")
+		durationMs, _ := cmd.Flags().GetInt64("duration")
+		errorType, _ := cmd.Flags().GetString("error-type")
+		pipeStatusStr, _ := cmd.Flags().GetString("pipestatus")
+		hostname, _ := cmd.Flags().GetString("hostname")
+		username, _ := cmd.Flags().GetString("user")
+		shell, _ := cmd.Flags().GetString("shell")
+		shellVersion, _ := cmd.Flags().GetString("shell-version")
+		tty, _ := cmd.Flags().GetString("tty")
+		envVars, _ := cmd.Flags().GetStringArray("env")
 		encoded, _ := cmd.Flags().GetBool("encoded")
 		if encoded {
 			decoded, err := base64.StdEncoding.DecodeString(command)
 			if err != nil {
-				fmt.Printf("Error decoding command: %v\n", err)
+				fmt.Fprintf(os.Stderr, "Error decoding command: %v\n", err)
 				os.Exit(1)
 			}
 			command = string(decoded)
@@ -40,6 +59,23 @@ var logCmd = &cobra.Command{
 			}
 		}
 
+		meta, err := common.ParseMeta(metaPairs)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		metadata, err = common.BuildMetadata(metadata, meta)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		pipeStatus, err := storage.ParsePipeStatus(pipeStatusStr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid --pipestatus: %v\n", err)
+			os.Exit(1)
+		}
+
 		if sessionID == "" {
 			sessionID = "default"
 		}
@@ -51,14 +87,68 @@ var logCmd = &cobra.Command{
 			}
 		}
 
-		_, err := common.InitAndGetDB()
-		if err != nil {
-			fmt.Printf("Error initializing database: %v\n", err)
-			os.Exit(1)
+		if hostname == "" {
+			hostname, _ = os.Hostname()
+		}
+		if username == "" {
+			username = common.CurrentUsername()
+		}
+		env := common.AllowlistedEnv()
+		for _, kv := range envVars {
+			name, value, ok := strings.Cut(kv, "=")
+			if !ok || name == "" {
+				fmt.Fprintf(os.Stderr, "Error: invalid --env value %q (use NAME=value)\n", kv)
+				os.Exit(1)
+			}
+			env[name] = value
+		}
+
+		// Git details are best effort; a broken repository must not stop logging
+		repo, _ := gitinfo.Detect(cwd)
+		if repo == nil {
+			repo = &gitinfo.Info{}
 		}
 
-		if err := storage.SaveCommand(command, sessionID, cwd, exitCode, metadata); err != nil {
-			fmt.Printf("Error saving command: %v\n", err)
+		entry := history.Command{
+			Command:      command,
+			SessionID:    sessionID,
+			CWD:          cwd,
+			ExitCode:     exitCode,
+			Metadata:     metadata,
+			DurationMs:   durationMs,
+			ErrorType:    errorType,
+			PipeStatus:   pipeStatus,
+			Hostname:     hostname,
+			Username:     username,
+			Shell:        shell,
+			ShellVersion: shellVersion,
+			TTY:          tty,
+			Env:          env,
+			GitRoot:      repo.Root,
+			GitRemote:    repo.Remote,
+			GitBranch:    repo.Branch,
+			GitCommit:    repo.Commit,
+		}
+
+		store, err := common.OpenStore()
+		if err == nil {
+			defer store.Close()
+			// Rather than lose the command while other shells hold the
+			// database, the store spools it for the next log to save
+			err = store.Save(cmd.Context(), entry)
+		}
+		var quarantined *history.QuarantineError
+		if errors.As(err, &quarantined) {
+			// Reported once, by the log that moved them aside
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", quarantined)
+			err = quarantined.Err
+		}
+		if errors.Is(err, history.ErrSpooled) {
+			fmt.Fprintln(os.Stderr, "Database busy; command spooled for the next log")
+			return
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error saving command: %v\n", err)
 			os.Exit(1)
 		}
 	},
@@ -69,6 +159,16 @@ func init() {
 	logCmd.Flags().String("session", "", "Session ID")
 	logCmd.Flags().String("cwd", "", "Current working directory")
 	logCmd.Flags().String("exit-code", "0", "Exit code")
-	logCmd.Flags().String("metadata", "", "Additional metadata")
+	logCmd.Flags().String("metadata", "", "Additional metadata, free-form or a JSON object")
+	logCmd.Flags().StringArray("meta", nil, "Metadata key=value pair (repeatable); stored as a JSON object that history, search and clean can filter on")
+	logCmd.Flags().Int64("duration", 0, "Execution time in milliseconds")
+	logCmd.Flags().String("error-type", "", "Type of error reported by the shell (e.g. PowerShell error record type)")
+	logCmd.Flags().String("pipestatus", "", "Exit status of each pipeline stage, space separated (e.g. \"0 1 0\")")
+	logCmd.Flags().String("hostname", "", "Host the command ran on (defaults to this host)")
+	logCmd.Flags().String("user", "", "User who ran the command (defaults to the current user)")
+	logCmd.Flags().String("shell", "", "Shell the command ran in")
+	logCmd.Flags().String("shell-version", "", "Version of the shell")
+	logCmd.Flags().String("tty", "", "Terminal the command ran on")
+	logCmd.Flags().StringArray("env", nil, "Environment variable to record, as NAME=value (repeatable); variables named in $"+common.EnvAllowlistVar+" are recorded automatically")
 	logCmd.Flags().Bool("encoded", false, "Command is base64 encoded")
 }
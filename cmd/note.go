@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/khelechy/consolidate/internal/common"
+	"github.com/spf13/cobra"
+)
+
+// noteCmd represents the note command
+var noteCmd = &cobra.Command{
+	Use:   "note [id] [text]",
+	Short: "Attach a note to a command in the history",
+	Long: `Attach a free-form note to a logged command, replacing any earlier note.
+An empty note removes it. Notes are shown with the command and included in
+JSON output.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		id := parseID(args[0])
+
+		store, err := common.OpenDB()
+		if err != nil {
+			fmt.Printf("Error initializing database: %v\n", err)
+			os.Exit(1)
+		}
+		defer store.Close()
+
+		if err := store.SetNote(id, args[1]); err != nil {
+			fmt.Printf("Error saving note: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(noteCmd)
+}
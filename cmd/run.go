@@ -0,0 +1,261 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/khelechy/consolidate/internal/common"
+	"github.com/khelechy/consolidate/internal/gitinfo"
+	"github.com/khelechy/consolidate/pkg/history"
+	"github.com/spf13/cobra"
+)
+
+// runCmd represents the run command
+var runCmd = &cobra.Command{
+	Use:   "run [id]",
+	Short: "Run a command from the history again",
+	Long: `Show a logged command and the directory it originally ran in, ask for
+confirmation, and run it again in your shell. The new run is logged with a
+reference to the original command's ID.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		id := parseID(args[0])
+		changeDir, _ := cmd.Flags().GetBool("cd")
+		edit, _ := cmd.Flags().GetBool("edit")
+		yes, _ := cmd.Flags().GetBool("yes")
+
+		store, err := common.OpenStore()
+		if err != nil {
+			fmt.Printf("Error initializing database: %v\n", err)
+			os.Exit(1)
+		}
+		source, err := store.Get(cmd.Context(), id)
+		// The command may run for long; other shells need the database
+		store.Close()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		dir, err := os.Getwd()
+		if err != nil {
+			fmt.Printf("Error getting current directory: %v\n", err)
+			os.Exit(1)
+		}
+		if changeDir {
+			if info, err := os.Stat(source.CWD); err != nil || !info.IsDir() {
+				fmt.Printf("Error: original directory %s no longer exists\n", source.CWD)
+				os.Exit(1)
+			}
+			dir = source.CWD
+		}
+
+		command := source.Command
+		if edit {
+			command, err = editCommand(command)
+			if err != nil {
+				fmt.Printf("Error editing command: %v\n", err)
+				os.Exit(1)
+			}
+			if strings.TrimSpace(command) == "" {
+				fmt.Println("Empty command, nothing to run.")
+				return
+			}
+		}
+
+		fmt.Printf("Command:      %s\n", command)
+		fmt.Printf("Original cwd: %s\n", source.CWD)
+		fmt.Printf("Runs in:      %s\n", dir)
+		if !yes && !confirm("Run this command?") {
+			fmt.Println("Aborted.")
+			return
+		}
+
+		shell, shellArgs := runShell()
+		exitCode, durationMs := execute(shell, append(shellArgs, command), dir)
+
+		logRun(command, dir, shell, exitCode, durationMs, struct {
+			RerunOf int  `json:"rerun_of"`
+			Edited  bool `json:"edited,omitempty"`
+		}{id, command != source.Command})
+
+		os.Exit(exitCode)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(runCmd)
+	runCmd.Flags().Bool("cd", false, "Run in the directory the command originally ran in")
+	runCmd.Flags().BoolP("edit", "e", false, "Edit the command in $EDITOR before running it")
+	runCmd.Flags().BoolP("yes", "y", false, "Run without asking for confirmation")
+}
+
+// stdin is shared by every prompt so buffered input is not lost between them
+var stdin = bufio.NewReader(os.Stdin)
+
+// prompt prints a question and returns the line typed in reply
+func prompt(question string) (string, error) {
+	fmt.Print(question)
+	answer, err := stdin.ReadString('\n')
+	if err != nil && answer == "" {
+		return "", err
+	}
+	return strings.TrimRight(answer, "\r\n"), nil
+}
+
+// confirm asks a yes/no question on the terminal, defaulting to no
+func confirm(question string) bool {
+	answer, _ := prompt(question + " [y/N] ")
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// logRun logs a command run by consolidate itself, since the hook skips
+// consolidate's own commands. The metadata is stored as JSON.
+func logRun(command, dir, shell string, exitCode int, durationMs int64, metadata any) {
+	metadataJSON, _ := json.Marshal(metadata)
+	hostname, _ := os.Hostname()
+	repo, _ := gitinfo.Detect(dir)
+	if repo == nil {
+		repo = &gitinfo.Info{}
+	}
+	entry := history.Command{
+		Command:    command,
+		SessionID:  strconv.Itoa(os.Getppid()),
+		CWD:        dir,
+		ExitCode:   exitCode,
+		Metadata:   string(metadataJSON),
+		DurationMs: durationMs,
+		Hostname:   hostname,
+		Username:   common.CurrentUsername(),
+		Shell:      strings.TrimSuffix(filepath.Base(shell), ".exe"),
+		Env:        common.AllowlistedEnv(),
+		GitRoot:    repo.Root,
+		GitRemote:  repo.Remote,
+		GitBranch:  repo.Branch,
+		GitCommit:  repo.Commit,
+	}
+	store, err := common.OpenStore()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error initializing database: %v\n", err)
+		return
+	}
+	defer store.Close()
+	err = store.Save(context.Background(), entry)
+	var quarantined *history.QuarantineError
+	if errors.As(err, &quarantined) {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", quarantined)
+		err = quarantined.Err
+	}
+	if errors.Is(err, history.ErrSpooled) {
+		fmt.Fprintln(os.Stderr, "Database busy; command spooled for the next log")
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Error saving command: %v\n", err)
+	}
+}
+
+// runShell returns the user's shell and the arguments that make it run a
+// single command line
+func runShell() (string, []string) {
+	if runtime.GOOS == "windows" {
+		if common.DetectShell() == "powershell" {
+			return "powershell", []string{"-NoProfile", "-Command"}
+		}
+		return "cmd", []string{"/C"}
+	}
+	if shell := os.Getenv("SHELL"); shell != "" {
+		return shell, []string{"-c"}
+	}
+	return "/bin/sh", []string{"-c"}
+}
+
+// execute runs the command attached to the terminal and returns its exit
+// code and how long it took
+func execute(name string, args []string, dir string) (int, int64) {
+	c := exec.Command(name, args...)
+	c.Dir = dir
+	c.Stdin = os.Stdin
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+
+	// Ctrl-C is meant for the command; consolidate keeps running to log it
+	signal.Ignore(os.Interrupt)
+	defer signal.Reset(os.Interrupt)
+
+	start := time.Now()
+	err := c.Run()
+	durationMs := time.Since(start).Milliseconds()
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return 0, durationMs
+	case errors.As(err, &exitErr) && exitErr.ExitCode() >= 0:
+		return exitErr.ExitCode(), durationMs
+	case errors.As(err, &exitErr):
+		// Killed by a signal
+		return 1, durationMs
+	default:
+		fmt.Printf("Error running command: %v\n", err)
+		return 127, durationMs
+	}
+}
+
+// editCommand opens the command in $VISUAL or $EDITOR and returns the edited
+// text
+func editCommand(command string) (string, error) {
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+		if runtime.GOOS == "windows" {
+			editor = "notepad"
+		}
+	}
+
+	f, err := os.CreateTemp("", "consolidate-run-*.sh")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(command + "\n"); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+
+	// The editor setting may carry arguments, e.g. "code --wait"
+	var c *exec.Cmd
+	if runtime.GOOS == "windows" {
+		c = exec.Command("cmd", "/C", editor+` "`+f.Name()+`"`)
+	} else {
+		c = exec.Command("sh", "-c", editor+` "$1"`, "sh", f.Name())
+	}
+	c.Stdin = os.Stdin
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	if err := c.Run(); err != nil {
+		return "", fmt.Errorf("running %s: %w", editor, err)
+	}
+
+	edited, err := os.ReadFile(f.Name())
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(edited), "\r\n"), nil
+}
@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/khelechy/consolidate/internal/common"
+	"github.com/khelechy/consolidate/internal/script"
+	"github.com/khelechy/consolidate/pkg/history"
+	"github.com/spf13/cobra"
+)
+
+// scriptCmd represents the script command
+var scriptCmd = &cobra.Command{
+	Use:   "script [query]",
+	Short: "Turn logged commands into a bash script or Markdown runbook",
+	Long: `Select commands by session, ID range or search query and write them out,
+oldest first, as a bash script or a Markdown runbook.
+
+The bash script starts with 'set -euo pipefail', changes directory wherever
+the working directory changed, and comments out commands that failed.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var filter history.Query
+		if len(args) > 0 {
+			filter.Query = args[0]
+		}
+		filter.Session, _ = cmd.Flags().GetString("session")
+		fromID, _ := cmd.Flags().GetInt("from-id")
+		toID, _ := cmd.Flags().GetInt("to-id")
+		filter.Host, _ = cmd.Flags().GetString("host")
+		inRepo, _ := cmd.Flags().GetBool("repo")
+		filter.Branch, _ = cmd.Flags().GetString("branch")
+		filter.Limit, _ = cmd.Flags().GetInt("limit")
+		markdown, _ := cmd.Flags().GetBool("markdown")
+		title, _ := cmd.Flags().GetString("title")
+		outputPath, _ := cmd.Flags().GetString("output")
+
+		if filter.Query == "" && filter.Session == "" && fromID == 0 && toID == 0 && !inRepo && filter.Branch == "" {
+			fmt.Printf("Error: select commands with a query, --session, --from-id/--to-id, --repo or --branch\n")
+			os.Exit(1)
+		}
+		if fromID < 0 || toID < 0 || (toID > 0 && toID < fromID) {
+			fmt.Printf("Error: invalid ID range %d to %d\n", fromID, toID)
+			os.Exit(1)
+		}
+		// The range is inclusive
+		if fromID > 0 {
+			filter.AfterID = fromID - 1
+		}
+		if toID > 0 {
+			filter.BeforeID = toID + 1
+		}
+		if inRepo {
+			repo, err := common.CurrentRepoRoot()
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			filter.Repo = repo
+		}
+
+		store, err := common.OpenStore()
+		if err != nil {
+			fmt.Printf("Error initializing database: %v\n", err)
+			os.Exit(1)
+		}
+		defer store.Close()
+
+		// Take the most recent matches, then put them in the order they ran
+		commands, err := store.Query(cmd.Context(), filter)
+		if err != nil {
+			fmt.Printf("Error fetching commands: %v\n", err)
+			os.Exit(1)
+		}
+		if len(commands) == 0 {
+			fmt.Println("No matching commands.")
+			os.Exit(1)
+		}
+		slices.Reverse(commands)
+
+		var out bytes.Buffer
+		mode := os.FileMode(0755)
+		if markdown {
+			err = script.WriteMarkdown(&out, commands, title)
+			mode = 0644
+		} else {
+			err = script.WriteBash(&out, commands)
+		}
+		if err != nil {
+			fmt.Printf("Error writing script: %v\n", err)
+			os.Exit(1)
+		}
+
+		if outputPath == "" {
+			fmt.Print(out.String())
+			return
+		}
+		if err := os.WriteFile(outputPath, out.Bytes(), mode); err != nil {
+			fmt.Printf("Error writing script: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Wrote %d commands to %s\n", len(commands), outputPath)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(scriptCmd)
+	scriptCmd.Flags().String("session", "", "Only include commands from this shell session")
+	scriptCmd.Flags().Int("from-id", 0, "First command ID to include")
+	scriptCmd.Flags().Int("to-id", 0, "Last command ID to include")
+	scriptCmd.Flags().String("host", "", "Only include commands run on this host")
+	scriptCmd.Flags().Bool("repo", false, "Only include commands run in the git repository containing the current directory")
+	scriptCmd.Flags().String("branch", "", "Only include commands run while this git branch was checked out")
+	scriptCmd.Flags().Int("limit", 1000, "Maximum number of commands, keeping the most recent")
+	scriptCmd.Flags().Bool("markdown", false, "Write a Markdown runbook instead of a bash script")
+	scriptCmd.Flags().String("title", "Runbook", "Title of the Markdown runbook")
+	scriptCmd.Flags().StringP("output", "o", "", "Write to this file instead of stdout")
+}
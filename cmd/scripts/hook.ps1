@@ -5,67 +5,101 @@
 # This will be set by the hook installation
 $ConsolidateBin = if ($env:CONSOLIDATE_BIN) { $env:CONSOLIDATE_BIN } else { "consolidate" }
 
+# Session context sent with every command
+$ConsolidateShell = if ($PSVersionTable.PSEdition -eq 'Core') { 'pwsh' } else { 'powershell' }
+$ConsolidateShellVersion = $PSVersionTable.PSVersion.ToString()
+
+# State carried between prompts. The history id guards against logging the
+# same entry twice when the user presses Enter on an empty line, and the last
+# seen error record tells cmdlet failures apart from native exit codes.
+$global:ConsolidateLastHistoryId = (Get-History -Count 1).Id
+$global:ConsolidateLastError = if ($Error.Count -gt 0) { $Error[0] } else { $null }
+
 # Function to log command after execution
 function Log-Command {
-    param([string]$LastCommand, [int]$ExitCode, [string]$Cwd, [string]$SessionId)
-
-    # Debug logging
-    $debugFile = "$env:USERPROFILE\consolidate_debug.log"
+    param(
+        [string]$LastCommand,
+        [int]$ExitCode,
+        [string]$ErrorType,
+        [long]$DurationMs,
+        [string]$Cwd,
+        [string]$SessionId
+    )
 
     # Skip logging if command is empty
-    if ([string]::IsNullOrWhiteSpace($LastCommand)) { 
-        return 
+    if ([string]::IsNullOrWhiteSpace($LastCommand)) {
+        return
     }
 
     # Skip logging consolidate commands to avoid recursion
-    if ($LastCommand -match '^(\./)?consolidate(\.exe)?') { 
-        return 
+    if ($LastCommand -match '^\s*(\.[\\/])?consolidate(\.exe)?') {
+        return
     }
 
     # Encode the command to avoid parsing issues
     $encodedCommand = [Convert]::ToBase64String([Text.Encoding]::UTF8.GetBytes($LastCommand))
 
-    # Log the command
+    $logArgs = @(
+        'log', $encodedCommand, '--encoded',
+        '--session', $SessionId,
+        '--cwd', $Cwd,
+        '--exit-code', $ExitCode,
+        '--duration', $DurationMs,
+        '--shell', $ConsolidateShell,
+        '--shell-version', $ConsolidateShellVersion
+    )
+    if ($ErrorType) {
+        $logArgs += @('--error-type', $ErrorType)
+    }
+
     try {
-        & $ConsolidateBin log $encodedCommand --encoded --session $SessionId --cwd $Cwd --exit-code $ExitCode 2>$null
+        & $ConsolidateBin @logArgs 2>$null | Out-Null
     } catch {
-        Add-Content $debugFile "Error executing log command: $_"
+        # Never let logging failures break the prompt
     }
 }
 
-# Set up the hook using Register-EngineEvent for command execution
-$null = Register-EngineEvent -SourceIdentifier PowerShell.Exiting -Action {
-    # This runs when PowerShell exits, but we need per-command
-    # For per-command, we might need to override prompt or use a different approach
-    # For now, this is a placeholder
-}
+# Override the prompt function to log after each command
+$ConsolidateOriginalPrompt = $function:prompt
+function global:prompt {
+    # Capture the status of the last command before anything else runs
+    $success = $?
+    $nativeExitCode = $global:LASTEXITCODE
+
+    $entry = Get-History -Count 1
+    if ($entry -and $entry.Id -ne $global:ConsolidateLastHistoryId) {
+        $global:ConsolidateLastHistoryId = $entry.Id
+
+        $lastError = if ($Error.Count -gt 0) { $Error[0] } else { $null }
+        $newError = $lastError -and -not [object]::ReferenceEquals($lastError, $global:ConsolidateLastError)
+        $global:ConsolidateLastError = $lastError
 
-# Alternative: Override the prompt function to log after each command
-$originalPrompt = $function:prompt
-function prompt {
-    # Log the last command
-    if ($?) {
         $exitCode = 0
-    } else {
-        $exitCode = 1
-    }
-    
-    # Get the last command, preferring PSReadLine for full command text
-    $lastCommand = if (Get-Module PSReadLine -ErrorAction SilentlyContinue) {
-        try {
-            [Microsoft.PowerShell.PSConsoleReadLine]::GetHistoryItems() | Select-Object -Last 1 -ExpandProperty CommandLine
-        } catch {
-            (Get-History -Count 1).CommandLine
+        $errorType = ''
+        if (-not $success) {
+            if ($newError -and $lastError.Exception.GetType().Name -ne 'NativeCommandExitException') {
+                # A cmdlet or script error: there is no exit code, so record
+                # the error record's exception type instead
+                $exitCode = 1
+                $errorType = $lastError.Exception.GetType().FullName
+            } elseif ($null -ne $nativeExitCode -and $nativeExitCode -ne 0) {
+                # A native command returned a non-zero exit code
+                $exitCode = $nativeExitCode
+            } else {
+                $exitCode = 1
+            }
         }
-    } else {
-        (Get-History -Count 1).CommandLine
+
+        $durationMs = [long]($entry.EndExecutionTime - $entry.StartExecutionTime).TotalMilliseconds
+
+        Log-Command -LastCommand $entry.CommandLine -ExitCode $exitCode -ErrorType $errorType `
+            -DurationMs $durationMs -Cwd (Get-Location).Path -SessionId $PID
     }
-    
-    # Debug
-    $debugFile = "$env:USERPROFILE\consolidate_debug.log"
-    
-    Log-Command -LastCommand $lastCommand -ExitCode $exitCode -Cwd (Get-Location).Path -SessionId $PID
+
+    # Running the consolidate binary overwrites $LASTEXITCODE; restore it so
+    # the user's session still sees the exit code of their own command
+    $global:LASTEXITCODE = $nativeExitCode
 
     # Call original prompt
-    & $originalPrompt
-}
\ No newline at end of file
+    & $ConsolidateOriginalPrompt
+}
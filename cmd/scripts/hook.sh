@@ -2,49 +2,218 @@
 
 # Consolidate hook script for bash/zsh
 # Source this in your shell profile (e.g., .bashrc, .zshrc)
+#
+# Every command line is logged exactly once, after it finishes. Zsh provides
+# preexec/precmd hooks natively. In bash they come from bash-preexec when it is
+# loaded, and otherwise from a DEBUG trap and PROMPT_COMMAND, both chained onto
+# whatever was configured before (e.g. by starship).
 
 # Get the path to the consolidate binary
 # This will be set by the hook installation
 CONSOLIDATE_BIN="${CONSOLIDATE_BIN:-consolidate}"
 
-# Function to log command after execution
-_log_command() {
-    local exit_code=$?
-    local cwd=$(pwd)
-    local session_id=$$
+# Sourcing the hook twice would log every command twice
+[[ -n "${_consolidate_hooked:-}" ]] && return 0
+_consolidate_hooked=1
 
-    # Get the last command from history
-    local last_command
+_consolidate_ran=""        # set by preexec once a command line starts running
+_consolidate_command=""    # zsh: the command line passed to preexec
+_consolidate_first=""      # bash: first simple command of the running line
+_consolidate_histnum=""    # bash: history number of the last logged command, empty until the first prompt
+_consolidate_start=0       # start time of the running command, in milliseconds
+_consolidate_now=0
+
+# Session context sent with every command
+if [[ -n "$ZSH_VERSION" ]]; then
+    _consolidate_shell=zsh _consolidate_shell_version="$ZSH_VERSION"
+else
+    _consolidate_shell=bash _consolidate_shell_version="$BASH_VERSION"
+fi
+_consolidate_tty=$(tty 2>/dev/null) || _consolidate_tty=""
+
+# Store the current time in milliseconds in _consolidate_now, without forking
+_consolidate_clock() {
     if [[ -n "$ZSH_VERSION" ]]; then
-        last_command="$_consolidate_last_command"
+        _consolidate_now=$(( EPOCHREALTIME * 1000 ))
+        _consolidate_now=${_consolidate_now%%.*}
+    elif [[ -n "${EPOCHREALTIME:-}" ]]; then
+        _consolidate_now=${EPOCHREALTIME/[.,]/}
+        _consolidate_now=$(( _consolidate_now / 1000 ))
     else
-        last_command=$(fc -ln -1 2>/dev/null | sed 's/^[[:space:]]*[0-9]*[[:space:]]*//')
+        _consolidate_now=$(( SECONDS * 1000 ))
     fi
+}
+
+# Send a finished command to consolidate
+_consolidate_log() {
+    local command="$1" exit_code="$2" pipe_status="$3" duration="$4"
 
     # Skip logging if command is empty or starts with space (bash histcontrol)
-    [[ -z "$last_command" ]] && return
-    [[ "$last_command" =~ ^[[:space:]] ]] && return
+    [[ -z "$command" ]] && return
+    [[ "$command" =~ ^[[:space:]] ]] && return
 
     # Skip logging consolidate commands to avoid recursion
-    [[ "$last_command" =~ ^(\./)?consolidate(\.exe)? ]] && return
+    [[ "$command" =~ ^(\./)?consolidate(\.exe)? ]] && return
+
+    # Only pipelines have more than one status worth recording
+    [[ "$pipe_status" == *" "* ]] || pipe_status=""
 
     # Log the command
-    encoded_command=$(echo -n "$last_command" | base64)
-    $CONSOLIDATE_BIN log "$encoded_command" --encoded --session "$session_id" --cwd "$cwd" --exit-code "$exit_code" 2>/dev/null || true
+    local encoded_command
+    encoded_command=$(printf '%s' "$command" | base64)
+    "$CONSOLIDATE_BIN" log "$encoded_command" --encoded --session "$$" --cwd "$PWD" --exit-code "$exit_code" \
+        --pipestatus "$pipe_status" --duration "$duration" --shell "$_consolidate_shell" \
+        --shell-version "$_consolidate_shell_version" --tty "$_consolidate_tty" 2>/dev/null || true
 }
 
-# Function to capture command before execution (for zsh)
-_capture_command() {
-    _consolidate_last_command="$1"
+# Remember that a command line started running, and when
+_consolidate_preexec() {
+    [[ -n "$_consolidate_ran" ]] && return 0
+    _consolidate_ran=1
+    _consolidate_command="${1:-}"
+    _consolidate_first="${BASH_COMMAND:-}"
+    _consolidate_clock
+    _consolidate_start=$_consolidate_now
 }
 
-# Set up the hook
 if [[ -n "$ZSH_VERSION" ]]; then
-    # Zsh
+    zmodload zsh/datetime 2>/dev/null
+
+    _consolidate_precmd_zsh() {
+        # Capture the exit status and the per-stage pipeline statuses in a
+        # single statement, before any other command overwrites them
+        local exit_code=$? pipe_status="${pipestatus[*]}"
+
+        # Nothing ran since the last prompt (empty line or Ctrl-C)
+        [[ -n "$_consolidate_ran" ]] || return 0
+        _consolidate_ran=""
+
+        _consolidate_clock
+        _consolidate_log "$_consolidate_command" "$exit_code" "$pipe_status" $(( _consolidate_now - _consolidate_start ))
+    }
+
     autoload -Uz add-zsh-hook
-    add-zsh-hook precmd _log_command
-    add-zsh-hook preexec _capture_command
-elif [[ -n "$BASH_VERSION" ]]; then
-    # Bash
-    PROMPT_COMMAND="_log_command"
-fi
\ No newline at end of file
+    add-zsh-hook preexec _consolidate_preexec
+    add-zsh-hook precmd _consolidate_precmd_zsh
+    return 0
+fi
+
+[[ -n "$BASH_VERSION" ]] || return 0
+
+# Print the latest history entry without timestamps
+_consolidate_history_entry() {
+    HISTTIMEFORMAT='' builtin history 1
+}
+
+# Log the command line that just finished, identified by its history number.
+# An entry whose number was already logged is only logged again when it was a
+# repeat that HISTCONTROL kept out of history; lines the user deliberately
+# kept out of history (leading space, HISTIGNORE) are not logged at all.
+_consolidate_finish() {
+    local exit_code="$1" pipe_status="$2"
+    local entry histnum command
+    entry=$(_consolidate_history_entry)
+
+    # The first prompt only records the current history entry, so the last
+    # command of a previous session is not logged again. Bash loads HISTFILE
+    # after the rc files, so this cannot be done while the hook is sourced.
+    if [[ -z "$_consolidate_histnum" ]]; then
+        _consolidate_histnum=0
+        [[ "$entry" =~ ^[[:space:]]*([0-9]+) ]] && _consolidate_histnum="${BASH_REMATCH[1]}"
+        _consolidate_ran=""
+        return 0
+    fi
+
+    # Nothing ran since the last prompt (empty line or Ctrl-C)
+    [[ -n "$_consolidate_ran" ]] || return 0
+    _consolidate_ran=""
+
+    [[ "$entry" =~ ^[[:space:]]*([0-9]+)[*[:space:]][[:space:]](.*)$ ]] || return 0
+    histnum="${BASH_REMATCH[1]}"
+    command="${BASH_REMATCH[2]}"
+
+    if [[ "$histnum" == "$_consolidate_histnum" && "$command" != "$_consolidate_first"* ]]; then
+        return 0
+    fi
+    _consolidate_histnum="$histnum"
+
+    _consolidate_clock
+    _consolidate_log "$command" "$exit_code" "$pipe_status" $(( _consolidate_now - _consolidate_start ))
+}
+
+if [[ -n "${bash_preexec_imported:-}${__bp_imported:-}" ]]; then
+    # bash-preexec owns the DEBUG trap and PROMPT_COMMAND; it restores $? for
+    # every precmd function and keeps pipeline statuses in BP_PIPESTATUS
+    _consolidate_precmd_bp() {
+        local exit_code=$? pipe_status="${BP_PIPESTATUS[*]:-}"
+        _consolidate_finish "$exit_code" "$pipe_status"
+    }
+
+    preexec_functions+=(_consolidate_preexec)
+    precmd_functions+=(_consolidate_precmd_bp)
+    return 0
+fi
+
+# Succeeds when the command is one of the PROMPT_COMMAND entries, which the
+# DEBUG trap also fires for
+_consolidate_in_prompt_command() {
+    local command="$1" part IFS=$'\n;'
+    local -a parts
+    read -rd '' -a parts <<< "${PROMPT_COMMAND[*]:-}"
+    for part in "${parts[@]}"; do
+        part="${part#"${part%%[![:space:]]*}"}"
+        part="${part%"${part##*[![:space:]]}"}"
+        [[ -n "$part" && "$part" == "$command" ]] && return 0
+    done
+    return 1
+}
+
+_consolidate_debug_trap() {
+    # Only the first command of a line matters, which keeps loops cheap
+    [[ -n "$_consolidate_ran" ]] && return 0
+    # Ignore programmable completion and the prompt's own commands
+    [[ -n "${COMP_LINE:-}" ]] && return 0
+    _consolidate_in_prompt_command "$BASH_COMMAND" && return 0
+    _consolidate_preexec
+    return 0
+}
+
+_consolidate_precmd() {
+    # Capture the exit status and the per-stage pipeline statuses in a single
+    # statement, before any other command overwrites them
+    local exit_code=$? pipe_status="${PIPESTATUS[*]}"
+
+    # starship_precmd saves the real statuses before they are overwritten, so
+    # use its copy when it was installed in front of this hook
+    if [[ "${PROMPT_COMMAND[*]:-}" == *starship_precmd*_consolidate_precmd* ]]; then
+        exit_code="${STARSHIP_CMD_STATUS:-$exit_code}"
+        pipe_status="${STARSHIP_PIPE_STATUS[*]:-$pipe_status}"
+    fi
+
+    _consolidate_finish "$exit_code" "$pipe_status"
+
+    # Hand the status on to the rest of PROMPT_COMMAND
+    return "$exit_code"
+}
+
+# Chain onto any existing DEBUG trap. It runs first so that traps relying on
+# $_ (like starship's) still see the right value.
+_consolidate_existing_trap=$(trap -p DEBUG)
+if [[ -n "$_consolidate_existing_trap" ]]; then
+    eval "_consolidate_existing_trap=( $_consolidate_existing_trap )"
+    trap "${_consolidate_existing_trap[2]}; _consolidate_debug_trap" DEBUG
+else
+    trap '_consolidate_debug_trap' DEBUG
+fi
+unset _consolidate_existing_trap
+
+# Run first in PROMPT_COMMAND, keeping whatever was there, as a string or as
+# an array (bash 5.1+)
+if [[ "$(declare -p PROMPT_COMMAND 2>/dev/null)" == "declare -a"* ]]; then
+    PROMPT_COMMAND=("_consolidate_precmd" "${PROMPT_COMMAND[@]}")
+else
+    PROMPT_COMMAND="_consolidate_precmd${PROMPT_COMMAND:+$'\n'$PROMPT_COMMAND}"
+fi
+
+# The DEBUG trap fired for the lines above; they are not a command line
+_consolidate_ran=""
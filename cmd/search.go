@@ -5,7 +5,6 @@ import (
 	"os"
 
 	"github.com/khelechy/consolidate/internal/common"
-	"github.com/khelechy/consolidate/internal/storage"
 	"github.com/spf13/cobra"
 )
 
@@ -17,23 +16,56 @@ var searchCmd = &cobra.Command{
 	Args:  cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		query := args[0]
-		limit, _ := cmd.Flags().GetInt("limit")
-		jsonOutput, _ := cmd.Flags().GetBool("json")
+		unique, _ := cmd.Flags().GetBool("unique")
 
-		_, err := common.InitAndGetDB()
+		filter, err := common.GetFilter(cmd)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		filter.Query = query
+
+		output, err := common.GetOutputOptions(cmd)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		store, err := common.OpenStore()
 		if err != nil {
 			fmt.Printf("Error initializing database: %v\n", err)
 			os.Exit(1)
 		}
+		defer store.Close()
+
+		stopPager := common.StartPager(output)
+		defer stopPager()
+
+		if unique {
+			summaries, err := store.Unique(cmd.Context(), filter)
+			if err != nil {
+				stopPager()
+				fmt.Fprintf(os.Stderr, "Error searching commands: %v\n", err)
+				os.Exit(1)
+			}
+			if err := common.PrintSummaries(summaries, output); err != nil {
+				stopPager()
+				fmt.Fprintf(os.Stderr, "Error printing commands: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
 
-		commands, err := storage.SearchCommands(query, limit)
+		commands, err := store.Query(cmd.Context(), filter)
 		if err != nil {
-			fmt.Printf("Error searching commands: %v\n", err)
+			stopPager()
+			fmt.Fprintf(os.Stderr, "Error searching commands: %v\n", err)
 			os.Exit(1)
 		}
 
-		if err := common.PrintCommands(commands, jsonOutput); err != nil {
-			fmt.Printf("Error printing commands: %v\n", err)
+		if err := common.PrintCommands(commands, output); err != nil {
+			stopPager()
+			fmt.Fprintf(os.Stderr, "Error printing commands: %v\n", err)
 			os.Exit(1)
 		}
 	},
@@ -43,4 +75,7 @@ func init() {
 	rootCmd.AddCommand(searchCmd)
 	searchCmd.Flags().Int("limit", 10, "Maximum number of results")
 	searchCmd.Flags().Bool("json", false, "Output in JSON format")
+	common.AddOutputFlags(searchCmd)
+	common.AddFilterFlags(searchCmd)
+	searchCmd.Flags().Bool("unique", false, "Collapse repeated commands, with counts, first and last use, last exit code and directories")
 }
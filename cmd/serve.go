@@ -0,0 +1,141 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/khelechy/consolidate/internal/api"
+	"github.com/khelechy/consolidate/internal/common"
+	"github.com/khelechy/consolidate/internal/peersync"
+	"github.com/spf13/cobra"
+)
+
+// serveCmd represents the serve command
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Serve the history database over HTTP",
+	Long: `Serve the history database over HTTP until interrupted.
+
+With --api, editor plugins and dashboards can list, search, tag and delete
+commands and read statistics through a JSON API under /api/v1, described by
+/api/v1/openapi.json. Requests must carry the token given with --token or
+$` + api.TokenVar + ` as "Authorization: Bearer <token>".
+
+With --sync, other machines can run 'consolidate sync <address>' against it
+to exchange commands. Requests must carry the pre-shared token given with
+--token or $` + peersync.TokenVar + `.
+
+The server listens on localhost by default, or on a Unix socket only the
+current user can open with --socket. Traffic is not encrypted: to sync
+across a network, listen on a VPN address or tunnel the port over SSH.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		serveAPI, _ := cmd.Flags().GetBool("api")
+		sync, _ := cmd.Flags().GetBool("sync")
+		addr, _ := cmd.Flags().GetString("addr")
+		socket, _ := cmd.Flags().GetString("socket")
+		token, _ := cmd.Flags().GetString("token")
+
+		if !serveAPI && !sync {
+			fmt.Println("Error: nothing to serve; use --api or --sync")
+			os.Exit(1)
+		}
+		if socket != "" && cmd.Flags().Changed("addr") {
+			fmt.Println("Error: --addr and --socket cannot be used together")
+			os.Exit(1)
+		}
+		apiToken, syncToken := token, token
+		if token == "" {
+			apiToken, syncToken = os.Getenv(api.TokenVar), os.Getenv(peersync.TokenVar)
+		}
+		if serveAPI && apiToken == "" {
+			fmt.Printf("Error: a token is required: set --token or $%s, e.g. to the output of 'openssl rand -hex 32'\n", api.TokenVar)
+			os.Exit(1)
+		}
+		if sync && syncToken == "" {
+			fmt.Printf("Error: a token is required: set --token or $%s, e.g. to the output of 'openssl rand -hex 32'\n", peersync.TokenVar)
+			os.Exit(1)
+		}
+
+		store, err := common.OpenDB()
+		if err != nil {
+			fmt.Printf("Error initializing database: %v\n", err)
+			os.Exit(1)
+		}
+		defer store.Close()
+
+		mux := http.NewServeMux()
+		var serving []string
+		if serveAPI {
+			mux.Handle("/api/", api.Handler(store, apiToken))
+			serving = append(serving, "the API")
+		}
+		if sync {
+			mux.Handle("/sync/", peersync.Handler(store, syncToken))
+			serving = append(serving, "sync")
+		}
+
+		listener, url, err := listen(addr, socket)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		srv := &http.Server{Handler: mux}
+		go func() {
+			<-ctx.Done()
+			srv.Shutdown(context.Background())
+		}()
+
+		fmt.Printf("Serving history %s for %s on %s\n", store.Origin(), strings.Join(serving, " and "), url)
+		if err := srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Printf("Error serving: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// listen opens the TCP address, or the Unix socket if one is given, and
+// returns the URL it is reached at
+func listen(addr, socket string) (net.Listener, string, error) {
+	if socket == "" {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, "", err
+		}
+		return listener, "http://" + listener.Addr().String(), nil
+	}
+
+	// A socket left behind by a server that did not shut down cleanly
+	// would make the listen fail
+	if info, err := os.Lstat(socket); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(socket)
+	}
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := os.Chmod(socket, 0600); err != nil {
+		listener.Close()
+		return nil, "", err
+	}
+	return listener, "unix:" + socket, nil
+}
+
+func init() {
+	rootCmd.AddCommand(serveCmd)
+	serveCmd.Flags().Bool("api", false, "Serve the JSON API for editor plugins and dashboards")
+	serveCmd.Flags().Bool("sync", false, "Let other machines sync with this database")
+	serveCmd.Flags().String("addr", "127.0.0.1:8750", "Address to listen on")
+	serveCmd.Flags().String("socket", "", "Listen on this Unix socket instead of a TCP address")
+	serveCmd.Flags().String("token", "", "Token clients must present (default $"+api.TokenVar+" for the API, $"+peersync.TokenVar+" for sync)")
+}
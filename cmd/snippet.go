@@ -0,0 +1,292 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/khelechy/consolidate/internal/common"
+	"github.com/khelechy/consolidate/internal/snippet"
+	"github.com/khelechy/consolidate/internal/storage"
+	"github.com/spf13/cobra"
+)
+
+// snippetCmd represents the snippet command
+var snippetCmd = &cobra.Command{
+	Use:   "snippet",
+	Short: "Manage a library of reusable command snippets",
+	Long: `Save commands from the history, or typed in, as named snippets. Snippets may
+contain {{placeholder}} parameters that are filled in when they are expanded
+or run. Snippets are stored in the history database.`,
+}
+
+// snippetSaveCmd represents the snippet save command
+var snippetSaveCmd = &cobra.Command{
+	Use:   "save [name] [command]",
+	Short: "Save a snippet",
+	Long: `Save a snippet from literal text, or from a history entry with --from.
+Use {{name}} for parameters, e.g. 'kubectl logs -f deploy/{{app}}'.`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		fromID, _ := cmd.Flags().GetInt("from")
+		description, _ := cmd.Flags().GetString("description")
+		force, _ := cmd.Flags().GetBool("force")
+
+		if (len(args) == 2) == (fromID != 0) {
+			fmt.Printf("Error: give either the command text or --from, not both\n")
+			os.Exit(1)
+		}
+
+		store, err := common.OpenDB()
+		if err != nil {
+			fmt.Printf("Error initializing database: %v\n", err)
+			os.Exit(1)
+		}
+		defer store.Close()
+
+		s := storage.Snippet{Name: args[0], Description: description}
+		if fromID != 0 {
+			source, err := store.GetCommand(fromID)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			s.Command = source.Command
+			s.SourceID = source.ID
+		} else {
+			s.Command = args[1]
+		}
+
+		if err := store.SaveSnippet(s, force); err != nil {
+			fmt.Printf("Error saving snippet: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Saved snippet %s: %s\n", s.Name, s.Command)
+	},
+}
+
+// snippetListCmd represents the snippet list command
+var snippetListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List snippets",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		listSnippets(cmd, "")
+	},
+}
+
+// snippetSearchCmd represents the snippet search command
+var snippetSearchCmd = &cobra.Command{
+	Use:   "search [query]",
+	Short: "Search snippets by name, command or description",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		listSnippets(cmd, args[0])
+	},
+}
+
+// snippetShowCmd represents the snippet show command
+var snippetShowCmd = &cobra.Command{
+	Use:   "show [name]",
+	Short: "Show a snippet and its parameters",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		jsonOutput, _ := cmd.Flags().GetBool("json")
+		s := getSnippet(args[0])
+
+		if jsonOutput {
+			printJSON(s)
+			return
+		}
+		fmt.Printf("Name:        %s\n", s.Name)
+		fmt.Printf("Command:     %s\n", s.Command)
+		if s.Description != "" {
+			fmt.Printf("Description: %s\n", s.Description)
+		}
+		if params := snippet.Params(s.Command); len(params) > 0 {
+			fmt.Printf("Parameters:  %s\n", strings.Join(params, ", "))
+		}
+		if s.SourceID != 0 {
+			fmt.Printf("Saved from:  command %d\n", s.SourceID)
+		}
+	},
+}
+
+// snippetExpandCmd represents the snippet expand command
+var snippetExpandCmd = &cobra.Command{
+	Use:   "expand [name] [param=value...]",
+	Short: "Print a snippet with its parameters filled in",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		s := getSnippet(args[0])
+		values, err := snippet.ParseValues(args[1:])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		expanded, err := snippet.Expand(s.Command, values)
+		if err != nil {
+			fmt.Printf("Error expanding snippet: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(expanded)
+	},
+}
+
+// snippetRunCmd represents the snippet run command
+var snippetRunCmd = &cobra.Command{
+	Use:   "run [name] [param=value...]",
+	Short: "Run a snippet, asking for any parameters not given",
+	Long: `Fill in the snippet's parameters from the name=value arguments, ask for any
+that are missing, confirm, and run the result in your shell. The run is
+logged with the snippet's name in its metadata.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		yes, _ := cmd.Flags().GetBool("yes")
+		s := getSnippet(args[0])
+		values, err := snippet.ParseValues(args[1:])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		for _, name := range snippet.Params(s.Command) {
+			if _, ok := values[name]; ok {
+				continue
+			}
+			value, err := prompt(name + ": ")
+			if err != nil {
+				fmt.Printf("\nError: no value for %s\n", name)
+				os.Exit(1)
+			}
+			values[name] = value
+		}
+		command, err := snippet.Expand(s.Command, values)
+		if err != nil {
+			fmt.Printf("Error expanding snippet: %v\n", err)
+			os.Exit(1)
+		}
+
+		dir, err := os.Getwd()
+		if err != nil {
+			fmt.Printf("Error getting current directory: %v\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("Command: %s\n", command)
+		if !yes && !confirm("Run this command?") {
+			fmt.Println("Aborted.")
+			return
+		}
+
+		shell, shellArgs := runShell()
+		exitCode, durationMs := execute(shell, append(shellArgs, command), dir)
+		logRun(command, dir, shell, exitCode, durationMs, struct {
+			Snippet string `json:"snippet"`
+		}{s.Name})
+
+		os.Exit(exitCode)
+	},
+}
+
+// snippetDeleteCmd represents the snippet delete command
+var snippetDeleteCmd = &cobra.Command{
+	Use:   "delete [name]",
+	Short: "Delete a snippet",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		store, err := common.OpenDB()
+		if err != nil {
+			fmt.Printf("Error initializing database: %v\n", err)
+			os.Exit(1)
+		}
+		defer store.Close()
+
+		if err := store.DeleteSnippet(args[0]); err != nil {
+			fmt.Printf("Error deleting snippet: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(snippetCmd)
+	snippetCmd.AddCommand(snippetSaveCmd, snippetListCmd, snippetSearchCmd, snippetShowCmd,
+		snippetExpandCmd, snippetRunCmd, snippetDeleteCmd)
+
+	snippetSaveCmd.Flags().Int("from", 0, "Save the command with this history ID")
+	snippetSaveCmd.Flags().StringP("description", "d", "", "What the snippet does")
+	snippetSaveCmd.Flags().Bool("force", false, "Replace an existing snippet with the same name")
+	snippetListCmd.Flags().Bool("json", false, "Output in JSON format")
+	snippetSearchCmd.Flags().Bool("json", false, "Output in JSON format")
+	snippetShowCmd.Flags().Bool("json", false, "Output in JSON format")
+	snippetRunCmd.Flags().BoolP("yes", "y", false, "Run without asking for confirmation")
+}
+
+// getSnippet opens the database and loads the named snippet, exiting on
+// failure
+func getSnippet(name string) *storage.Snippet {
+	store, err := common.OpenDB()
+	if err != nil {
+		fmt.Printf("Error initializing database: %v\n", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+
+	s, err := store.GetSnippet(name)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	return s
+}
+
+// listSnippets prints the snippets matching the query, one per line with
+// the description below
+func listSnippets(cmd *cobra.Command, query string) {
+	jsonOutput, _ := cmd.Flags().GetBool("json")
+
+	store, err := common.OpenDB()
+	if err != nil {
+		fmt.Printf("Error initializing database: %v\n", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+
+	snippets, err := store.ListSnippets(query)
+	if err != nil {
+		fmt.Printf("Error listing snippets: %v\n", err)
+		os.Exit(1)
+	}
+	if jsonOutput {
+		printJSON(snippets)
+		return
+	}
+	if len(snippets) == 0 {
+		fmt.Println("No snippets found.")
+		return
+	}
+
+	width := 0
+	for _, s := range snippets {
+		width = max(width, len(s.Name))
+	}
+	for _, s := range snippets {
+		fmt.Printf("%-*s  %s\n", width, s.Name, s.Command)
+		if s.Description != "" {
+			fmt.Printf("%-*s  # %s\n", width, "", s.Description)
+		}
+	}
+}
+
+// printJSON prints v as indented JSON
+func printJSON(v any) {
+	jsonData, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		fmt.Printf("Error marshaling to JSON: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(string(jsonData))
+}
@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/khelechy/consolidate/internal/common"
+	"github.com/khelechy/consolidate/internal/storage"
+	"github.com/spf13/cobra"
+)
+
+// starCmd represents the star command
+var starCmd = &cobra.Command{
+	Use:   "star [id]",
+	Short: "Star a command in the history",
+	Long: `Star a logged command worth keeping, or unstar it with --remove. Starring
+adds the '` + storage.StarredTag + `' tag; list starred commands with 'history --starred'.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		id := parseID(args[0])
+		remove, _ := cmd.Flags().GetBool("remove")
+
+		store, err := common.OpenDB()
+		if err != nil {
+			fmt.Printf("Error initializing database: %v\n", err)
+			os.Exit(1)
+		}
+		defer store.Close()
+
+		if remove {
+			err = store.RemoveTags(id, storage.StarredTag)
+		} else {
+			err = store.AddTags(id, storage.StarredTag)
+		}
+		if err != nil {
+			fmt.Printf("Error starring command: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(starCmd)
+	starCmd.Flags().Bool("remove", false, "Unstar the command")
+}
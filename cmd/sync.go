@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/khelechy/consolidate/internal/common"
+	"github.com/khelechy/consolidate/internal/dirsync"
+	"github.com/khelechy/consolidate/internal/peersync"
+	"github.com/khelechy/consolidate/internal/storage"
+	"github.com/spf13/cobra"
+)
+
+// syncCmd represents the sync command
+var syncCmd = &cobra.Command{
+	Use:   "sync [address] | --dir <dir>",
+	Short: "Exchange history with another machine",
+	Long: `Pull the commands another machine logged since the last sync, then push the
+ones logged here. The other machine must be running 'consolidate serve --sync'
+with the same token.
+
+Every command keeps a unique ID and the database it was first logged in, so
+syncing again, or in any direction, never duplicates it. Commands removed with
+'clean' are removed on the other side too.
+
+With --dir, sync through a directory shared by other means instead, such as a
+Syncthing folder, an NFS export or a mounted drive. Each machine appends its
+new commands to its own subdirectory as compressed segment files encrypted
+with the token, and imports the segments of the others.
+
+Without an address or directory, lists the machines synced with so far.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		token, _ := cmd.Flags().GetString("token")
+		full, _ := cmd.Flags().GetBool("full")
+		dir, _ := cmd.Flags().GetString("dir")
+		if token == "" {
+			token = os.Getenv(peersync.TokenVar)
+		}
+
+		if dir != "" && (len(args) > 0 || full) {
+			fmt.Println("Error: --dir cannot be combined with an address or --full")
+			os.Exit(1)
+		}
+
+		store, err := common.OpenDB()
+		if err != nil {
+			fmt.Printf("Error initializing database: %v\n", err)
+			os.Exit(1)
+		}
+		defer store.Close()
+
+		if dir != "" {
+			syncDir(store, dir, token)
+			return
+		}
+
+		if len(args) == 0 {
+			peers, err := store.ListSyncPeers()
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			if len(peers) == 0 {
+				fmt.Println("Not synced with any machine yet.")
+				return
+			}
+			for _, p := range peers {
+				syncedAt := p.SyncedAt
+				if syncedAt == "" {
+					syncedAt = "never completed"
+				}
+				peer := p.Peer
+				if strings.HasPrefix(peer, dirsync.PeerPrefix) {
+					peer = "shared directory"
+				}
+				fmt.Printf("%-26s  %-30s  %s\n", peer, p.Address, syncedAt)
+			}
+			return
+		}
+
+		if token == "" {
+			fmt.Printf("Error: a token is required: set --token or $%s\n", peersync.TokenVar)
+			os.Exit(1)
+		}
+
+		result, err := peersync.Sync(context.Background(), store, args[0], peersync.Options{Token: token, Full: full})
+		if err != nil {
+			fmt.Printf("Error syncing with %s: %v\n", args[0], err)
+			os.Exit(1)
+		}
+		fmt.Printf("Synced with %s\n", result.Peer)
+		fmt.Printf("  Pulled %d commands, deleted %d\n", result.Pulled, result.Deleted)
+		fmt.Printf("  Pushed %d commands, deleted %d there\n", result.Pushed, result.PeerDeleted)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(syncCmd)
+	syncCmd.Flags().String("token", "", "Pre-shared token of the other machine (default $"+peersync.TokenVar+")")
+	syncCmd.Flags().Bool("full", false, "Exchange everything again instead of resuming from the last sync")
+	syncCmd.Flags().String("dir", "", "Sync through this shared directory instead of with a server")
+}
+
+// syncDir syncs the store through a shared directory and reports what
+// changed
+func syncDir(store *storage.Store, dir, token string) {
+	if token == "" {
+		fmt.Printf("Error: a token is required to encrypt the segments: set --token or $%s\n", peersync.TokenVar)
+		os.Exit(1)
+	}
+
+	result, err := dirsync.Sync(store, dir, dirsync.Options{Token: token})
+	if err != nil {
+		fmt.Printf("Error syncing through %s: %v\n", dir, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Wrote %d segments with %d changes\n", result.Written, result.Exported)
+	fmt.Printf("Imported %d segments from %d machines: added %d commands, deleted %d\n",
+		result.Imported, result.Hosts, result.Added, result.Deleted)
+	for _, problem := range result.Problems {
+		fmt.Printf("Warning: %s\n", problem)
+	}
+	if len(result.Problems) > 0 {
+		os.Exit(1)
+	}
+}
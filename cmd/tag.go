@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/khelechy/consolidate/internal/common"
+	"github.com/spf13/cobra"
+)
+
+// tagCmd represents the tag command
+var tagCmd = &cobra.Command{
+	Use:   "tag [id] [tag...]",
+	Short: "Tag a command in the history",
+	Long: `Attach one or more tags to a logged command, or remove them with --remove.
+Find tagged commands with 'history --tag' or 'search --tag'.`,
+	Args: cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		id := parseID(args[0])
+		tags := args[1:]
+		remove, _ := cmd.Flags().GetBool("remove")
+
+		store, err := common.OpenDB()
+		if err != nil {
+			fmt.Printf("Error initializing database: %v\n", err)
+			os.Exit(1)
+		}
+		defer store.Close()
+
+		if remove {
+			err = store.RemoveTags(id, tags...)
+		} else {
+			err = store.AddTags(id, tags...)
+		}
+		if err != nil {
+			fmt.Printf("Error tagging command: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(tagCmd)
+	tagCmd.Flags().Bool("remove", false, "Remove the tags instead of adding them")
+}
+
+// parseID parses a command ID argument, exiting on anything but a positive
+// number
+func parseID(arg string) int {
+	id, err := strconv.Atoi(arg)
+	if err != nil || id <= 0 {
+		fmt.Printf("Error: invalid command ID %q\n", arg)
+		os.Exit(1)
+	}
+	return id
+}
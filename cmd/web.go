@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"context"
+	"crypto/rand"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/khelechy/consolidate/internal/api"
+	"github.com/khelechy/consolidate/internal/common"
+	"github.com/spf13/cobra"
+)
+
+//go:embed web
+var webFiles embed.FS
+
+// webCmd represents the web command
+var webCmd = &cobra.Command{
+	Use:   "web",
+	Short: "Browse the history in a web browser",
+	Long: `Serve a web interface to the history on localhost until interrupted.
+
+It searches commands, filters them by directory, session, exit code and
+date, replays sessions as a timeline, charts statistics and copies commands
+to the clipboard. Everything it needs is built into consolidate, so it works
+offline.
+
+The page talks to the JSON API of 'consolidate serve --api' with a token
+given with --token or $` + api.TokenVar + `, or a random one. The printed
+URL carries the token, so open it rather than the bare address.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		addr, _ := cmd.Flags().GetString("addr")
+		token, _ := cmd.Flags().GetString("token")
+
+		if token == "" {
+			token = os.Getenv(api.TokenVar)
+		}
+		if token == "" {
+			token = rand.Text()
+		}
+
+		store, err := common.OpenDB()
+		if err != nil {
+			fmt.Printf("Error initializing database: %v\n", err)
+			os.Exit(1)
+		}
+		defer store.Close()
+
+		static, err := fs.Sub(webFiles, "web")
+		if err != nil {
+			fmt.Printf("Error reading web interface: %v\n", err)
+			os.Exit(1)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/api/", api.Handler(store, token))
+		mux.Handle("/", http.FileServerFS(static))
+
+		listener, url, err := listen(addr, "")
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		srv := &http.Server{Handler: offlineOnly(mux)}
+		go func() {
+			<-ctx.Done()
+			srv.Shutdown(context.Background())
+		}()
+
+		// The token goes in the fragment, which browsers do not send
+		fmt.Printf("Open %s/#token=%s\n", url, token)
+		if err := srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Printf("Error serving: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// offlineOnly forbids the page to load anything from elsewhere, so it cannot
+// leak the history even if a command in it is crafted to look like markup
+func offlineOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; frame-ancestors 'none'")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		next.ServeHTTP(w, r)
+	})
+}
+
+func init() {
+	rootCmd.AddCommand(webCmd)
+	webCmd.Flags().String("addr", "127.0.0.1:8751", "Address to listen on")
+	webCmd.Flags().String("token", "", "Token the page must present (default $"+api.TokenVar+", or a random one)")
+}
@@ -0,0 +1,400 @@
+// The web interface of consolidate. It only talks to the JSON API of the
+// server it was loaded from and builds the page with DOM calls, never from
+// markup, since commands can contain anything.
+"use strict";
+
+const SVG = "http://www.w3.org/2000/svg";
+
+// The token arrives in the URL fragment and is kept for the tab only
+const token = (() => {
+  const match = location.hash.match(/token=([^&]+)/);
+  if (match) {
+    sessionStorage.setItem("token", decodeURIComponent(match[1]));
+    history.replaceState(null, "", location.pathname + "#commands");
+  }
+  return sessionStorage.getItem("token") || "";
+})();
+
+const $ = (selector, root = document) => root.querySelector(selector);
+
+// el creates an element with attributes and children
+function el(tag, attrs = {}, ...children) {
+  const node = document.createElement(tag);
+  for (const [name, value] of Object.entries(attrs)) {
+    if (name.startsWith("on")) {
+      node.addEventListener(name.slice(2), value);
+    } else if (value !== undefined && value !== null && value !== false) {
+      node.setAttribute(name, value === true ? "" : value);
+    }
+  }
+  node.append(...children.filter((c) => c !== undefined && c !== null));
+  return node;
+}
+
+function svg(tag, attrs = {}, ...children) {
+  const node = document.createElementNS(SVG, tag);
+  for (const [name, value] of Object.entries(attrs)) {
+    node.setAttribute(name, value);
+  }
+  node.append(...children);
+  return node;
+}
+
+async function api(path) {
+  const response = await fetch(path, { headers: { Authorization: "Bearer " + token } });
+  const body = await response.json().catch(() => ({}));
+  if (!response.ok) {
+    if (response.status === 401) {
+      throw new Error("Not authorized: open the URL printed by 'consolidate web', which carries the token.");
+    }
+    throw new Error(body.error || response.statusText);
+  }
+  return body;
+}
+
+function showError(err) {
+  const box = $("#error");
+  box.textContent = err ? err.message : "";
+  box.hidden = !err;
+}
+
+// Filters
+
+// localDay turns a date input into the start or end of that day in local time
+function localDay(value, end) {
+  const [y, m, d] = value.split("-").map(Number);
+  return (end ? new Date(y, m - 1, d, 23, 59, 59, 999) : new Date(y, m - 1, d)).toISOString();
+}
+
+function filterParams() {
+  const params = new URLSearchParams();
+  const set = (name, value) => value && params.set(name, value);
+  set("q", $("#q").value.trim());
+  set("dir", $("#dir").value.trim());
+  if ($("#dir").value.trim() && $("#subtree").checked) params.set("subtree", "true");
+  set("session", $("#session").value.trim());
+  set("host", $("#host").value.trim());
+  switch ($("#exit").value) {
+    case "0":
+      params.set("exit_code", "0");
+      break;
+    case "failed":
+      params.set("failed", "true");
+      break;
+    case "code":
+      set("exit_code", $("#exit-code").value);
+      break;
+  }
+  if ($("#from").value) params.set("from", localDay($("#from").value, false));
+  if ($("#to").value) params.set("to", localDay($("#to").value, true));
+  return params;
+}
+
+// Copying
+
+async function copy(text, button) {
+  try {
+    await navigator.clipboard.writeText(text);
+  } catch {
+    // Without the clipboard API, copy from a hidden text area
+    const area = el("textarea", { readonly: true, class: "offscreen" });
+    area.value = text;
+    document.body.append(area);
+    area.select();
+    document.execCommand("copy");
+    area.remove();
+  }
+  button.textContent = "Copied";
+  setTimeout(() => (button.textContent = "Copy"), 1200);
+}
+
+function copyButton(text) {
+  const button = el("button", { type: "button", class: "copy", title: "Copy to clipboard" }, "Copy");
+  button.addEventListener("click", () => copy(text, button));
+  return button;
+}
+
+// Formatting
+
+function formatTime(timestamp) {
+  return timestamp ? new Date(timestamp).toLocaleString() : "";
+}
+
+function formatDuration(ms) {
+  if (ms < 1000) return ms + " ms";
+  const s = Math.round(ms / 1000);
+  if (s < 60) return s + " s";
+  if (s < 3600) return Math.floor(s / 60) + " min " + (s % 60) + " s";
+  return Math.floor(s / 3600) + " h " + Math.floor((s % 3600) / 60) + " min";
+}
+
+function failed(cmd) {
+  return cmd.exit_code !== 0 || (cmd.pipestatus || []).some((code) => code !== 0);
+}
+
+function exitBadge(cmd) {
+  const status = cmd.pipestatus && cmd.pipestatus.length > 1 ? cmd.pipestatus.join("|") : String(cmd.exit_code || 0);
+  return el("span", { class: failed(cmd) ? "exit bad" : "exit ok" }, status);
+}
+
+// Commands
+
+let commandsNext = "";
+
+function commandRow(cmd) {
+  const session = el("a", { href: "#sessions", title: "Show this session" }, cmd.session_id || "");
+  session.addEventListener("click", (event) => {
+    event.preventDefault();
+    openSession(cmd.session_id || "", cmd.hostname || "");
+  });
+  const dir = el("a", { href: "#commands", title: "Filter by this directory" }, cmd.cwd || "");
+  dir.addEventListener("click", (event) => {
+    event.preventDefault();
+    $("#dir").value = cmd.cwd || "";
+    refresh();
+  });
+  return el(
+    "tr",
+    {},
+    el("td", { class: "when", title: cmd.hostname || "" }, formatTime(cmd.timestamp)),
+    el("td", {}, el("code", {}, cmd.command), ...(cmd.tags || []).map((tag) => el("span", { class: "tag" }, tag))),
+    el("td", { class: "dir" }, dir),
+    el("td", {}, exitBadge(cmd)),
+    el("td", { class: "session" }, session),
+    el("td", {}, copyButton(cmd.command)),
+  );
+}
+
+async function loadCommands(more) {
+  const section = $("#commands");
+  const body = $("tbody", section);
+  const page = await api(more ? commandsNext : "/api/v1/commands?" + filterParams());
+  if (!more) body.replaceChildren();
+  body.append(...page.commands.map(commandRow));
+  commandsNext = page.next || "";
+  $(".more", section).hidden = !commandsNext;
+  $(".empty", section).hidden = body.children.length > 0;
+}
+
+// Sessions
+
+let sessionsNext = "";
+
+function sessionItem(session) {
+  const item = el(
+    "li",
+    { tabindex: "0" },
+    el("div", { class: "session-head" }, el("strong", {}, session.session_id || "(no session)"), " on ", session.hostname || "unknown host"),
+    el("div", { class: "session-meta" },
+      formatTime(session.first) + " – " + formatTime(session.last) + " · " + session.commands + " commands" +
+      (session.failed ? " · " + session.failed + " failed" : "")),
+    el("code", {}, session.last_command),
+  );
+  const open = () => {
+    for (const other of item.parentNode.children) other.classList.remove("selected");
+    item.classList.add("selected");
+    showTimeline(session.session_id, session.hostname);
+  };
+  item.addEventListener("click", open);
+  item.addEventListener("keydown", (event) => event.key === "Enter" && open());
+  return item;
+}
+
+async function loadSessions(more) {
+  const section = $("#sessions");
+  const list = $(".session-list", section);
+  const page = await api(more ? sessionsNext : "/api/v1/sessions?" + filterParams());
+  if (!more) list.replaceChildren();
+  list.append(...page.sessions.map(sessionItem));
+  if (!list.children.length) list.append(el("li", { class: "empty" }, "No sessions match."));
+  sessionsNext = page.next || "";
+  $(".more", section).hidden = !sessionsNext;
+}
+
+// showTimeline lists the commands of a session oldest first, with the time
+// that passed between them
+async function showTimeline(sessionID, hostname) {
+  const timeline = $("#sessions .timeline");
+  const params = new URLSearchParams({ reverse: "true", limit: "1000" });
+  if (sessionID) params.set("session", sessionID);
+  if (hostname) params.set("host", hostname);
+  const commands = [];
+  let next = "/api/v1/commands?" + params;
+  while (next) {
+    const page = await api(next);
+    commands.push(...page.commands);
+    next = page.next;
+  }
+
+  const entries = [];
+  let previous = null;
+  for (const cmd of commands) {
+    if (previous) {
+      const gap = new Date(cmd.timestamp) - new Date(previous.timestamp);
+      if (gap >= 60000) entries.push(el("li", { class: "gap" }, formatDuration(gap) + " later"));
+    }
+    entries.push(
+      el(
+        "li",
+        { class: failed(cmd) ? "failed" : "" },
+        el("div", { class: "step-head" },
+          el("span", { class: "when" }, formatTime(cmd.timestamp)),
+          exitBadge(cmd),
+          cmd.duration_ms ? el("span", { class: "duration" }, formatDuration(cmd.duration_ms)) : null,
+          copyButton(cmd.command)),
+        el("code", {}, cmd.command),
+        el("div", { class: "dir" }, cmd.cwd || ""),
+      ),
+    );
+    previous = cmd;
+  }
+  timeline.replaceChildren(
+    el("h2", {}, "Session " + (sessionID || "(none)") + (hostname ? " on " + hostname : "")),
+    el("ol", { class: "steps" }, ...entries),
+  );
+}
+
+function openSession(sessionID, hostname) {
+  location.hash = "#sessions";
+  showTimeline(sessionID, hostname).catch(showError);
+}
+
+// Stats
+
+// barChart draws labelled vertical bars scaled to the largest value
+function barChart(values, labels, { height = 160, every = 1 } = {}) {
+  const width = Math.max(values.length * 14, 300);
+  const max = Math.max(1, ...values);
+  const step = width / Math.max(values.length, 1);
+  const chart = svg("svg", { viewBox: `0 0 ${width} ${height + 20}`, class: "bars", role: "img" });
+  values.forEach((value, i) => {
+    const h = (value / max) * height;
+    chart.append(
+      svg("rect", { x: i * step + 1, y: height - h, width: Math.max(step - 2, 1), height: h },
+        svg("title", {}, labels[i] + ": " + value)),
+    );
+    if (i % every === 0) {
+      chart.append(svg("text", { x: i * step + step / 2, y: height + 14, "text-anchor": "middle" }, labels[i]));
+    }
+  });
+  return chart;
+}
+
+// rankChart draws horizontal bars for ranked items
+function rankChart(items, onPick) {
+  const max = Math.max(1, ...items.map((item) => item.count));
+  const rowHeight = 22;
+  const chart = svg("svg", { viewBox: `0 0 400 ${items.length * rowHeight}`, class: "ranks", role: "img" });
+  items.forEach((item, i) => {
+    const y = i * rowHeight;
+    const bar = svg("rect", { x: 0, y: y + 2, width: (item.count / max) * 400, height: rowHeight - 4 },
+      svg("title", {}, item.label + ": " + item.count));
+    const label = svg("text", { x: 4, y: y + rowHeight - 7 }, item.count + "  " + item.label);
+    const group = svg("g", { class: onPick ? "pick" : "" }, bar, label);
+    if (onPick) group.addEventListener("click", () => onPick(item));
+    chart.append(group);
+  });
+  return chart;
+}
+
+// fillDays adds the days without commands between the first and last day,
+// keeping the most recent
+function fillDays(perDay, keep) {
+  if (!perDay.length) return [];
+  const counts = new Map(perDay.map((d) => [d.day, d.count]));
+  const days = [];
+  const last = new Date(perDay[perDay.length - 1].day + "T00:00:00Z");
+  for (let day = new Date(perDay[0].day + "T00:00:00Z"); day <= last; day.setUTCDate(day.getUTCDate() + 1)) {
+    const key = day.toISOString().slice(0, 10);
+    days.push({ day: key, count: counts.get(key) || 0 });
+  }
+  return days.slice(-keep);
+}
+
+async function loadStats() {
+  const section = $("#stats");
+  const stats = await api("/api/v1/stats?" + filterParams());
+
+  const totals = [
+    ["Commands", stats.commands],
+    ["Unique", stats.unique],
+    ["Failed", stats.failed],
+    ["Sessions", stats.sessions],
+    ["Hosts", stats.hosts],
+    ["Since", formatTime(stats.first)],
+  ];
+  $(".totals", section).replaceChildren(
+    ...totals.flatMap(([name, value]) => [el("div", {}, el("dt", {}, name), el("dd", {}, String(value)))]),
+  );
+
+  const days = fillDays(stats.per_day, 180);
+  $(".per-day", section).replaceChildren(
+    days.length
+      ? barChart(days.map((d) => d.count), days.map((d) => d.day.slice(5)), { every: Math.ceil(days.length / 12) })
+      : el("p", { class: "empty" }, "No commands."),
+  );
+
+  // The server counts hours in UTC
+  const shift = -Math.round(new Date().getTimezoneOffset() / 60);
+  const hours = Array.from({ length: 24 }, (_, hour) => stats.per_hour[(hour - shift + 48) % 24]);
+  $(".per-hour", section).replaceChildren(
+    barChart(hours, hours.map((_, hour) => String(hour).padStart(2, "0")), { every: 2 }),
+  );
+
+  $(".top-commands", section).replaceChildren(
+    rankChart(stats.top_commands.map((c) => ({ label: c.command, count: c.count })), (item) => {
+      $("#q").value = item.label;
+      location.hash = "#commands";
+    }),
+  );
+  $(".top-dirs", section).replaceChildren(
+    rankChart(stats.top_dirs.map((d) => ({ label: d.dir || "(unknown)", count: d.count })), (item) => {
+      $("#dir").value = item.label;
+      location.hash = "#commands";
+    }),
+  );
+}
+
+// Views
+
+const views = { commands: loadCommands, sessions: loadSessions, stats: loadStats };
+
+function currentView() {
+  const name = location.hash.slice(1);
+  return views[name] ? name : "commands";
+}
+
+function refresh() {
+  const name = currentView();
+  for (const view of Object.keys(views)) {
+    $("#" + view).hidden = view !== name;
+    $(`nav a[data-view="${view}"]`).classList.toggle("active", view === name);
+  }
+  showError(null);
+  views[name](false).catch(showError);
+}
+
+let typing;
+$("#filters").addEventListener("input", (event) => {
+  if (event.target.id === "exit") {
+    $("#exit-code").hidden = event.target.value !== "code";
+  }
+  clearTimeout(typing);
+  typing = setTimeout(refresh, event.target.type === "search" || event.target.type === "text" ? 250 : 0);
+});
+$("#filters").addEventListener("submit", (event) => {
+  event.preventDefault();
+  refresh();
+});
+$("#filters").addEventListener("reset", () => {
+  $("#exit-code").hidden = true;
+  setTimeout(refresh);
+});
+$("#commands .more").addEventListener("click", () => loadCommands(true).catch(showError));
+$("#sessions .more").addEventListener("click", () => loadSessions(true).catch(showError));
+window.addEventListener("hashchange", refresh);
+
+if (!token) {
+  showError(new Error("No token: open the URL printed by 'consolidate web', which carries it."));
+}
+refresh();
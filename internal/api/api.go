@@ -0,0 +1,322 @@
+// Package api serves the history of a store as a JSON API, for editor
+// plugins and dashboards that would otherwise shell out to consolidate and
+// parse its output. openapi.json describes it.
+package api
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/khelechy/consolidate/internal/common"
+	"github.com/khelechy/consolidate/internal/httpjson"
+	"github.com/khelechy/consolidate/internal/storage"
+)
+
+// TokenVar holds the token clients must present, so it stays out of the
+// process list
+const TokenVar = "CONSOLIDATE_API_TOKEN"
+
+// Page sizes of the list endpoints
+const (
+	defaultLimit = 50
+	maxLimit     = 1000
+)
+
+//go:embed openapi.json
+var openAPI []byte
+
+// commandPage is a page of commands
+type commandPage struct {
+	Commands []storage.Command `json:"commands"`
+	// Next is the path and query of the following page, empty on the last
+	Next string `json:"next,omitempty"`
+}
+
+// summaryPage is a page of commands grouped by their normalized text
+type summaryPage struct {
+	Commands []storage.CommandSummary `json:"commands"`
+	Next     string                   `json:"next,omitempty"`
+}
+
+// sessionPage is a page of sessions
+type sessionPage struct {
+	Sessions []storage.SessionSummary `json:"sessions"`
+	Next     string                   `json:"next,omitempty"`
+}
+
+// Handler serves the store to clients that present the token. The OpenAPI
+// description at /api/v1/openapi.json is served without one.
+func Handler(s *storage.Store, token string) http.Handler {
+	api := http.NewServeMux()
+	api.HandleFunc("GET /api/v1/commands", func(w http.ResponseWriter, r *http.Request) {
+		listCommands(w, r, s, false)
+	})
+	api.HandleFunc("GET /api/v1/search", func(w http.ResponseWriter, r *http.Request) {
+		listCommands(w, r, s, true)
+	})
+	api.HandleFunc("GET /api/v1/commands/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, ok := commandID(w, r)
+		if !ok {
+			return
+		}
+		cmd, err := s.GetCommand(id)
+		if err != nil {
+			httpjson.WriteError(w, http.StatusNotFound, err)
+			return
+		}
+		httpjson.WriteJSON(w, http.StatusOK, cmd)
+	})
+	api.HandleFunc("DELETE /api/v1/commands/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, ok := commandID(w, r)
+		if !ok {
+			return
+		}
+		if _, err := s.GetCommand(id); err != nil {
+			httpjson.WriteError(w, http.StatusNotFound, err)
+			return
+		}
+		if err := s.DeleteCommandContext(r.Context(), id); err != nil {
+			httpjson.WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	api.HandleFunc("PUT /api/v1/commands/{id}/tags/{tag}", func(w http.ResponseWriter, r *http.Request) {
+		tagCommand(w, r, s, s.AddTags)
+	})
+	api.HandleFunc("DELETE /api/v1/commands/{id}/tags/{tag}", func(w http.ResponseWriter, r *http.Request) {
+		tagCommand(w, r, s, s.RemoveTags)
+	})
+	api.HandleFunc("GET /api/v1/stats", func(w http.ResponseWriter, r *http.Request) {
+		f, err := parseFilter(r.URL.Query())
+		if err != nil {
+			httpjson.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+		stats, err := s.StatsContext(r.Context(), f)
+		if err != nil {
+			httpjson.WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+		httpjson.WriteJSON(w, http.StatusOK, stats)
+	})
+	api.HandleFunc("GET /api/v1/sessions", func(w http.ResponseWriter, r *http.Request) {
+		listSessions(w, r, s)
+	})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(openAPI)
+	})
+	mux.Handle("/api/", httpjson.RequireToken(token, api))
+	return mux
+}
+
+// listCommands serves a page of the commands matching the query. Search
+// requires q and can group repeated commands with unique=true.
+func listCommands(w http.ResponseWriter, r *http.Request, s *storage.Store, search bool) {
+	query := r.URL.Query()
+	f, err := parseFilter(query)
+	if err == nil && search && strings.TrimSpace(f.Query) == "" {
+		err = errors.New("q is required")
+	}
+	if err != nil {
+		httpjson.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// One extra row tells whether there is another page
+	limit := f.Limit
+	f.Limit++
+
+	if search && query.Get("unique") == "true" {
+		summaries, err := s.UniqueCommandsContext(r.Context(), f)
+		if err != nil {
+			httpjson.WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+		page := summaryPage{Commands: summaries}
+		if len(summaries) > limit {
+			page.Commands = summaries[:limit]
+			page.Next = nextPage(r.URL, "offset", f.Offset+limit)
+		}
+		if page.Commands == nil {
+			page.Commands = []storage.CommandSummary{}
+		}
+		httpjson.WriteJSON(w, http.StatusOK, page)
+		return
+	}
+
+	commands, err := s.QueryCommandsContext(r.Context(), f)
+	if err != nil {
+		httpjson.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+	page := commandPage{Commands: commands}
+	if len(commands) > limit {
+		page.Commands = commands[:limit]
+		// Pages in ID order continue from the last ID, so commands logged in
+		// the meantime do not shift them
+		last := page.Commands[limit-1].ID
+		switch {
+		case f.Frecency:
+			page.Next = nextPage(r.URL, "offset", f.Offset+limit)
+		case f.Reverse:
+			page.Next = nextPage(r.URL, "after_id", last)
+		default:
+			page.Next = nextPage(r.URL, "before_id", last)
+		}
+	}
+	if page.Commands == nil {
+		page.Commands = []storage.Command{}
+	}
+	httpjson.WriteJSON(w, http.StatusOK, page)
+}
+
+// listSessions serves a page of the sessions with commands matching the
+// query, most recently active first
+func listSessions(w http.ResponseWriter, r *http.Request, s *storage.Store) {
+	f, err := parseFilter(r.URL.Query())
+	if err != nil {
+		httpjson.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	limit := f.Limit
+	f.Limit++
+	sessions, err := s.Sessions(f)
+	if err != nil {
+		httpjson.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+	page := sessionPage{Sessions: sessions}
+	if len(sessions) > limit {
+		page.Sessions = sessions[:limit]
+		page.Next = nextPage(r.URL, "offset", f.Offset+limit)
+	}
+	if page.Sessions == nil {
+		page.Sessions = []storage.SessionSummary{}
+	}
+	httpjson.WriteJSON(w, http.StatusOK, page)
+}
+
+// nextPage returns the request's path and query with one parameter changed
+func nextPage(u *url.URL, name string, value int) string {
+	query := u.Query()
+	query.Set(name, strconv.Itoa(value))
+	if name != "offset" {
+		query.Del("offset")
+	}
+	return u.Path + "?" + query.Encode()
+}
+
+// tagCommand adds or removes the tag in the path and answers with the
+// updated command
+func tagCommand(w http.ResponseWriter, r *http.Request, s *storage.Store, change func(int, ...string) error) {
+	id, ok := commandID(w, r)
+	if !ok {
+		return
+	}
+	if _, err := s.GetCommand(id); err != nil {
+		httpjson.WriteError(w, http.StatusNotFound, err)
+		return
+	}
+	if err := change(id, r.PathValue("tag")); err != nil {
+		httpjson.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	cmd, err := s.GetCommand(id)
+	if err != nil {
+		httpjson.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+	httpjson.WriteJSON(w, http.StatusOK, cmd)
+}
+
+// commandID reads the command ID from the path, answering the request if it
+// is invalid
+func commandID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id <= 0 {
+		httpjson.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid command ID %q", r.PathValue("id")))
+		return 0, false
+	}
+	return id, true
+}
+
+// parseFilter builds a filter from the query parameters, which are named
+// after the flags of history and search
+func parseFilter(query url.Values) (storage.Filter, error) {
+	f := storage.Filter{
+		Query:   query.Get("q"),
+		Session: query.Get("session"),
+		Host:    query.Get("host"),
+		User:    query.Get("user"),
+		Repo:    query.Get("repo"),
+		Branch:  query.Get("branch"),
+		Dir:     query.Get("dir"),
+		Tags:    query["tag"],
+		Limit:   defaultLimit,
+	}
+
+	var err error
+	for name, dest := range map[string]*int{
+		"limit": &f.Limit, "offset": &f.Offset, "before_id": &f.BeforeID, "after_id": &f.AfterID,
+	} {
+		if value := query.Get(name); value != "" {
+			if *dest, err = strconv.Atoi(value); err != nil || *dest < 0 {
+				return f, fmt.Errorf("invalid %s %q", name, value)
+			}
+		}
+	}
+	if f.Limit == 0 || f.Limit > maxLimit {
+		return f, fmt.Errorf("limit must be between 1 and %d", maxLimit)
+	}
+
+	for name, dest := range map[string]*bool{
+		"failed": &f.Failed, "subtree": &f.Subtree, "starred": &f.Starred, "reverse": &f.Reverse,
+		"frecency": &f.Frecency,
+	} {
+		if value := query.Get(name); value != "" {
+			if *dest, err = strconv.ParseBool(value); err != nil {
+				return f, fmt.Errorf("invalid %s %q", name, value)
+			}
+		}
+	}
+
+	if value := query.Get("exit_code"); value != "" {
+		code, err := strconv.Atoi(value)
+		if err != nil {
+			return f, fmt.Errorf("invalid exit_code %q", value)
+		}
+		f.ExitCode = &code
+	}
+	// A date alone means the whole day, for both ends of the range
+	for name, dest := range map[string]**time.Time{"from": &f.From, "to": &f.To} {
+		if value := query.Get(name); value != "" {
+			t, err := common.ParseDateTime(value, name == "from")
+			if err != nil {
+				return f, fmt.Errorf("invalid %s: %w", name, err)
+			}
+			*dest = &t
+		}
+	}
+
+	for _, pair := range query["meta"] {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || key == "" {
+			return f, fmt.Errorf("invalid meta %q (use key=value)", pair)
+		}
+		if f.Meta == nil {
+			f.Meta = make(map[string]string)
+		}
+		f.Meta[key] = value
+	}
+	return f, nil
+}
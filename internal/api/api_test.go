@@ -0,0 +1,223 @@
+//go:build cgo
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/khelechy/consolidate/internal/httpjson"
+	"github.com/khelechy/consolidate/internal/storage"
+)
+
+// client calls the API of a test server
+type client struct {
+	t      *testing.T
+	server *httptest.Server
+	token  string
+}
+
+// do sends a request and decodes the JSON answer into out, if given,
+// returning the status code
+func (c *client) do(method, path string, out any) int {
+	c.t.Helper()
+	req, err := http.NewRequest(method, c.server.URL+path, nil)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := c.server.Client().Do(req)
+	if err != nil {
+		c.t.Fatalf("%s %s failed: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			c.t.Fatalf("%s %s: decoding response: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func newClient(t *testing.T) (*client, *storage.Store) {
+	t.Helper()
+	s, err := storage.Open(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	server := httptest.NewServer(Handler(s, "s3cret"))
+	t.Cleanup(server.Close)
+	return &client{t: t, server: server, token: "s3cret"}, s
+}
+
+func TestListAndSearch(t *testing.T) {
+	c, s := newClient(t)
+	for _, e := range []storage.Command{
+		{Command: "git status", Hostname: "laptop"},
+		{Command: "make", Hostname: "laptop", ExitCode: 2, Metadata: `{"job":"7"}`},
+		{Command: "git push", Hostname: "server"},
+		{Command: "git status", Hostname: "laptop"},
+		{Command: "ls", Hostname: "laptop"},
+	} {
+		if err := s.SaveEntry(e); err != nil {
+			t.Fatalf("SaveEntry failed: %v", err)
+		}
+	}
+
+	// Page through everything, newest first
+	var ids []int
+	next := "/api/v1/commands?limit=2"
+	for next != "" {
+		var page commandPage
+		if status := c.do(http.MethodGet, next, &page); status != http.StatusOK {
+			t.Fatalf("GET %s: %d", next, status)
+		}
+		for _, cmd := range page.Commands {
+			ids = append(ids, cmd.ID)
+		}
+		next = page.Next
+	}
+	if len(ids) != 5 || ids[0] != 5 || ids[4] != 1 {
+		t.Errorf("Expected IDs 5 to 1, got %v", ids)
+	}
+
+	var page commandPage
+	c.do(http.MethodGet, "/api/v1/commands?host=laptop&failed=true&meta=job=7", &page)
+	if len(page.Commands) != 1 || page.Commands[0].Command != "make" || page.Next != "" {
+		t.Errorf("Expected only make, got %+v", page)
+	}
+
+	c.do(http.MethodGet, "/api/v1/search?q=git&reverse=true", &page)
+	if len(page.Commands) != 3 || page.Commands[0].Command != "git status" {
+		t.Errorf("Expected three git commands, oldest first, got %+v", page.Commands)
+	}
+	var unique summaryPage
+	c.do(http.MethodGet, "/api/v1/search?q=git&unique=true", &unique)
+	if len(unique.Commands) != 2 || unique.Commands[0].Command != "git status" || unique.Commands[0].Count != 2 {
+		t.Errorf("Expected two unique git commands, got %+v", unique.Commands)
+	}
+
+	for _, path := range []string{"/api/v1/search", "/api/v1/commands?limit=0", "/api/v1/commands?failed=maybe",
+		"/api/v1/commands?meta=job", "/api/v1/commands?before_id=-1", "/api/v1/commands?exit_code=x",
+		"/api/v1/commands?from=yesterday"} {
+		var e httpjson.ErrorResponse
+		if status := c.do(http.MethodGet, path, &e); status != http.StatusBadRequest || e.Error == "" {
+			t.Errorf("GET %s: expected an error, got %d %+v", path, status, e)
+		}
+	}
+
+	var stats storage.HistoryStats
+	c.do(http.MethodGet, "/api/v1/stats?host=laptop", &stats)
+	if stats.Commands != 4 || stats.Failed != 1 || len(stats.TopCommands) != 3 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestSessionsAndTimeFilters(t *testing.T) {
+	c, s := newClient(t)
+	for _, e := range []storage.Command{
+		{Command: "vim main.go", SessionID: "1", Hostname: "laptop"},
+		{Command: "go test", SessionID: "1", Hostname: "laptop", ExitCode: 1},
+		{Command: "ssh server", SessionID: "2", Hostname: "laptop"},
+		{Command: "uptime", SessionID: "1", Hostname: "server"},
+	} {
+		if err := s.SaveEntry(e); err != nil {
+			t.Fatalf("SaveEntry failed: %v", err)
+		}
+	}
+
+	var sessions sessionPage
+	if status := c.do(http.MethodGet, "/api/v1/sessions?limit=2", &sessions); status != http.StatusOK {
+		t.Fatalf("GET /api/v1/sessions: %d", status)
+	}
+	if len(sessions.Sessions) != 2 || sessions.Sessions[0].Hostname != "server" || sessions.Next == "" {
+		t.Fatalf("Expected the session on server first and a next page, got %+v", sessions)
+	}
+	var rest sessionPage
+	c.do(http.MethodGet, sessions.Next, &rest)
+	if len(rest.Sessions) != 1 || rest.Sessions[0].Commands != 2 || rest.Sessions[0].Failed != 1 || rest.Next != "" {
+		t.Errorf("Expected the first session on laptop last, got %+v", rest)
+	}
+
+	var page commandPage
+	c.do(http.MethodGet, "/api/v1/commands?exit_code=1", &page)
+	if len(page.Commands) != 1 || page.Commands[0].Command != "go test" {
+		t.Errorf("Expected only go test, got %+v", page.Commands)
+	}
+	// A date alone covers the whole day
+	today := time.Now().UTC().Format("2006-01-02")
+	c.do(http.MethodGet, "/api/v1/commands?from="+today+"&to="+today, &page)
+	if len(page.Commands) != 4 {
+		t.Errorf("Expected all commands today, got %+v", page.Commands)
+	}
+	c.do(http.MethodGet, "/api/v1/commands?to=2000-01-01", &page)
+	if len(page.Commands) != 0 {
+		t.Errorf("Expected no commands in 2000, got %+v", page.Commands)
+	}
+}
+
+func TestCommandEndpoints(t *testing.T) {
+	c, s := newClient(t)
+	if err := s.SaveCommand("rm -rf build", "1", "/src", 0, ""); err != nil {
+		t.Fatalf("SaveCommand failed: %v", err)
+	}
+
+	var cmd storage.Command
+	if status := c.do(http.MethodGet, "/api/v1/commands/1", &cmd); status != http.StatusOK || cmd.Command != "rm -rf build" {
+		t.Fatalf("Expected the command, got %d %+v", status, cmd)
+	}
+	if status := c.do(http.MethodGet, "/api/v1/commands/2", nil); status != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing command, got %d", status)
+	}
+	if status := c.do(http.MethodGet, "/api/v1/commands/x", nil); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid ID, got %d", status)
+	}
+
+	if status := c.do(http.MethodPut, "/api/v1/commands/1/tags/cleanup", &cmd); status != http.StatusOK ||
+		len(cmd.Tags) != 1 || cmd.Tags[0] != "cleanup" {
+		t.Errorf("Expected the tag, got %d %+v", status, cmd)
+	}
+	if status := c.do(http.MethodPut, "/api/v1/commands/1/tags/a,b", nil); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid tag, got %d", status)
+	}
+	var untagged storage.Command
+	if status := c.do(http.MethodDelete, "/api/v1/commands/1/tags/cleanup", &untagged); status != http.StatusOK ||
+		len(untagged.Tags) != 0 {
+		t.Errorf("Expected the tag removed, got %d %+v", status, untagged)
+	}
+
+	if status := c.do(http.MethodDelete, "/api/v1/commands/1", nil); status != http.StatusNoContent {
+		t.Errorf("Expected 204, got %d", status)
+	}
+	if status := c.do(http.MethodDelete, "/api/v1/commands/1", nil); status != http.StatusNotFound {
+		t.Errorf("Expected 404 deleting again, got %d", status)
+	}
+}
+
+func TestToken(t *testing.T) {
+	c, _ := newClient(t)
+	c.token = "wrong"
+	if status := c.do(http.MethodGet, "/api/v1/commands", nil); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 with a wrong token, got %d", status)
+	}
+
+	// The description is public and valid JSON
+	var spec struct {
+		OpenAPI string         `json:"openapi"`
+		Paths   map[string]any `json:"paths"`
+	}
+	if status := c.do(http.MethodGet, "/api/v1/openapi.json", &spec); status != http.StatusOK || spec.OpenAPI == "" {
+		t.Fatalf("Expected the OpenAPI description, got %d", status)
+	}
+	for _, path := range []string{"/api/v1/commands", "/api/v1/search", "/api/v1/commands/{id}",
+		"/api/v1/commands/{id}/tags/{tag}", "/api/v1/stats", "/api/v1/sessions"} {
+		if spec.Paths[path] == nil {
+			t.Errorf("OpenAPI description lacks %s", path)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package common
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/khelechy/consolidate/internal/storage"
+)
+
+// AuditKeyFileVar overrides the location of the host's audit signing key
+const AuditKeyFileVar = "CONSOLIDATE_AUDIT_KEY_FILE"
+
+// GetAuditKeyPath returns the host's audit signing key:
+// $CONSOLIDATE_AUDIT_KEY_FILE, or audit_ed25519 next to the database
+func GetAuditKeyPath() (string, error) {
+	if path := os.Getenv(AuditKeyFileVar); path != "" {
+		return path, nil
+	}
+	dbPath, err := GetDBPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(dbPath), "audit_ed25519"), nil
+}
+
+// LoadAuditKey reads an Ed25519 key whose hex encoded seed is stored in path
+func LoadAuditKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading audit key: %w", err)
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("audit key %s does not hold a %d-byte hex encoded seed", path, ed25519.SeedSize)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// GenerateAuditKey writes a new Ed25519 key to path, which must not exist yet
+func GenerateAuditKey(path string) (ed25519.PrivateKey, error) {
+	seed := make([]byte, ed25519.SeedSize)
+	rand.Read(seed)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("creating audit key directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("creating audit key: %w", err)
+	}
+	if _, err := f.WriteString(hex.EncodeToString(seed) + "\n"); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("writing audit key: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, fmt.Errorf("writing audit key: %w", err)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// readAuditKey reads the host's audit signing key, returning nil if there
+// is none
+func readAuditKey() (ed25519.PrivateKey, error) {
+	path, err := GetAuditKeyPath()
+	if err != nil {
+		return nil, err
+	}
+	key, err := LoadAuditKey(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return key, err
+}
+
+// loadAuditSigner gives the store the host's key to sign audit entries with,
+// if audit mode is on and the key exists. Without it entries go unsigned and
+// verify reports them.
+func loadAuditSigner(s *storage.Store) error {
+	if s.Audit() == nil {
+		return nil
+	}
+	key, err := readAuditKey()
+	if err != nil {
+		return err
+	}
+	if key != nil {
+		s.SetAuditSigner(key)
+	}
+	return nil
+}
+
+// GetAuditTrustPath returns the file listing the public keys audit verify
+// trusts, audit_trusted_keys next to the database. The keys are kept outside
+// the database, since its own rows cannot vouch for who signed them.
+func GetAuditTrustPath() (string, error) {
+	dbPath, err := GetDBPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(dbPath), "audit_trusted_keys"), nil
+}
+
+// ParseAuditPublicKey decodes a hex encoded Ed25519 public key
+func ParseAuditPublicKey(s string) (ed25519.PublicKey, error) {
+	public, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(public) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("expected a %d-byte hex encoded public key", ed25519.PublicKeySize)
+	}
+	return public, nil
+}
+
+// TrustAuditKey adds a public key to the trusted keys file
+func TrustAuditKey(public ed25519.PublicKey) error {
+	path, err := GetAuditTrustPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("creating trusted keys directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("opening trusted keys: %w", err)
+	}
+	if _, err := f.WriteString(hex.EncodeToString(public) + "\n"); err != nil {
+		f.Close()
+		return fmt.Errorf("writing trusted keys: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("writing trusted keys: %w", err)
+	}
+	return nil
+}
+
+// TrustedAuditKeys returns the public keys audit verify trusts by default:
+// this host's signing key and the keys added with TrustAuditKey
+func TrustedAuditKeys() ([]ed25519.PublicKey, error) {
+	var keys []ed25519.PublicKey
+	key, err := readAuditKey()
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		keys = append(keys, key.Public().(ed25519.PublicKey))
+	}
+
+	path, err := GetAuditTrustPath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return keys, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading trusted keys: %w", err)
+	}
+	for n, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		public, err := ParseAuditPublicKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", path, n+1, err)
+		}
+		keys = append(keys, public)
+	}
+	return keys, nil
+}
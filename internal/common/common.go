@@ -1,15 +1,30 @@
 package common
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
+	"os/user"
 	"path/filepath"
 	"strings"
+	"unicode"
 
+	"github.com/khelechy/consolidate/internal/gitinfo"
 	"github.com/khelechy/consolidate/internal/storage"
+	"github.com/khelechy/consolidate/pkg/history"
 )
 
+// BackendVar selects the storage backend, "sqlite" or "bolt". It defaults
+// to sqlite, or to bolt in builds without cgo.
+const BackendVar = "CONSOLIDATE_BACKEND"
+
+// GetBackend returns the storage backend to use
+func GetBackend() string {
+	if backend := os.Getenv(BackendVar); backend != "" {
+		return backend
+	}
+	return history.DefaultBackend
+}
+
 // GetDBPath returns the path to the consolidate database
 func GetDBPath() (string, error) {
 	homeDir, err := os.UserHomeDir()
@@ -19,6 +34,25 @@ func GetDBPath() (string, error) {
 	return filepath.Join(homeDir, ".consolidate", "history.db"), nil
 }
 
+// GetStorePath returns the path to the database of the selected backend
+func GetStorePath() (string, error) {
+	dbPath, err := GetDBPath()
+	if err != nil || GetBackend() != history.BackendBolt {
+		return dbPath, err
+	}
+	return filepath.Join(filepath.Dir(dbPath), "history.bolt"), nil
+}
+
+// GetSpoolDir returns the directory holding commands that log could not save
+// because the database was busy
+func GetSpoolDir() (string, error) {
+	dbPath, err := GetDBPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(dbPath), "spool"), nil
+}
+
 // EnsureConfigDir creates the config directory if it doesn't exist
 func EnsureConfigDir() error {
 	dbPath, err := GetDBPath()
@@ -29,32 +63,103 @@ func EnsureConfigDir() error {
 	return os.MkdirAll(configDir, 0755)
 }
 
-// InitAndGetDB initializes the database and returns the path
-func InitAndGetDB() (string, error) {
+// OpenDB opens the SQLite database, unlocking it if it is encrypted. It is
+// for the commands that need what only the SQLite store has; the rest open
+// the store of either backend with OpenStore.
+func OpenDB() (*storage.Store, error) {
+	if backend := GetBackend(); backend != history.BackendSQLite {
+		return nil, fmt.Errorf("this command needs the SQLite backend, not %s", backend)
+	}
 	dbPath, err := GetDBPath()
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	s, err := storage.Open(dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("initializing database: %w", err)
+	}
+	if err := unlockDB(s); err != nil {
+		s.Close()
+		return nil, err
 	}
-	if err := storage.InitDB(dbPath); err != nil {
-		return "", fmt.Errorf("initializing database: %w", err)
+	if err := loadAuditSigner(s); err != nil {
+		s.Close()
+		return nil, err
 	}
-	return dbPath, nil
+	return s, nil
 }
 
-// PrintCommands prints the commands to stdout, either as JSON or formatted text
-func PrintCommands(commands []storage.Command, jsonOutput bool) error {
-	if jsonOutput {
-		jsonData, err := json.MarshalIndent(commands, "", "  ")
-		if err != nil {
-			return fmt.Errorf("marshaling to JSON: %w", err)
+// OpenStore opens the database of the selected backend as a history.Store,
+// unlocking it if it is encrypted. Commands it cannot save while the
+// database is busy are spooled.
+func OpenStore() (*history.Store, error) {
+	path, err := GetStorePath()
+	if err != nil {
+		return nil, err
+	}
+	spoolDir, err := GetSpoolDir()
+	if err != nil {
+		return nil, err
+	}
+	return history.Open(path, history.Options{
+		Backend:  GetBackend(),
+		Secret:   readSecret,
+		KeyCache: keyCache{},
+		AuditKey: readAuditKey,
+		SpoolDir: spoolDir,
+	})
+}
+
+// CurrentRepoRoot returns the root of the git work tree containing the
+// current directory
+func CurrentRepoRoot() (string, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", fmt.Errorf("getting current directory: %w", err)
+	}
+	info, err := gitinfo.Detect(cwd)
+	if err != nil {
+		return "", fmt.Errorf("detecting git repository: %w", err)
+	}
+	if info == nil {
+		return "", fmt.Errorf("%s is not inside a git repository", cwd)
+	}
+	return info.Root, nil
+}
+
+// EnvAllowlistVar is the environment variable listing the names of other
+// environment variables to record with each command, separated by commas or
+// spaces (e.g. "VIRTUAL_ENV,KUBECONTEXT,AWS_PROFILE")
+const EnvAllowlistVar = "CONSOLIDATE_ENV_VARS"
+
+// AllowlistedEnv returns the allowlisted environment variables that are set
+func AllowlistedEnv() map[string]string {
+	names := strings.FieldsFunc(os.Getenv(EnvAllowlistVar), func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+	env := make(map[string]string)
+	for _, name := range names {
+		if value, ok := os.LookupEnv(name); ok {
+			env[name] = value
 		}
-		fmt.Println(string(jsonData))
-	} else {
-		for _, cmd := range commands {
-			fmt.Printf("[%s] %s (exit: %d)\n", cmd.Timestamp, cmd.Command, cmd.ExitCode)
+	}
+	return env
+}
+
+// CurrentUsername returns the login name of the current user, or an empty
+// string if it cannot be determined
+func CurrentUsername() string {
+	if u, err := user.Current(); err == nil {
+		// Windows reports DOMAIN\user
+		if i := strings.LastIndex(u.Username, `\`); i >= 0 {
+			return u.Username[i+1:]
 		}
+		return u.Username
+	}
+	if name := os.Getenv("USER"); name != "" {
+		return name
 	}
-	return nil
+	return os.Getenv("USERNAME")
 }
 
 // DetectShell detects the current shell environment
@@ -0,0 +1,211 @@
+package common
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/khelechy/consolidate/internal/storage"
+	"golang.org/x/term"
+)
+
+// Environment variables that supply the secret of an encrypted database.
+// Shell hooks cannot answer a prompt, so they need one of these.
+const (
+	// PassphraseVar holds the passphrase itself
+	PassphraseVar = "CONSOLIDATE_PASSPHRASE"
+	// KeyCommandVar is a command that prints the passphrase, e.g. a password
+	// manager or keychain lookup
+	KeyCommandVar = "CONSOLIDATE_KEY_COMMAND"
+	// KeyFileVar overrides the location of the key file
+	KeyFileVar = "CONSOLIDATE_KEY_FILE"
+	// KeyCacheVar overrides the directory keeping the keys derived from
+	// passphrases, or turns the cache off when set to "off"
+	KeyCacheVar = "CONSOLIDATE_KEY_CACHE"
+)
+
+// Interactive is false in commands run by the shell hooks, which must never
+// wait for a passphrase at a prompt the user cannot see
+var Interactive = true
+
+// GetKeyFilePath returns the key file used by databases encrypted with a
+// key file: $CONSOLIDATE_KEY_FILE, or key next to the database
+func GetKeyFilePath() (string, error) {
+	if path := os.Getenv(KeyFileVar); path != "" {
+		return path, nil
+	}
+	dbPath, err := GetDBPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(dbPath), "key"), nil
+}
+
+// ReadKeyFile reads a hex encoded key
+func ReadKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading key file: %w", err)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != storage.KeySize {
+		return nil, fmt.Errorf("key file %s does not hold a %d-byte hex encoded key", path, storage.KeySize)
+	}
+	return key, nil
+}
+
+// GenerateKeyFile writes a new random key to path, which must not exist yet
+func GenerateKeyFile(path string) ([]byte, error) {
+	key := make([]byte, storage.KeySize)
+	rand.Read(key)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("creating key file directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("creating key file: %w", err)
+	}
+	if _, err := f.WriteString(hex.EncodeToString(key) + "\n"); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("writing key file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, fmt.Errorf("writing key file: %w", err)
+	}
+	return key, nil
+}
+
+// ReadPassphrase gets the passphrase from $CONSOLIDATE_PASSPHRASE, the
+// output of $CONSOLIDATE_KEY_COMMAND, or a prompt on the terminal. When
+// prompting for a new passphrase, confirm asks for it twice.
+func ReadPassphrase(confirm bool) ([]byte, error) {
+	if passphrase := os.Getenv(PassphraseVar); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+
+	if command := os.Getenv(KeyCommandVar); command != "" {
+		var c *exec.Cmd
+		if runtime.GOOS == "windows" {
+			c = exec.Command("cmd", "/C", command)
+		} else {
+			c = exec.Command("sh", "-c", command)
+		}
+		c.Stderr = os.Stderr
+		out, err := c.Output()
+		if err != nil {
+			return nil, fmt.Errorf("running $%s: %w", KeyCommandVar, err)
+		}
+		return []byte(strings.TrimRight(string(out), "\r\n")), nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !Interactive || !term.IsTerminal(fd) {
+		if keyCacheDir() != "" {
+			return nil, fmt.Errorf("the database is encrypted: set $%s or $%s, or run any consolidate command to enter the passphrase for this session",
+				PassphraseVar, KeyCommandVar)
+		}
+		return nil, fmt.Errorf("the database is encrypted: set $%s or $%s", PassphraseVar, KeyCommandVar)
+	}
+	fmt.Fprint(os.Stderr, "Passphrase: ")
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("reading passphrase: %w", err)
+	}
+	if confirm {
+		fmt.Fprint(os.Stderr, "Repeat passphrase: ")
+		again, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, fmt.Errorf("reading passphrase: %w", err)
+		}
+		if string(again) != string(passphrase) {
+			return nil, fmt.Errorf("passphrases do not match")
+		}
+	}
+	return passphrase, nil
+}
+
+// readSecret gets the secret of a database encrypted with the key
+// derivation kdf: the key file, or the passphrase
+func readSecret(kdf string) ([]byte, error) {
+	if kdf == storage.KDFKeyFile {
+		path, err := GetKeyFilePath()
+		if err != nil {
+			return nil, err
+		}
+		return ReadKeyFile(path)
+	}
+	return ReadPassphrase(false)
+}
+
+// unlockDB unlocks the store if it is encrypted
+func unlockDB(s *storage.Store) error {
+	if s.Encryption() == nil {
+		return nil
+	}
+	return s.UnlockWith(readSecret, keyCache{})
+}
+
+// keyCacheDir returns the directory of the key cache: $CONSOLIDATE_KEY_CACHE,
+// or consolidate in $XDG_RUNTIME_DIR, which is private to the user, kept in
+// memory and emptied at logout. It is empty when there is no cache.
+func keyCacheDir() string {
+	dir := os.Getenv(KeyCacheVar)
+	if dir == "off" {
+		return ""
+	}
+	if dir == "" {
+		if xdg := os.Getenv("XDG_RUNTIME_DIR"); xdg != "" {
+			dir = filepath.Join(xdg, "consolidate")
+		}
+	}
+	return dir
+}
+
+// keyCache keeps the keys derived from passphrases in keyCacheDir, so that
+// Argon2id runs once a session rather than before every prompt, and the
+// shell hooks can log to a database whose passphrase was typed once
+type keyCache struct{}
+
+func (keyCache) Key(id string) []byte {
+	dir := keyCacheDir()
+	if dir == "" {
+		return nil
+	}
+	key, err := ReadKeyFile(filepath.Join(dir, id+".key"))
+	if err != nil {
+		return nil
+	}
+	return key
+}
+
+// SetKey caches the key, on a best effort basis: without the cache the
+// passphrase is only asked for again
+func (keyCache) SetKey(id string, key []byte) {
+	dir := keyCacheDir()
+	if dir == "" || os.MkdirAll(dir, 0700) != nil {
+		return
+	}
+	os.WriteFile(filepath.Join(dir, id+".key"), []byte(hex.EncodeToString(key)+"\n"), 0600)
+}
+
+// CacheKey caches the key of a database newly encrypted with a passphrase,
+// so the shell hooks can log to it straight away
+func CacheKey(settings *storage.EncryptionSettings, passphrase []byte) error {
+	if keyCacheDir() == "" {
+		return nil
+	}
+	key, err := storage.DeriveKey(settings, passphrase)
+	if err != nil {
+		return err
+	}
+	keyCache{}.SetKey(settings.CacheID(), key)
+	return nil
+}
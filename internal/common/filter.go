@@ -0,0 +1,86 @@
+package common
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/khelechy/consolidate/pkg/history"
+	"github.com/spf13/cobra"
+)
+
+// AddFilterFlags registers the filter and paging flags shared by the
+// commands that read history. Each command declares its own --limit, since
+// the defaults differ.
+func AddFilterFlags(cmd *cobra.Command) {
+	cmd.Flags().Bool("failed", false, "Only show commands that failed, including any failed pipeline stage")
+	cmd.Flags().String("host", "", "Only show commands run on this host")
+	cmd.Flags().String("user", "", "Only show commands run by this user")
+	cmd.Flags().Bool("repo", false, "Only show commands run in the git repository containing the current directory")
+	cmd.Flags().String("branch", "", "Only show commands run while this git branch was checked out")
+	cmd.Flags().StringArray("tag", nil, "Only show commands with this tag (repeatable; all must match)")
+	cmd.Flags().Bool("starred", false, "Only show starred commands")
+	cmd.Flags().StringArray("meta", nil, "Only show commands with this metadata key=value (repeatable; all must match)")
+	cmd.Flags().Int("offset", 0, "Skip this many matching commands")
+	cmd.Flags().Int("before-id", 0, "Only show commands with an ID below this one (next page of newest-first output)")
+	cmd.Flags().Int("after-id", 0, "Only show commands with an ID above this one")
+	cmd.Flags().Bool("reverse", false, "Show the oldest commands first")
+}
+
+// GetFilter builds a history query from the flags registered by
+// AddFilterFlags and the command's --limit
+func GetFilter(cmd *cobra.Command) (history.Query, error) {
+	var f history.Query
+	f.Limit, _ = cmd.Flags().GetInt("limit")
+	f.Failed, _ = cmd.Flags().GetBool("failed")
+	f.Host, _ = cmd.Flags().GetString("host")
+	f.User, _ = cmd.Flags().GetString("user")
+	inRepo, _ := cmd.Flags().GetBool("repo")
+	f.Branch, _ = cmd.Flags().GetString("branch")
+	f.Tags, _ = cmd.Flags().GetStringArray("tag")
+	f.Starred, _ = cmd.Flags().GetBool("starred")
+	metaPairs, _ := cmd.Flags().GetStringArray("meta")
+	f.Offset, _ = cmd.Flags().GetInt("offset")
+	f.BeforeID, _ = cmd.Flags().GetInt("before-id")
+	f.AfterID, _ = cmd.Flags().GetInt("after-id")
+	f.Reverse, _ = cmd.Flags().GetBool("reverse")
+
+	if f.Offset < 0 || f.BeforeID < 0 || f.AfterID < 0 {
+		return f, fmt.Errorf("--offset, --before-id and --after-id cannot be negative")
+	}
+
+	meta, err := ParseMeta(metaPairs)
+	if err != nil {
+		return f, err
+	}
+	f.Meta = meta
+
+	if inRepo {
+		repo, err := CurrentRepoRoot()
+		if err != nil {
+			return f, err
+		}
+		f.Repo = repo
+	}
+	return f, nil
+}
+
+// ParseDateTime parses a datetime string, accepting both RFC3339 and date-only formats
+func ParseDateTime(input string, isFrom bool) (time.Time, error) {
+	// First try RFC3339 format
+	if t, err := time.Parse(time.RFC3339, input); err == nil {
+		return t, nil
+	}
+
+	// If that fails, try date-only format (YYYY-MM-DD)
+	if t, err := time.Parse("2006-01-02", input); err == nil {
+		if isFrom {
+			// A start is the start of the day
+			return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC), nil
+		} else {
+			// An end is the end of the day
+			return time.Date(t.Year(), t.Month(), t.Day(), 23, 59, 59, 999999999, time.UTC), nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid datetime format: %s (use RFC3339 or YYYY-MM-DD)", input)
+}
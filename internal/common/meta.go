@@ -0,0 +1,49 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ParseMeta parses repeated --meta key=value flags
+func ParseMeta(pairs []string) (map[string]string, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	meta := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid --meta value %q (use key=value)", pair)
+		}
+		meta[key] = value
+	}
+	return meta, nil
+}
+
+// BuildMetadata combines the --metadata and --meta flags of log into the
+// stored metadata. Without --meta the --metadata text is kept as it is, so
+// free-form strings still work. With --meta the result is a JSON object:
+// the --metadata object, if any, with the key/value pairs set on top.
+func BuildMetadata(metadata string, meta map[string]string) (string, error) {
+	if len(meta) == 0 {
+		return metadata, nil
+	}
+
+	object := make(map[string]any)
+	if strings.TrimSpace(metadata) != "" {
+		if err := json.Unmarshal([]byte(metadata), &object); err != nil || object == nil {
+			return "", fmt.Errorf("--meta can only be combined with --metadata holding a JSON object")
+		}
+	}
+	for key, value := range meta {
+		object[key] = value
+	}
+
+	encoded, err := json.Marshal(object)
+	if err != nil {
+		return "", fmt.Errorf("encoding metadata: %w", err)
+	}
+	return string(encoded), nil
+}
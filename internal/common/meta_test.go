@@ -0,0 +1,48 @@
+package common
+
+import "testing"
+
+func TestParseMeta(t *testing.T) {
+	meta, err := ParseMeta([]string{"job=42", "url=http://x/?a=b", "empty="})
+	if err != nil {
+		t.Fatalf("ParseMeta failed: %v", err)
+	}
+	if meta["job"] != "42" || meta["url"] != "http://x/?a=b" || meta["empty"] != "" {
+		t.Errorf("Unexpected metadata: %v", meta)
+	}
+	if _, err := ParseMeta([]string{"=value"}); err == nil {
+		t.Error("Expected an error for an empty key")
+	}
+	if _, err := ParseMeta([]string{"job"}); err == nil {
+		t.Error("Expected an error for a pair without =")
+	}
+}
+
+func TestBuildMetadata(t *testing.T) {
+	tests := []struct {
+		metadata string
+		meta     map[string]string
+		expected string
+	}{
+		{"free-form text", nil, "free-form text"},
+		{"", map[string]string{"job": "42", "ticket": "OPS-1"}, `{"job":"42","ticket":"OPS-1"}`},
+		{`{"job": 1, "ci": true}`, map[string]string{"job": "2"}, `{"ci":true,"job":"2"}`},
+	}
+	for _, tt := range tests {
+		result, err := BuildMetadata(tt.metadata, tt.meta)
+		if err != nil {
+			t.Errorf("BuildMetadata(%q) failed: %v", tt.metadata, err)
+			continue
+		}
+		if result != tt.expected {
+			t.Errorf("BuildMetadata(%q) = %s, expected %s", tt.metadata, result, tt.expected)
+		}
+	}
+
+	if _, err := BuildMetadata("text", map[string]string{"job": "1"}); err == nil {
+		t.Error("Expected an error combining --meta with non-JSON metadata")
+	}
+	if _, err := BuildMetadata("[1]", map[string]string{"job": "1"}); err == nil {
+		t.Error("Expected an error combining --meta with a JSON array")
+	}
+}
@@ -0,0 +1,332 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+
+	"github.com/khelechy/consolidate/pkg/history"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+// OutputOptions controls how commands are printed
+type OutputOptions struct {
+	// JSON prints the commands as JSON instead of text
+	JSON bool
+	// Format is a text/template executed once per command
+	Format string
+	// Columns prints a table with these columns
+	Columns []string
+	// NoHeader leaves out the table's header row
+	NoHeader bool
+	// Color is "auto", "always" or "never"; auto colors output to a terminal
+	Color string
+	// Width is the terminal width that tables are fitted to, 0 if unknown
+	Width int
+	// Pager sends the output through $PAGER
+	Pager bool
+}
+
+// column is a field of a command that can be shown in table output
+type column struct {
+	header string
+	value  func(history.Command) string
+}
+
+// columns maps the names accepted by --columns to their definitions
+var columns = map[string]column{
+	"id":         {"ID", func(c history.Command) string { return strconv.Itoa(c.ID) }},
+	"timestamp":  {"TIMESTAMP", func(c history.Command) string { return c.Timestamp }},
+	"command":    {"COMMAND", func(c history.Command) string { return c.Command }},
+	"exit":       {"EXIT", func(c history.Command) string { return strconv.Itoa(c.ExitCode) }},
+	"pipestatus": {"PIPESTATUS", func(c history.Command) string { return strings.Trim(fmt.Sprint(c.PipeStatus), "[]") }},
+	"duration":   {"DURATION", func(c history.Command) string { return strconv.FormatInt(c.DurationMs, 10) + "ms" }},
+	"session":    {"SESSION", func(c history.Command) string { return c.SessionID }},
+	"cwd":        {"CWD", func(c history.Command) string { return c.CWD }},
+	"host":       {"HOST", func(c history.Command) string { return c.Hostname }},
+	"user":       {"USER", func(c history.Command) string { return c.Username }},
+	"shell":      {"SHELL", func(c history.Command) string { return c.Shell }},
+	"repo":       {"REPO", func(c history.Command) string { return c.GitRoot }},
+	"branch":     {"BRANCH", func(c history.Command) string { return c.GitBranch }},
+	"tags":       {"TAGS", func(c history.Command) string { return strings.Join(c.Tags, ",") }},
+	"note":       {"NOTE", func(c history.Command) string { return c.Note }},
+}
+
+const (
+	colorRed   = "\x1b[31m"
+	colorReset = "\x1b[0m"
+)
+
+// AddOutputFlags registers the flags read by GetOutputOptions, except --json
+// which every command declares itself
+func AddOutputFlags(cmd *cobra.Command) {
+	names := make([]string, 0, len(columns))
+	for name := range columns {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	cmd.Flags().String("format", "", `Go template applied to each command, e.g. '{{.ID}}\t{{.CWD}}\t{{.Command}}'`)
+	cmd.Flags().String("columns", "", "Show a table with these comma-separated columns: "+strings.Join(names, ", "))
+	cmd.Flags().Bool("no-header", false, "Leave out the header row of --columns output")
+	cmd.Flags().String("color", "auto", "Highlight failed commands: auto, always or never")
+	cmd.Flags().Bool("no-pager", false, "Do not send output to $PAGER")
+}
+
+// GetOutputOptions reads and validates the output flags of a command. Whether
+// stdout is a terminal is settled here, before a pager replaces it.
+func GetOutputOptions(cmd *cobra.Command) (OutputOptions, error) {
+	var opts OutputOptions
+	opts.JSON, _ = cmd.Flags().GetBool("json")
+	opts.Format, _ = cmd.Flags().GetString("format")
+	columnList, _ := cmd.Flags().GetString("columns")
+	opts.NoHeader, _ = cmd.Flags().GetBool("no-header")
+	opts.Color, _ = cmd.Flags().GetString("color")
+	noPager, _ := cmd.Flags().GetBool("no-pager")
+
+	for _, name := range strings.Split(columnList, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if _, ok := columns[name]; !ok {
+			return opts, fmt.Errorf("unknown column %q", name)
+		}
+		opts.Columns = append(opts.Columns, name)
+	}
+
+	modes := 0
+	for _, set := range []bool{opts.JSON, opts.Format != "", len(opts.Columns) > 0} {
+		if set {
+			modes++
+		}
+	}
+	if modes > 1 {
+		return opts, fmt.Errorf("--json, --format and --columns cannot be combined")
+	}
+
+	isTerminal := term.IsTerminal(int(os.Stdout.Fd()))
+	switch opts.Color {
+	case "auto":
+		opts.Color = "never"
+		if isTerminal && os.Getenv("NO_COLOR") == "" {
+			opts.Color = "always"
+		}
+	case "always", "never":
+	default:
+		return opts, fmt.Errorf("invalid --color value %q (use auto, always or never)", opts.Color)
+	}
+	if isTerminal {
+		opts.Width, _, _ = term.GetSize(int(os.Stdout.Fd()))
+		opts.Pager = !noPager
+	}
+
+	if opts.Format != "" {
+		if _, err := opts.template(); err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
+
+// red wraps s in red when coloring is enabled
+func (o OutputOptions) red(s string) string {
+	if o.Color != "always" {
+		return s
+	}
+	return colorRed + s + colorReset
+}
+
+// template parses the --format template. Escaped tabs and newlines are
+// expanded since they are awkward to type in a shell, and every command ends
+// with a newline.
+func (o OutputOptions) template() (*template.Template, error) {
+	format := strings.NewReplacer(`\t`, "\t", `\n`, "\n").Replace(o.Format)
+	tmpl, err := template.New("format").Funcs(template.FuncMap{
+		"red":  o.red,
+		"join": strings.Join,
+	}).Parse(format + "\n")
+	if err != nil {
+		return nil, fmt.Errorf("parsing --format template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// PrintCommands prints the commands to stdout as JSON, through the format
+// template, as a table, or as the default text
+func PrintCommands(commands []history.Command, opts OutputOptions) error {
+	switch {
+	case opts.JSON:
+		jsonData, err := json.MarshalIndent(commands, "", "  ")
+		if err != nil {
+			return fmt.Errorf("marshaling to JSON: %w", err)
+		}
+		fmt.Println(string(jsonData))
+	case opts.Format != "":
+		return executeTemplate(os.Stdout, opts, commands)
+	case len(opts.Columns) > 0:
+		printTable(os.Stdout, commands, opts)
+	default:
+		for _, cmd := range commands {
+			status := fmt.Sprintf("exit: %d", cmd.ExitCode)
+			if len(cmd.PipeStatus) > 1 {
+				status += ", pipestatus: " + strings.Trim(fmt.Sprint(cmd.PipeStatus), "[]")
+			}
+			if cmd.Failed() {
+				status = opts.red(status)
+			}
+			tags := ""
+			for _, tag := range cmd.Tags {
+				tags += " #" + tag
+			}
+			fmt.Printf("[%s] %s (%s)%s\n", cmd.Timestamp, cmd.Command, status, tags)
+			if cmd.Note != "" {
+				fmt.Printf("    note: %s\n", cmd.Note)
+			}
+		}
+	}
+	return nil
+}
+
+// PrintCommandStream prints commands as they arrive while following the
+// history. JSON output has one object per line so it can be consumed
+// incrementally.
+func PrintCommandStream(commands []history.Command, opts OutputOptions) error {
+	if !opts.JSON {
+		return PrintCommands(commands, opts)
+	}
+	for _, cmd := range commands {
+		jsonData, err := json.Marshal(cmd)
+		if err != nil {
+			return fmt.Errorf("marshaling to JSON: %w", err)
+		}
+		fmt.Println(string(jsonData))
+	}
+	return nil
+}
+
+// PrintSummaries prints command summaries to stdout, either as JSON, through
+// the format template, or as formatted text
+func PrintSummaries(summaries []history.Summary, opts OutputOptions) error {
+	switch {
+	case opts.JSON:
+		jsonData, err := json.MarshalIndent(summaries, "", "  ")
+		if err != nil {
+			return fmt.Errorf("marshaling to JSON: %w", err)
+		}
+		fmt.Println(string(jsonData))
+	case opts.Format != "":
+		return executeTemplate(os.Stdout, opts, summaries)
+	case len(opts.Columns) > 0:
+		return fmt.Errorf("--columns is not supported for grouped output")
+	default:
+		for _, s := range summaries {
+			lastExit := fmt.Sprintf("last exit: %d", s.LastExitCode)
+			if s.LastExitCode != 0 {
+				lastExit = opts.red(lastExit)
+			}
+			fmt.Printf("[%s .. %s] %s (count: %d, %s, dirs: %s)\n",
+				s.FirstSeen, s.LastSeen, s.Command, s.Count, lastExit, strings.Join(s.Dirs, ", "))
+		}
+	}
+	return nil
+}
+
+// executeTemplate runs the format template once for every item
+func executeTemplate[T any](w io.Writer, opts OutputOptions, items []T) error {
+	tmpl, err := opts.template()
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if err := tmpl.Execute(w, item); err != nil {
+			return fmt.Errorf("executing --format template: %w", err)
+		}
+	}
+	return nil
+}
+
+// printTable prints the selected columns aligned. When the terminal width is
+// known, the command column (or the last column when it is not shown) is
+// truncated so that each row fits.
+func printTable(w io.Writer, commands []history.Command, opts OutputOptions) {
+	rows := make([][]string, 0, len(commands)+1)
+	if !opts.NoHeader {
+		header := make([]string, len(opts.Columns))
+		for i, name := range opts.Columns {
+			header[i] = columns[name].header
+		}
+		rows = append(rows, header)
+	}
+	for _, cmd := range commands {
+		row := make([]string, len(opts.Columns))
+		for i, name := range opts.Columns {
+			// Multi-line commands would break the table
+			row[i] = strings.ReplaceAll(columns[name].value(cmd), "\n", " ")
+		}
+		rows = append(rows, row)
+	}
+
+	widths := make([]int, len(opts.Columns))
+	for _, row := range rows {
+		for i, cell := range row {
+			widths[i] = max(widths[i], utf8.RuneCountInString(cell))
+		}
+	}
+
+	const gap = 2
+	flexible := slices.Index(opts.Columns, "command")
+	if flexible < 0 {
+		flexible = len(opts.Columns) - 1
+	}
+	if opts.Width > 0 {
+		total := 0
+		for _, width := range widths {
+			total += width + gap
+		}
+		total -= gap
+		if total > opts.Width {
+			widths[flexible] = max(widths[flexible]-(total-opts.Width), len(columns[opts.Columns[flexible]].header))
+		}
+	}
+
+	exitColumn := slices.Index(opts.Columns, "exit")
+	for r, row := range rows {
+		failed := false
+		if cmdIndex := r - (len(rows) - len(commands)); cmdIndex >= 0 {
+			failed = commands[cmdIndex].Failed()
+		}
+
+		var line strings.Builder
+		for i, cell := range row {
+			cell = truncate(cell, widths[i])
+			padding := ""
+			if i < len(row)-1 {
+				padding = strings.Repeat(" ", widths[i]-utf8.RuneCountInString(cell)+gap)
+			}
+			if failed && (i == exitColumn || (exitColumn < 0 && i == flexible)) {
+				cell = opts.red(cell)
+			}
+			line.WriteString(cell + padding)
+		}
+		fmt.Fprintln(w, line.String())
+	}
+}
+
+// truncate shortens s to at most width runes, marking the cut with an ellipsis
+func truncate(s string, width int) string {
+	if utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	if width <= 1 {
+		return string([]rune(s)[:width])
+	}
+	return string([]rune(s)[:width-1]) + "…"
+}
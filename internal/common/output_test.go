@@ -0,0 +1,54 @@
+package common
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/khelechy/consolidate/pkg/history"
+)
+
+func TestPrintTable(t *testing.T) {
+	commands := []history.Command{
+		{ID: 12, Command: "make | tee build.log", ExitCode: 0, PipeStatus: []int{2, 0}, CWD: "/src"},
+		{ID: 3, Command: "ls", CWD: "/"},
+	}
+
+	var buf bytes.Buffer
+	printTable(&buf, commands, OutputOptions{Columns: []string{"id", "cwd", "command"}, Color: "never"})
+	expected := "ID  CWD   COMMAND\n" +
+		"12  /src  make | tee build.log\n" +
+		"3   /     ls\n"
+	if buf.String() != expected {
+		t.Errorf("Unexpected table:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	printTable(&buf, commands, OutputOptions{Columns: []string{"exit", "id"}, NoHeader: true, Color: "always"})
+	expected = "\x1b[31m0\x1b[0m  12\n" +
+		"0  3\n"
+	if buf.String() != expected {
+		t.Errorf("Unexpected colored table: %q", buf.String())
+	}
+}
+
+func TestExecuteTemplate(t *testing.T) {
+	opts := OutputOptions{Format: `{{.ID}}\t{{.Command}}{{if .Failed}} {{red "failed"}}{{end}}`, Color: "never"}
+	commands := []history.Command{{ID: 1, Command: "true"}, {ID: 2, Command: "false", ExitCode: 1}}
+
+	var buf bytes.Buffer
+	if err := executeTemplate(&buf, opts, commands); err != nil {
+		t.Fatalf("executeTemplate failed: %v", err)
+	}
+	if buf.String() != "1\ttrue\n2\tfalse failed\n" {
+		t.Errorf("Unexpected output: %q", buf.String())
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	if got := truncate("kubectl get pods", 8); got != "kubectl…" {
+		t.Errorf("Expected 'kubectl…', got %q", got)
+	}
+	if got := truncate("ls", 8); got != "ls" {
+		t.Errorf("Expected 'ls', got %q", got)
+	}
+}
@@ -0,0 +1,65 @@
+package common
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+// defaultPager is used when $PAGER is not set. -F exits straight away when
+// the output fits on one screen, -R passes colors through and -X leaves the
+// output on the screen after quitting.
+const defaultPager = "less -FRX"
+
+// StartPager sends everything printed to stdout through the user's pager
+// until the returned function is called, which waits for the pager to exit.
+// It does nothing unless the output options ask for paging, or when the
+// pager cannot be started.
+func StartPager(opts OutputOptions) func() {
+	if !opts.Pager {
+		return func() {}
+	}
+
+	pager, ok := os.LookupEnv("PAGER")
+	if !ok {
+		if runtime.GOOS == "windows" {
+			return func() {}
+		}
+		pager = defaultPager
+	}
+	if pager == "" || pager == "cat" {
+		return func() {}
+	}
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", pager)
+	} else {
+		cmd = exec.Command("sh", "-c", pager)
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if _, ok := os.LookupEnv("LESS"); !ok {
+		cmd.Env = append(os.Environ(), "LESS=FRX")
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return func() {}
+	}
+	cmd.Stdin = r
+	if err := cmd.Start(); err != nil {
+		r.Close()
+		w.Close()
+		return func() {}
+	}
+	r.Close()
+
+	stdout := os.Stdout
+	os.Stdout = w
+	return func() {
+		os.Stdout = stdout
+		w.Close()
+		cmd.Wait()
+	}
+}
@@ -0,0 +1,469 @@
+// Package dirsync syncs history through a directory shared between machines,
+// such as a Syncthing folder, an NFS export or a mounted drive.
+//
+// Every database writes only to its own subdirectory, named after its
+// origin, so no locking is needed. New changes are appended there as
+// numbered segment files: JSON, gzip compressed and sealed with
+// XChaCha20-Poly1305 under a key derived from the pre-shared token. Each
+// segment appears atomically through a rename, and the segments imported
+// from every other host are recorded in the database, so an interrupted
+// sync picks up where it stopped.
+package dirsync
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/khelechy/consolidate/internal/storage"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// PeerPrefix starts the sync peer name under which a database records what
+// it wrote to a shared directory, followed by the directory
+const PeerPrefix = "dir:"
+
+// batchSize is the most commands and tombstones written to one segment
+const batchSize = 5000
+
+// keyFileName holds the key derivation settings of a host's segments
+const keyFileName = "key.json"
+
+// segmentExt ends the name of every segment file
+const segmentExt = ".seg"
+
+// segmentMagic starts every segment file, followed by a version byte
+const segmentMagic = "CSEG"
+
+// segmentVersion is the format of the segments written
+const segmentVersion = 1
+
+// checkText is sealed in the key file so a wrong token is recognised
+const checkText = "consolidate"
+
+// kdfParams are the Argon2id costs for new key files; tests lower them
+var kdfParams = struct {
+	time, memory uint32
+	threads      uint8
+}{3, 64 * 1024, 4}
+
+// Key files come from other hosts, so their costs are bounded before use:
+// Argon2 panics on a zero time or thread count, and memory is allocated as
+// asked
+const (
+	maxKDFTime    = 16
+	maxKDFMemory  = 1024 * 1024 // KiB
+	minSaltLength = 16
+)
+
+// keyFile describes how a host's segment key is derived from the token.
+// None of it is secret.
+type keyFile struct {
+	KDF     string `json:"kdf"`
+	Salt    []byte `json:"salt"`
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"` // KiB
+	Threads uint8  `json:"threads"`
+	Check   []byte `json:"check"`
+}
+
+// Options configures Sync
+type Options struct {
+	// Token is the secret shared by all hosts of the directory
+	Token string
+}
+
+// Result counts what a sync changed
+type Result struct {
+	// Written counts the segments written for this database, and Exported
+	// the commands and tombstones in them
+	Written, Exported int
+	// Imported counts the segments read from Hosts other databases
+	Imported, Hosts int
+	// Added and Deleted count the commands added and removed here
+	Added, Deleted int
+	// Problems lists hosts whose segments could not be read. The segments
+	// before the problem are imported and the rest are retried next time.
+	Problems []string
+}
+
+// Sync writes the changes of the store since its last sync to dir and
+// imports the segments other hosts wrote since then
+func Sync(s *storage.Store, dir string, opts Options) (*Result, error) {
+	if opts.Token == "" {
+		return nil, fmt.Errorf("a token is required")
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+
+	own := filepath.Join(dir, s.Origin())
+	if err := os.MkdirAll(own, 0700); err != nil {
+		return nil, fmt.Errorf("creating %s: %w", own, err)
+	}
+	ownKey, err := hostKey(own, opts.Token, true)
+	if err != nil {
+		return nil, err
+	}
+	hosts, err := otherHosts(dir, s.Origin())
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{Problems: []string{}}
+	if err := export(s, dir, own, ownKey, hosts, result); err != nil {
+		return result, err
+	}
+	for _, host := range hosts {
+		if err := importHost(s, dir, host, opts.Token, result); err != nil {
+			result.Problems = append(result.Problems, fmt.Sprintf("%s: %v", host, err))
+		}
+	}
+	return result, nil
+}
+
+// otherHosts lists the subdirectories written by databases other than own
+func otherHosts(dir, own string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var hosts []string
+	for _, e := range entries {
+		if !e.IsDir() || e.Name() == own || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, e.Name(), keyFileName)); err == nil {
+			hosts = append(hosts, e.Name())
+		}
+	}
+	return hosts, nil
+}
+
+// export appends this database's new changes to its own directory. Commands
+// and tombstones that came from the other hosts are left out, since they
+// write those themselves.
+func export(s *storage.Store, dir, own string, key *sealer, hosts []string, result *Result) error {
+	if err := removeTemporaryFiles(own); err != nil {
+		return err
+	}
+	segments, err := listSegments(own)
+	if err != nil {
+		return err
+	}
+	next := int64(1)
+	if len(segments) > 0 {
+		next = segments[len(segments)-1] + 1
+	}
+
+	// A crash between writing a segment and saving the cursor writes the
+	// same changes again, which importing skips
+	state, err := s.GetSyncPeer(PeerPrefix + dir)
+	if err != nil {
+		return err
+	}
+	state.Address = dir
+	for {
+		changes, err := s.ChangesSince(state.Pushed, batchSize, hosts...)
+		if err != nil {
+			return err
+		}
+		if len(changes.Commands) == 0 && len(changes.Tombstones) == 0 {
+			break
+		}
+		if err := writeSegment(own, next, key, changes); err != nil {
+			return err
+		}
+		result.Written++
+		result.Exported += len(changes.Commands) + len(changes.Tombstones)
+		next++
+		state.Pushed = changes.Next
+		if err := s.SaveSyncPeer(state); err != nil {
+			return err
+		}
+		if !changes.More {
+			break
+		}
+	}
+	state.SyncedAt = time.Now().UTC().Format(time.RFC3339)
+	return s.SaveSyncPeer(state)
+}
+
+// importHost applies the segments of another host that were not imported
+// yet, in order
+func importHost(s *storage.Store, dir, host, token string, result *Result) error {
+	hostDir := filepath.Join(dir, host)
+	mark, err := s.SegmentMark(dir, host)
+	if err != nil {
+		return err
+	}
+	segments, err := listSegments(hostDir)
+	if err != nil {
+		return err
+	}
+	i, _ := slices.BinarySearch(segments, mark+1)
+	segments = segments[i:]
+	if len(segments) == 0 || segments[0] != mark+1 {
+		return nil
+	}
+	result.Hosts++
+
+	key, err := hostKey(hostDir, token, false)
+	if err != nil {
+		return err
+	}
+	for _, n := range segments {
+		// Files may arrive out of order; a gap is filled on a later sync
+		if n != mark+1 {
+			break
+		}
+		changes, err := readSegment(hostDir, host, n, key)
+		if err != nil {
+			return err
+		}
+		added, deleted, err := s.ApplyChanges(changes.Commands, changes.Tombstones)
+		if err != nil {
+			return fmt.Errorf("segment %d: %w", n, err)
+		}
+		if err := s.SaveSegmentMark(dir, host, n); err != nil {
+			return err
+		}
+		mark = n
+		result.Imported++
+		result.Added += added
+		result.Deleted += deleted
+	}
+	return nil
+}
+
+// segmentName is the file name of segment n; the padding keeps them in
+// order when listed
+func segmentName(n int64) string {
+	return fmt.Sprintf("%012d%s", n, segmentExt)
+}
+
+// listSegments returns the numbers of the segments in a host directory,
+// ignoring temporary files and copies such as Syncthing's conflict files
+func listSegments(hostDir string) ([]int64, error) {
+	entries, err := os.ReadDir(hostDir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []int64
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), segmentExt)
+		if !ok || len(name) != 12 {
+			continue
+		}
+		if n, err := strconv.ParseInt(name, 10, 64); err == nil && n > 0 {
+			segments = append(segments, n)
+		}
+	}
+	slices.Sort(segments)
+	return segments, nil
+}
+
+// removeTemporaryFiles deletes the leftovers of writes that were interrupted
+func removeTemporaryFiles(hostDir string) error {
+	matches, err := filepath.Glob(filepath.Join(hostDir, ".tmp-*"))
+	if err != nil {
+		return err
+	}
+	for _, m := range matches {
+		if err := os.Remove(m); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSegment compresses and seals the changes into segment n
+func writeSegment(hostDir string, n int64, key *sealer, changes *storage.Changes) error {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(changes); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	name := segmentName(n)
+	header := append([]byte(segmentMagic), segmentVersion)
+	sealed := key.seal(header, buf.Bytes(), segmentData(filepath.Base(hostDir), name))
+	return writeFileAtomic(filepath.Join(hostDir, name), sealed)
+}
+
+// readSegment opens, decompresses and decodes segment n of a host
+func readSegment(hostDir, host string, n int64, key *sealer) (*storage.Changes, error) {
+	name := segmentName(n)
+	data, err := os.ReadFile(filepath.Join(hostDir, name))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < len(segmentMagic)+1 || string(data[:len(segmentMagic)]) != segmentMagic {
+		return nil, fmt.Errorf("segment %d is not a segment file", n)
+	}
+	if data[len(segmentMagic)] != segmentVersion {
+		return nil, fmt.Errorf("segment %d has unknown version %d; upgrade consolidate", n, data[len(segmentMagic)])
+	}
+	plain, err := key.open(data[len(segmentMagic)+1:], segmentData(host, name))
+	if err != nil {
+		return nil, fmt.Errorf("segment %d is damaged or incomplete", n)
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(plain))
+	if err != nil {
+		return nil, fmt.Errorf("segment %d: %w", n, err)
+	}
+	var changes storage.Changes
+	if err := json.NewDecoder(zr).Decode(&changes); err != nil {
+		return nil, fmt.Errorf("segment %d: %w", n, err)
+	}
+	return &changes, nil
+}
+
+// segmentData is authenticated along with a segment, so segments cannot be
+// renamed or moved to another host's directory
+func segmentData(host, name string) []byte {
+	return []byte(host + "/" + name)
+}
+
+// writeFileAtomic writes data to a temporary file and renames it into
+// place, so readers see the whole file or nothing
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	f, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	// Make the rename itself durable where directories can be synced
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// sealer encrypts segments with XChaCha20-Poly1305
+type sealer struct {
+	key []byte
+}
+
+func (s *sealer) seal(prefix, plain, data []byte) []byte {
+	aead, _ := chacha20poly1305.NewX(s.key)
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	return aead.Seal(append(prefix, nonce...), nonce, plain, data)
+}
+
+func (s *sealer) open(sealed, data []byte) ([]byte, error) {
+	aead, _ := chacha20poly1305.NewX(s.key)
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], data)
+}
+
+// hostKey derives the segment key of a host directory from the token. With
+// create, a missing key file is written with a fresh salt.
+func hostKey(hostDir, token string, create bool) (*sealer, error) {
+	path := filepath.Join(hostDir, keyFileName)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) && create {
+		return newHostKey(path, token)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading key file: %w", err)
+	}
+
+	var kf keyFile
+	if err := json.Unmarshal(data, &kf); err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", path, err)
+	}
+	if err := kf.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	s := &sealer{key: argon2.IDKey([]byte(token), kf.Salt, kf.Time, kf.Memory, kf.Threads, chacha20poly1305.KeySize)}
+	if check, err := s.open(kf.Check, []byte(keyFileName)); err != nil || string(check) != checkText {
+		return nil, fmt.Errorf("wrong token for the segments in %s", hostDir)
+	}
+	return s, nil
+}
+
+// validate rejects key files that name an unknown key derivation or whose
+// costs are out of bounds
+func (kf *keyFile) validate() error {
+	if kf.KDF != "argon2id" {
+		return fmt.Errorf("unknown key derivation %q", kf.KDF)
+	}
+	if len(kf.Salt) < minSaltLength {
+		return fmt.Errorf("salt of %d bytes is shorter than %d", len(kf.Salt), minSaltLength)
+	}
+	if kf.Time < 1 || kf.Time > maxKDFTime {
+		return fmt.Errorf("argon2id time %d is not between 1 and %d", kf.Time, maxKDFTime)
+	}
+	if kf.Memory < 8*uint32(kf.Threads) || kf.Memory > maxKDFMemory {
+		return fmt.Errorf("argon2id memory %d KiB is not between %d and %d", kf.Memory, 8*uint32(kf.Threads), maxKDFMemory)
+	}
+	if kf.Threads < 1 {
+		return fmt.Errorf("argon2id threads must be at least 1")
+	}
+	return nil
+}
+
+// newHostKey writes a key file with a fresh salt and returns its key
+func newHostKey(path, token string) (*sealer, error) {
+	kf := keyFile{
+		KDF:     "argon2id",
+		Salt:    make([]byte, 16),
+		Time:    kdfParams.time,
+		Memory:  kdfParams.memory,
+		Threads: kdfParams.threads,
+	}
+	rand.Read(kf.Salt)
+	s := &sealer{key: argon2.IDKey([]byte(token), kf.Salt, kf.Time, kf.Memory, kf.Threads, chacha20poly1305.KeySize)}
+	kf.Check = s.seal(nil, []byte(checkText), []byte(keyFileName))
+
+	data, err := json.MarshalIndent(kf, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(path, append(data, '\n')); err != nil {
+		return nil, fmt.Errorf("writing key file: %w", err)
+	}
+	return s, nil
+}
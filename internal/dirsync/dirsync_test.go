@@ -0,0 +1,215 @@
+//go:build cgo
+
+package dirsync
+
+import (
+	"encoding/json"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/khelechy/consolidate/internal/storage"
+)
+
+func init() {
+	// Keep key derivation fast in tests
+	kdfParams.time, kdfParams.memory, kdfParams.threads = 1, 64, 1
+}
+
+// open opens the database at path until the test ends
+func open(t *testing.T, path string) *storage.Store {
+	t.Helper()
+	s, err := storage.Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// sync runs Sync and fails the test on an error or problem
+func sync(t *testing.T, s *storage.Store, dir string) *Result {
+	t.Helper()
+	result, err := Sync(s, dir, Options{Token: "s3cret"})
+	if err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if len(result.Problems) > 0 {
+		t.Fatalf("Sync had problems: %v", result.Problems)
+	}
+	return result
+}
+
+// commandTexts returns the sorted command text of every row
+func commandTexts(t *testing.T, s *storage.Store) []string {
+	t.Helper()
+	commands, err := s.QueryCommands(storage.Filter{Limit: 100})
+	if err != nil {
+		t.Fatalf("QueryCommands failed: %v", err)
+	}
+	var texts []string
+	for _, cmd := range commands {
+		texts = append(texts, cmd.Command)
+	}
+	slices.Sort(texts)
+	return texts
+}
+
+func TestSyncThroughDirectory(t *testing.T) {
+	tmp := t.TempDir()
+	shared := filepath.Join(tmp, "shared")
+	if err := os.Mkdir(shared, 0700); err != nil {
+		t.Fatal(err)
+	}
+	a, b := open(t, filepath.Join(tmp, "a.db")), open(t, filepath.Join(tmp, "b.db"))
+	originA, originB := a.Origin(), b.Origin()
+	for _, c := range []string{"a1", "a2"} {
+		if err := a.SaveCommand(c, "1", "/", 0, `{"temp":"`+c+`"}`); err != nil {
+			t.Fatalf("SaveCommand failed: %v", err)
+		}
+	}
+	if r := sync(t, a, shared); r.Written != 1 || r.Exported != 2 || r.Imported != 0 {
+		t.Errorf("Unexpected first sync of A: %+v", r)
+	}
+
+	if err := b.SaveCommand("b1", "1", "/", 0, ""); err != nil {
+		t.Fatalf("SaveCommand failed: %v", err)
+	}
+	if r := sync(t, b, shared); r.Written != 1 || r.Exported != 1 || r.Imported != 1 || r.Hosts != 1 || r.Added != 2 {
+		t.Errorf("Unexpected first sync of B: %+v", r)
+	}
+	// B does not write A's commands back
+	if r := sync(t, b, shared); r.Written != 0 || r.Imported != 0 {
+		t.Errorf("Expected nothing to do, got %+v", r)
+	}
+
+	if r := sync(t, a, shared); r.Written != 0 || r.Imported != 1 || r.Added != 1 {
+		t.Errorf("Unexpected second sync of A: %+v", r)
+	}
+	if texts := commandTexts(t, a); !slices.Equal(texts, []string{"a1", "a2", "b1"}) {
+		t.Errorf("Unexpected commands in A: %v", texts)
+	}
+
+	// A deletion is carried by the next segment
+	if _, err := a.CleanCommands(storage.CleanCriteria{Meta: map[string]string{"temp": "a1"}}); err != nil {
+		t.Fatalf("CleanCommands failed: %v", err)
+	}
+	if r := sync(t, a, shared); r.Written != 1 {
+		t.Errorf("Expected a segment with the tombstone, got %+v", r)
+	}
+	// Leftovers of an interrupted write are ignored and cleaned up
+	stray := filepath.Join(shared, originA, ".tmp-123")
+	if err := os.WriteFile(stray, []byte("partial"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if r := sync(t, b, shared); r.Imported != 1 || r.Deleted != 1 {
+		t.Errorf("Expected the deletion, got %+v", r)
+	}
+	if texts := commandTexts(t, b); !slices.Equal(texts, []string{"a2", "b1"}) {
+		t.Errorf("Unexpected commands in B: %v", texts)
+	}
+
+	// Losing track of what was written only writes duplicates, which
+	// importing skips
+	if err := b.SaveSyncPeer(&storage.SyncPeer{Peer: PeerPrefix + shared}); err != nil {
+		t.Fatalf("SaveSyncPeer failed: %v", err)
+	}
+	if r := sync(t, b, shared); r.Written != 1 {
+		t.Errorf("Expected B to write its changes again, got %+v", r)
+	}
+	if r := sync(t, a, shared); r.Imported != 1 || r.Added != 0 {
+		t.Errorf("Expected a duplicate segment to add nothing, got %+v", r)
+	}
+	if _, err := os.Stat(stray); err == nil {
+		t.Error("Expected the temporary file to be removed")
+	}
+
+	// A wrong token cannot read or write
+	if _, err := Sync(a, shared, Options{Token: "wrong"}); err == nil {
+		t.Error("Expected an error for a wrong token")
+	}
+
+	// A damaged segment is reported and retried later
+	segment := filepath.Join(shared, originB, segmentName(3))
+	if err := os.WriteFile(segment, []byte(segmentMagic+"\x01garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	result, err := Sync(a, shared, Options{Token: "s3cret"})
+	if err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if len(result.Problems) != 1 || !strings.Contains(result.Problems[0], "damaged") {
+		t.Errorf("Expected a problem with the damaged segment, got %v", result.Problems)
+	}
+	if mark, _ := a.SegmentMark(shared, originB); mark != 2 {
+		t.Errorf("Expected to stop before segment 3, got mark %d", mark)
+	}
+}
+
+func TestHostileKeyFile(t *testing.T) {
+	tmp := t.TempDir()
+	shared := filepath.Join(tmp, "shared")
+	if err := os.Mkdir(shared, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	a := open(t, filepath.Join(tmp, "a.db"))
+	if err := a.SaveCommand("a1", "1", "/", 0, ""); err != nil {
+		t.Fatalf("SaveCommand failed: %v", err)
+	}
+	sync(t, a, shared)
+	keyPath := filepath.Join(shared, a.Origin(), keyFileName)
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var good map[string]any
+	if err := json.Unmarshal(data, &good); err != nil {
+		t.Fatal(err)
+	}
+
+	b := open(t, filepath.Join(tmp, "b.db"))
+	// Each of these would make Argon2 panic or allocate without bound
+	for field, value := range map[string]any{"time": 0, "threads": 0, "memory": uint32(1 << 31), "salt": "", "kdf": "scrypt"} {
+		bad := maps.Clone(good)
+		bad[field] = value
+		data, err := json.Marshal(bad)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(keyPath, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		result, err := Sync(b, shared, Options{Token: "s3cret"})
+		if err != nil {
+			t.Fatalf("Sync with a bad %s failed: %v", field, err)
+		}
+		if len(result.Problems) != 1 || !strings.Contains(result.Problems[0], keyFileName) {
+			t.Errorf("Expected a problem with the key file for a bad %s, got %v", field, result.Problems)
+		}
+	}
+}
+
+func TestSegmentsCannotMove(t *testing.T) {
+	dir := t.TempDir()
+	key := &sealer{key: make([]byte, 32)}
+	changes := &storage.Changes{Commands: []storage.Command{{UID: "u", Origin: "o", Command: "ls"}}}
+	if err := writeSegment(dir, 1, key, changes); err != nil {
+		t.Fatalf("writeSegment failed: %v", err)
+	}
+
+	got, err := readSegment(dir, filepath.Base(dir), 1, key)
+	if err != nil || len(got.Commands) != 1 || got.Commands[0].Command != "ls" {
+		t.Fatalf("Expected the segment back, got %+v (%v)", got, err)
+	}
+	if err := os.Rename(filepath.Join(dir, segmentName(1)), filepath.Join(dir, segmentName(2))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readSegment(dir, filepath.Base(dir), 2, key); err == nil {
+		t.Error("Expected a renamed segment to be rejected")
+	}
+}
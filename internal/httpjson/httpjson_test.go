@@ -0,0 +1,43 @@
+package httpjson
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireToken(t *testing.T) {
+	h := RequireToken("s3cret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		WriteJSON(w, http.StatusOK, map[string]bool{"ok": true})
+	}))
+
+	for _, tc := range []struct {
+		auth   string
+		status int
+	}{
+		{"Bearer s3cret", http.StatusOK},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"s3cret", http.StatusUnauthorized},
+		{"", http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tc.status {
+			t.Errorf("Authorization %q: expected status %d, got %d", tc.auth, tc.status, rec.Code)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Expected a JSON response, got %q", ct)
+		}
+		if rec.Code != http.StatusOK {
+			var e ErrorResponse
+			if err := json.NewDecoder(rec.Body).Decode(&e); err != nil || e.Error == "" {
+				t.Errorf("Expected an error body, got %v (%v)", e, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,243 @@
+// Package peersync syncs the history of two databases over HTTP. One side
+// serves its store with Handler; the other runs Sync against it, pulling the
+// changes it has not seen and pushing its own.
+package peersync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/khelechy/consolidate/internal/httpjson"
+	"github.com/khelechy/consolidate/internal/storage"
+)
+
+// TokenVar holds the pre-shared token, so it stays out of the process list
+const TokenVar = "CONSOLIDATE_SYNC_TOKEN"
+
+// batchSize is the number of commands and tombstones sent per request
+const batchSize = 500
+
+// maxBodySize limits the size of a pushed batch
+const maxBodySize = 64 << 20
+
+// info describes the served database
+type info struct {
+	Origin string `json:"origin"`
+}
+
+// pushResult is the answer to a push
+type pushResult struct {
+	Added   int `json:"added"`
+	Deleted int `json:"deleted"`
+}
+
+// Handler serves the store to peers that present the token
+func Handler(s *storage.Store, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /sync/v1/info", func(w http.ResponseWriter, r *http.Request) {
+		httpjson.WriteJSON(w, http.StatusOK, info{Origin: s.Origin()})
+	})
+	mux.HandleFunc("GET /sync/v1/changes", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		var since storage.SyncCursor
+		var err error
+		if since.Commands, err = parseCursor(query.Get("commands")); err != nil {
+			httpjson.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+		if since.Tombstones, err = parseCursor(query.Get("tombstones")); err != nil {
+			httpjson.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+		changes, err := s.ChangesSince(since, batchSize, query.Get("exclude"))
+		if err != nil {
+			httpjson.WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+		httpjson.WriteJSON(w, http.StatusOK, changes)
+	})
+	mux.HandleFunc("POST /sync/v1/changes", func(w http.ResponseWriter, r *http.Request) {
+		var changes storage.Changes
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&changes); err != nil {
+			httpjson.WriteError(w, http.StatusBadRequest, fmt.Errorf("decoding changes: %w", err))
+			return
+		}
+		added, deleted, err := s.ApplyChanges(changes.Commands, changes.Tombstones)
+		if err != nil {
+			httpjson.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+		httpjson.WriteJSON(w, http.StatusOK, pushResult{Added: added, Deleted: deleted})
+	})
+	return httpjson.RequireToken(token, mux)
+}
+
+func parseCursor(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid cursor %q", s)
+	}
+	return n, nil
+}
+
+// Options configures Sync
+type Options struct {
+	// Token is the pre-shared token the peer was started with
+	Token string
+	// Full ignores the progress recorded for the peer and exchanges
+	// everything again; rows both sides have are skipped
+	Full bool
+	// Client makes the requests; nil means a client with a timeout
+	Client *http.Client
+}
+
+// Result counts what a sync changed
+type Result struct {
+	// Peer is the origin of the other database
+	Peer string
+	// Pulled and Deleted count the commands added and removed here
+	Pulled, Deleted int
+	// Pushed and PeerDeleted count the commands added and removed there
+	Pushed, PeerDeleted int
+}
+
+// Sync exchanges the changes of the store with the peer serving at address:
+// first it pulls the peer's new commands and tombstones, then it pushes its
+// own. Progress is recorded after every batch, so an interrupted sync
+// resumes where it stopped.
+func Sync(ctx context.Context, s *storage.Store, address string, opts Options) (*Result, error) {
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+	c := &client{base: strings.TrimRight(address, "/"), token: opts.Token, http: opts.Client}
+	if c.http == nil {
+		c.http = &http.Client{Timeout: 2 * time.Minute}
+	}
+
+	var peer info
+	if err := c.do(ctx, http.MethodGet, "/sync/v1/info", nil, &peer); err != nil {
+		return nil, err
+	}
+	if peer.Origin == "" {
+		return nil, fmt.Errorf("%s did not identify itself", address)
+	}
+	if peer.Origin == s.Origin() {
+		return nil, fmt.Errorf("%s serves this database", address)
+	}
+
+	state, err := s.GetSyncPeer(peer.Origin)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Full {
+		state.Pulled, state.Pushed = storage.SyncCursor{}, storage.SyncCursor{}
+	}
+	state.Address = address
+	result := &Result{Peer: peer.Origin}
+
+	for {
+		query := url.Values{
+			"commands":   {strconv.FormatInt(state.Pulled.Commands, 10)},
+			"tombstones": {strconv.FormatInt(state.Pulled.Tombstones, 10)},
+			"exclude":    {s.Origin()},
+		}
+		var changes storage.Changes
+		if err := c.do(ctx, http.MethodGet, "/sync/v1/changes?"+query.Encode(), nil, &changes); err != nil {
+			return result, err
+		}
+		added, deleted, err := s.ApplyChanges(changes.Commands, changes.Tombstones)
+		if err != nil {
+			return result, err
+		}
+		result.Pulled += added
+		result.Deleted += deleted
+		state.Pulled = changes.Next
+		if err := s.SaveSyncPeer(state); err != nil {
+			return result, err
+		}
+		if !changes.More {
+			break
+		}
+	}
+
+	for {
+		changes, err := s.ChangesSince(state.Pushed, batchSize, peer.Origin)
+		if err != nil {
+			return result, err
+		}
+		if len(changes.Commands) == 0 && len(changes.Tombstones) == 0 {
+			break
+		}
+		var pushed pushResult
+		if err := c.do(ctx, http.MethodPost, "/sync/v1/changes", changes, &pushed); err != nil {
+			return result, err
+		}
+		result.Pushed += pushed.Added
+		result.PeerDeleted += pushed.Deleted
+		state.Pushed = changes.Next
+		if err := s.SaveSyncPeer(state); err != nil {
+			return result, err
+		}
+		if !changes.More {
+			break
+		}
+	}
+
+	state.SyncedAt = time.Now().UTC().Format(time.RFC3339)
+	return result, s.SaveSyncPeer(state)
+}
+
+// client talks to a peer
+type client struct {
+	base, token string
+	http        *http.Client
+}
+
+// do sends a request with body encoded as JSON and decodes the answer into
+// out
+func (c *client) do(ctx context.Context, method, path string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e httpjson.ErrorResponse
+		if json.NewDecoder(resp.Body).Decode(&e) == nil && e.Error != "" {
+			return fmt.Errorf("%s: %s", resp.Status, e.Error)
+		}
+		return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decoding response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+//go:build cgo
+
+package peersync
+
+import (
+	"context"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/khelechy/consolidate/internal/storage"
+)
+
+const testToken = "s3cret"
+
+// openStore opens a new database in the test's temporary directory
+func openStore(t *testing.T, name string) *storage.Store {
+	t.Helper()
+	s, err := storage.Open(filepath.Join(t.TempDir(), name))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// startPeer serves the store over loopback
+func startPeer(t *testing.T, s *storage.Store) string {
+	t.Helper()
+	srv := httptest.NewServer(Handler(s, testToken))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// commandTexts returns the command text of every row, sorted
+func commandTexts(t *testing.T, s *storage.Store) []string {
+	t.Helper()
+	commands, err := s.QueryCommands(storage.Filter{Limit: 100, Reverse: true})
+	if err != nil {
+		t.Fatalf("QueryCommands failed: %v", err)
+	}
+	var texts []string
+	for _, cmd := range commands {
+		texts = append(texts, cmd.Command)
+	}
+	slices.Sort(texts)
+	return texts
+}
+
+func TestSyncOverLoopback(t *testing.T) {
+	a, b := openStore(t, "a.db"), openStore(t, "b.db")
+	for _, c := range []string{"b1", "b2"} {
+		if err := b.SaveCommand(c, "1", "/", 0, ""); err != nil {
+			t.Fatalf("SaveCommand failed: %v", err)
+		}
+	}
+	if err := a.SaveCommand("a1", "1", "/", 0, `{"temp":"yes"}`); err != nil {
+		t.Fatalf("SaveCommand failed: %v", err)
+	}
+
+	address := startPeer(t, b)
+	ctx := context.Background()
+	opts := Options{Token: testToken}
+
+	result, err := Sync(ctx, a, address, opts)
+	if err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if *result != (Result{Peer: b.Origin(), Pulled: 2, Pushed: 1}) {
+		t.Errorf("Unexpected first sync: %+v", result)
+	}
+
+	// Nothing changed, so nothing moves
+	result, err = Sync(ctx, a, address, opts)
+	if err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if *result != (Result{Peer: b.Origin()}) {
+		t.Errorf("Unexpected second sync: %+v", result)
+	}
+
+	if _, err := Sync(ctx, a, address, Options{Token: "wrong"}); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Expected 401 for a wrong token, got %v", err)
+	}
+
+	// A deletion and a new command travel together
+	if _, err := a.CleanCommands(storage.CleanCriteria{Meta: map[string]string{"temp": "yes"}}); err != nil {
+		t.Fatalf("CleanCommands failed: %v", err)
+	}
+	if err := a.SaveCommand("a2", "1", "/", 0, ""); err != nil {
+		t.Fatalf("SaveCommand failed: %v", err)
+	}
+	result, err = Sync(ctx, a, address, opts)
+	if err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if *result != (Result{Peer: b.Origin(), Pushed: 1, PeerDeleted: 1}) {
+		t.Errorf("Unexpected third sync: %+v", result)
+	}
+
+	// Starting over from scratch duplicates nothing
+	result, err = Sync(ctx, a, address, Options{Token: testToken, Full: true})
+	if err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if *result != (Result{Peer: b.Origin()}) {
+		t.Errorf("Unexpected full sync: %+v", result)
+	}
+
+	expected := []string{"a2", "b1", "b2"}
+	if texts := commandTexts(t, a); !slices.Equal(texts, expected) {
+		t.Errorf("Expected A to hold %v, got %v", expected, texts)
+	}
+	if texts := commandTexts(t, b); !slices.Equal(texts, expected) {
+		t.Errorf("Expected B to hold %v, got %v", expected, texts)
+	}
+}
+
+func TestSyncWithItself(t *testing.T) {
+	a := openStore(t, "a.db")
+	address := startPeer(t, a)
+	if _, err := Sync(context.Background(), a, address, Options{Token: testToken}); err == nil {
+		t.Error("Expected an error syncing a database with itself")
+	}
+}
@@ -0,0 +1,111 @@
+// Package script turns logged commands into a bash script or a Markdown
+// runbook
+package script
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/khelechy/consolidate/pkg/history"
+)
+
+// WriteBash writes the commands, oldest first, as a bash script. A cd line
+// is inserted whenever the working directory changes, and failed commands
+// are commented out so the script does not stop at them.
+func WriteBash(w io.Writer, commands []history.Command) error {
+	var b strings.Builder
+	b.WriteString("#!/usr/bin/env bash\n")
+	if len(commands) > 0 {
+		fmt.Fprintf(&b, "# Generated by consolidate from %d commands, %s to %s\n",
+			len(commands), commands[0].Timestamp, commands[len(commands)-1].Timestamp)
+	}
+	b.WriteString("set -euo pipefail\n")
+
+	dir := ""
+	for _, cmd := range commands {
+		b.WriteString("\n")
+		// The hook records the directory a command left the shell in, so a
+		// cd shows up as the next directory; the absolute cd replaces it
+		if cmd.CWD != "" && cmd.CWD != "unknown" && cmd.CWD != dir {
+			fmt.Fprintf(&b, "cd %s\n", quote(cmd.CWD))
+			dir = cmd.CWD
+		}
+		if isDirChange(cmd.Command) {
+			continue
+		}
+		if cmd.Failed() {
+			fmt.Fprintf(&b, "# Failed (%s):\n", status(cmd))
+			for _, line := range strings.Split(cmd.Command, "\n") {
+				b.WriteString("# " + line + "\n")
+			}
+			continue
+		}
+		b.WriteString(cmd.Command + "\n")
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteMarkdown writes the commands, oldest first, as a Markdown runbook
+// with a fenced block, timestamp and directory for each command
+func WriteMarkdown(w io.Writer, commands []history.Command, title string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n", title)
+	if len(commands) > 0 {
+		fmt.Fprintf(&b, "\n_%d commands, %s to %s_\n",
+			len(commands), commands[0].Timestamp, commands[len(commands)-1].Timestamp)
+	}
+
+	for i, cmd := range commands {
+		fmt.Fprintf(&b, "\n%d. **%s**", i+1, cmd.Timestamp)
+		if cmd.CWD != "" && cmd.CWD != "unknown" {
+			fmt.Fprintf(&b, " in `%s`", cmd.CWD)
+		}
+		if cmd.Failed() {
+			fmt.Fprintf(&b, " (failed, %s)", status(cmd))
+		}
+
+		// The fence must be longer than any run of backticks in the command
+		fence := "```"
+		for strings.Contains(cmd.Command, fence) {
+			fence += "`"
+		}
+		fmt.Fprintf(&b, "\n\n   %sbash\n", fence)
+		for _, line := range strings.Split(cmd.Command, "\n") {
+			b.WriteString("   " + line + "\n")
+		}
+		b.WriteString("   " + fence + "\n")
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// status describes how a command exited
+func status(cmd history.Command) string {
+	s := fmt.Sprintf("exit code %d", cmd.ExitCode)
+	if len(cmd.PipeStatus) > 1 {
+		s += ", pipestatus " + strings.Trim(fmt.Sprint(cmd.PipeStatus), "[]")
+	}
+	return s
+}
+
+// isDirChange reports whether the command does nothing but change directory
+func isDirChange(command string) bool {
+	fields := strings.Fields(command)
+	if len(fields) == 0 || strings.ContainsAny(command, ";&|\n") {
+		return false
+	}
+	switch fields[0] {
+	case "cd", "pushd", "popd":
+		return true
+	}
+	return false
+}
+
+// quote quotes s for a POSIX shell
+func quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,66 @@
+package script
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/khelechy/consolidate/pkg/history"
+)
+
+var session = []history.Command{
+	{Timestamp: "2026-01-01T10:00:00Z", Command: "git pull", CWD: "/src/app"},
+	{Timestamp: "2026-01-01T10:01:00Z", Command: "cd web", CWD: "/src/app/web"},
+	{Timestamp: "2026-01-01T10:02:00Z", Command: "npm test", CWD: "/src/app/web", ExitCode: 1},
+	{Timestamp: "2026-01-01T10:03:00Z", Command: "make | tee log", CWD: "/src/it's here", PipeStatus: []int{2, 0}},
+	{Timestamp: "2026-01-01T10:04:00Z", Command: "npm run build", CWD: "/src/it's here"},
+}
+
+func TestWriteBash(t *testing.T) {
+	var b strings.Builder
+	if err := WriteBash(&b, session); err != nil {
+		t.Fatalf("WriteBash failed: %v", err)
+	}
+
+	expected := `#!/usr/bin/env bash
+# Generated by consolidate from 5 commands, 2026-01-01T10:00:00Z to 2026-01-01T10:04:00Z
+set -euo pipefail
+
+cd '/src/app'
+git pull
+
+cd '/src/app/web'
+
+# Failed (exit code 1):
+# npm test
+
+cd '/src/it'\''s here'
+# Failed (exit code 0, pipestatus 2 0):
+# make | tee log
+
+npm run build
+`
+	if b.String() != expected {
+		t.Errorf("Unexpected script:\n%s", b.String())
+	}
+}
+
+func TestWriteMarkdown(t *testing.T) {
+	var b strings.Builder
+	commands := []history.Command{
+		session[0],
+		{Timestamp: "2026-01-01T10:05:00Z", Command: "echo ```\nls", CWD: "unknown", ExitCode: 2},
+	}
+	if err := WriteMarkdown(&b, commands, "Deploy"); err != nil {
+		t.Fatalf("WriteMarkdown failed: %v", err)
+	}
+
+	expected := "# Deploy\n" +
+		"\n_2 commands, 2026-01-01T10:00:00Z to 2026-01-01T10:05:00Z_\n" +
+		"\n1. **2026-01-01T10:00:00Z** in `/src/app`\n" +
+		"\n   ```bash\n   git pull\n   ```\n" +
+		"\n2. **2026-01-01T10:05:00Z** (failed, exit code 2)\n" +
+		"\n   ````bash\n   echo ```\n   ls\n   ````\n"
+	if b.String() != expected {
+		t.Errorf("Unexpected runbook:\n%s", b.String())
+	}
+}
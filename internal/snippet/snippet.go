@@ -0,0 +1,55 @@
+// Package snippet expands the {{placeholder}} parameters of saved snippets
+package snippet
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// placeholder matches {{name}}, allowing spaces inside the braces
+var placeholder = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_-]*)\s*\}\}`)
+
+// Params returns the names of the placeholders in the text, in the order
+// they first appear
+func Params(text string) []string {
+	var names []string
+	for _, m := range placeholder.FindAllStringSubmatch(text, -1) {
+		if !slices.Contains(names, m[1]) {
+			names = append(names, m[1])
+		}
+	}
+	return names
+}
+
+// Expand replaces every placeholder with its value. Values are inserted as
+// they are, without shell quoting. It fails if a value is missing.
+func Expand(text string, values map[string]string) (string, error) {
+	var missing []string
+	for _, name := range Params(text) {
+		if _, ok := values[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("missing values for %s", strings.Join(missing, ", "))
+	}
+
+	return placeholder.ReplaceAllStringFunc(text, func(m string) string {
+		return values[placeholder.FindStringSubmatch(m)[1]]
+	}), nil
+}
+
+// ParseValues parses key=value arguments
+func ParseValues(args []string) (map[string]string, error) {
+	values := make(map[string]string, len(args))
+	for _, arg := range args {
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid parameter %q (use name=value)", arg)
+		}
+		values[name] = value
+	}
+	return values, nil
+}
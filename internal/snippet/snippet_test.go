@@ -0,0 +1,45 @@
+package snippet
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParams(t *testing.T) {
+	params := Params("ssh {{user}}@{{ host }} -p {{port}} 'tail -f {{log_file}}' # {{user}}")
+	if !slices.Equal(params, []string{"user", "host", "port", "log_file"}) {
+		t.Errorf("Unexpected params: %v", params)
+	}
+	if params := Params("echo {{}} {not} {{1bad}}"); len(params) != 0 {
+		t.Errorf("Expected no params, got %v", params)
+	}
+}
+
+func TestExpand(t *testing.T) {
+	text := "git commit -m \"{{message}}\" && git push {{remote}} {{ remote }}"
+
+	expanded, err := Expand(text, map[string]string{"message": "fix build", "remote": "origin"})
+	if err != nil {
+		t.Fatalf("Expand failed: %v", err)
+	}
+	if expanded != `git commit -m "fix build" && git push origin origin` {
+		t.Errorf("Unexpected expansion: %s", expanded)
+	}
+
+	if _, err := Expand(text, map[string]string{"message": "x"}); err == nil {
+		t.Error("Expected an error for a missing value")
+	}
+}
+
+func TestParseValues(t *testing.T) {
+	values, err := ParseValues([]string{"app=web", "query=a=b", "empty="})
+	if err != nil {
+		t.Fatalf("ParseValues failed: %v", err)
+	}
+	if values["app"] != "web" || values["query"] != "a=b" || values["empty"] != "" {
+		t.Errorf("Unexpected values: %v", values)
+	}
+	if _, err := ParseValues([]string{"novalue"}); err == nil {
+		t.Error("Expected an error for an argument without =")
+	}
+}
@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// StarredTag is the tag that marks a starred command
+const StarredTag = "starred"
+
+// ValidateTag checks that a tag is a single word. Tags are stored space
+// separated when commands are read, and commas would be ambiguous on the
+// command line.
+func ValidateTag(tag string) error {
+	if tag == "" {
+		return fmt.Errorf("tag cannot be empty")
+	}
+	if strings.ContainsFunc(tag, func(r rune) bool { return unicode.IsSpace(r) || r == ',' }) {
+		return fmt.Errorf("invalid tag %q: tags cannot contain spaces or commas", tag)
+	}
+	return nil
+}
+
+// AddTags tags the command with the given ID. Tags it already has are left
+// as they are.
+func (s *Store) AddTags(id int, tags ...string) error {
+	if err := s.requireCommand(id); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if err := ValidateTag(tag); err != nil {
+			return err
+		}
+		if _, err := s.db.Exec("INSERT OR IGNORE INTO tags (command_id, tag) VALUES (?, ?)", id, tag); err != nil {
+			return fmt.Errorf("failed to add tag: %w", err)
+		}
+	}
+	return nil
+}
+
+// RemoveTags removes the given tags from the command with the given ID
+func (s *Store) RemoveTags(id int, tags ...string) error {
+	if err := s.requireCommand(id); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if _, err := s.db.Exec("DELETE FROM tags WHERE command_id = ? AND tag = ?", id, tag); err != nil {
+			return fmt.Errorf("failed to remove tag: %w", err)
+		}
+	}
+	return nil
+}
+
+// SetNote attaches a note to the command with the given ID, replacing any
+// earlier note. An empty note removes it.
+func (s *Store) SetNote(id int, note string) error {
+	if err := s.requireCommand(id); err != nil {
+		return err
+	}
+	k, err := s.writeKeys()
+	if err != nil {
+		return err
+	}
+	if note == "" {
+		_, err = s.db.Exec("DELETE FROM notes WHERE command_id = ?", id)
+	} else {
+		_, err = s.db.Exec(`
+			INSERT INTO notes (command_id, note) VALUES (?, ?)
+			ON CONFLICT (command_id) DO UPDATE SET note = excluded.note, updated_at = CURRENT_TIMESTAMP`,
+			id, sealText(k, note))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save note: %w", err)
+	}
+	return nil
+}
+
+// requireCommand returns an error unless a command with the ID exists
+func (s *Store) requireCommand(id int) error {
+	if s == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	var exists bool
+	if err := s.db.QueryRow("SELECT EXISTS (SELECT 1 FROM commands WHERE id = ?)", id).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to look up command: %w", err)
+	}
+	if !exists {
+		return fmt.Errorf("no command with ID %d", id)
+	}
+	return nil
+}
+
+// deleteOrphanedAnnotations removes the tags and notes of deleted commands.
+// SQLite only enforces ON DELETE CASCADE when foreign keys are switched on
+// for the connection, so this does not rely on it.
+func (s *Store) deleteOrphanedAnnotations() error {
+	for _, table := range []string{"tags", "notes"} {
+		if _, err := s.db.Exec("DELETE FROM " + table + " WHERE command_id NOT IN (SELECT id FROM commands)"); err != nil {
+			return fmt.Errorf("failed to delete orphaned %s: %w", table, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+//go:build cgo
+
+package storage
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestTagsAndNotes(t *testing.T) {
+	s := openTestStore(t, ":memory:")
+
+	for _, c := range []string{"kubectl get pods", "ls", "terraform apply"} {
+		if err := s.SaveCommand(c, "s", "/", 0, ""); err != nil {
+			t.Fatalf("SaveCommand failed: %v", err)
+		}
+	}
+
+	if err := s.AddTags(1, "k8s", "ops"); err != nil {
+		t.Fatalf("AddTags failed: %v", err)
+	}
+	if err := s.AddTags(3, "ops", StarredTag); err != nil {
+		t.Fatalf("AddTags failed: %v", err)
+	}
+	if err := s.AddTags(1, "ops"); err != nil {
+		t.Fatalf("Adding an existing tag failed: %v", err)
+	}
+	if err := s.AddTags(1, "two words"); err == nil {
+		t.Error("Expected an error for a tag with a space")
+	}
+	if err := s.AddTags(99, "ops"); err == nil {
+		t.Error("Expected an error for a missing command")
+	}
+	if err := s.SetNote(3, "needs the prod workspace"); err != nil {
+		t.Fatalf("SetNote failed: %v", err)
+	}
+
+	cmd, err := s.GetCommand(1)
+	if err != nil {
+		t.Fatalf("GetCommand failed: %v", err)
+	}
+	if !slices.Equal(cmd.Tags, []string{"k8s", "ops"}) {
+		t.Errorf("Expected tags k8s and ops, got %v", cmd.Tags)
+	}
+
+	results, err := s.QueryCommands(Filter{Limit: 10, Tags: []string{"ops"}})
+	if err != nil {
+		t.Fatalf("QueryCommands failed: %v", err)
+	}
+	if len(results) != 2 {
+		t.Errorf("Expected 2 commands tagged ops, got %d", len(results))
+	}
+
+	results, err = s.QueryCommands(Filter{Limit: 10, Tags: []string{"ops"}, Starred: true})
+	if err != nil {
+		t.Fatalf("QueryCommands failed: %v", err)
+	}
+	if len(results) != 1 || results[0].Note != "needs the prod workspace" {
+		t.Errorf("Expected the starred command with its note, got %v", results)
+	}
+
+	if err := s.RemoveTags(3, StarredTag); err != nil {
+		t.Fatalf("RemoveTags failed: %v", err)
+	}
+	if err := s.SetNote(3, ""); err != nil {
+		t.Fatalf("Clearing the note failed: %v", err)
+	}
+	cmd, err = s.GetCommand(3)
+	if err != nil {
+		t.Fatalf("GetCommand failed: %v", err)
+	}
+	if !slices.Equal(cmd.Tags, []string{"ops"}) || cmd.Note != "" {
+		t.Errorf("Expected only the ops tag and no note, got %+v", cmd)
+	}
+}
+
+func TestCleanHistoryRemovesAnnotations(t *testing.T) {
+	s := openTestStore(t, ":memory:")
+
+	if err := s.SaveCommand("ls", "s", "/", 0, ""); err != nil {
+		t.Fatalf("SaveCommand failed: %v", err)
+	}
+	if err := s.AddTags(1, "old"); err != nil {
+		t.Fatalf("AddTags failed: %v", err)
+	}
+	if err := s.SetNote(1, "gone soon"); err != nil {
+		t.Fatalf("SetNote failed: %v", err)
+	}
+
+	future := time.Now().Add(time.Hour)
+	if _, err := s.CleanHistory(nil, &future, false, false); err != nil {
+		t.Fatalf("CleanHistory failed: %v", err)
+	}
+
+	var count int
+	if err := s.db.QueryRow("SELECT (SELECT COUNT(*) FROM tags) + (SELECT COUNT(*) FROM notes)").Scan(&count); err != nil {
+		t.Fatalf("Counting annotations failed: %v", err)
+	}
+	if count != 0 {
+		t.Errorf("Expected annotations to be deleted with their commands, %d left", count)
+	}
+}
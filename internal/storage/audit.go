@@ -0,0 +1,534 @@
+package storage
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AuditSettings is stored in the database when audit mode is on
+type AuditSettings struct {
+	// Signed records that audit mode was turned on with a signing key.
+	// Being stored in the database, it is a hint: VerifyAudit relies on the
+	// AuditTrust it is given instead.
+	Signed bool `json:"signed"`
+}
+
+// AuditTrust is what VerifyAudit takes on trust. It must come from outside
+// the database, since anyone able to rewrite its rows could add their own
+// key, re-sign the chain or turn signing off.
+type AuditTrust struct {
+	// Keys are the public keys whose signatures are accepted. When there
+	// are any, every entry must be signed by one of them.
+	Keys []ed25519.PublicKey
+	// Head is a hash the chain must contain, such as the head reported by
+	// an earlier verify, so that a chain rebuilt from scratch is noticed
+	Head string
+}
+
+// auditHead records the last entry of the chain, so that removing entries
+// from the end is noticed
+type auditHead struct {
+	Seq       int    `json:"seq"`
+	Hash      string `json:"hash"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// auditContent is the part of a command covered by its audit hash. Tags and
+// notes are left out since they are meant to change.
+type auditContent struct {
+	Timestamp    string            `json:"timestamp"`
+	Command      string            `json:"command"`
+	SessionID    string            `json:"session_id"`
+	CWD          string            `json:"cwd"`
+	ExitCode     int               `json:"exit_code"`
+	Metadata     string            `json:"metadata"`
+	DurationMs   int64             `json:"duration_ms"`
+	ErrorType    string            `json:"error_type"`
+	PipeStatus   string            `json:"pipestatus"`
+	Hostname     string            `json:"hostname"`
+	Username     string            `json:"username"`
+	Shell        string            `json:"shell"`
+	ShellVersion string            `json:"shell_version"`
+	TTY          string            `json:"tty"`
+	Env          map[string]string `json:"env"`
+	GitRoot      string            `json:"git_root"`
+	GitRemote    string            `json:"git_remote"`
+	GitBranch    string            `json:"git_branch"`
+	GitCommit    string            `json:"git_commit"`
+}
+
+// querier is implemented by *sql.DB, *sql.Conn and *sql.Tx
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// getSetting reads a value from the settings table
+func getSetting(q querier, name string, v any) (bool, error) {
+	var value string
+	err := q.QueryRowContext(context.Background(), "SELECT value FROM settings WHERE name = ?", name).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("reading %s settings: %w", name, err)
+	}
+	if err := json.Unmarshal([]byte(value), v); err != nil {
+		return false, fmt.Errorf("decoding %s settings: %w", name, err)
+	}
+	return true, nil
+}
+
+// putSetting writes a value to the settings table
+func putSetting(q querier, name string, v any) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encoding %s settings: %w", name, err)
+	}
+	_, err = q.ExecContext(context.Background(),
+		"INSERT INTO settings (name, value) VALUES (?, ?) ON CONFLICT (name) DO UPDATE SET value = excluded.value",
+		name, string(value))
+	if err != nil {
+		return fmt.Errorf("saving %s settings: %w", name, err)
+	}
+	return nil
+}
+
+// loadAudit reads the audit settings of a newly opened database
+func (s *Store) loadAudit() error {
+	settings := &AuditSettings{}
+	found, err := getSetting(s.db, "audit", settings)
+	if err != nil {
+		return err
+	}
+	if !found {
+		settings = nil
+	}
+	s.audit = settings
+	return nil
+}
+
+// Audit returns the audit settings of the database, or nil if audit mode is
+// off
+func (s *Store) Audit() *AuditSettings {
+	return s.audit
+}
+
+// SetAuditSigner sets the key that signs new audit entries
+func (s *Store) SetAuditSigner(key ed25519.PrivateKey) {
+	s.auditSigner = key
+}
+
+// AuditKeyID identifies a signing key by its public key
+func AuditKeyID(public ed25519.PublicKey) string {
+	sum := sha256.Sum256(public)
+	return hex.EncodeToString(sum[:8])
+}
+
+// sign signs the message with the audit signer, returning "keyid:signature",
+// or "" when there is no signer
+func (s *Store) sign(message string) string {
+	if s.auditSigner == nil {
+		return ""
+	}
+	id := AuditKeyID(s.auditSigner.Public().(ed25519.PublicKey))
+	return id + ":" + base64.StdEncoding.EncodeToString(ed25519.Sign(s.auditSigner, []byte(message)))
+}
+
+// verifySignature checks a signature made by sign against the trusted keys,
+// indexed by AuditKeyID
+func verifySignature(keys map[string]ed25519.PublicKey, message, signature string) error {
+	if signature == "" {
+		return fmt.Errorf("not signed")
+	}
+	id, encoded, ok := strings.Cut(signature, ":")
+	if !ok {
+		return fmt.Errorf("malformed signature")
+	}
+	public, ok := keys[id]
+	if !ok {
+		return fmt.Errorf("signed with untrusted key %s", id)
+	}
+	sig, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || !ed25519.Verify(public, []byte(message), sig) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+// withImmediateTx runs fn in a transaction that takes the write lock up
+// front, so concurrent loggers append to the chain one at a time
+func (s *Store) withImmediateTx(ctx context.Context, fn func(q querier) error) error {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE"); err != nil {
+		return err
+	}
+	if err := fn(conn); err != nil {
+		conn.ExecContext(ctx, "ROLLBACK")
+		return err
+	}
+	_, err = conn.ExecContext(ctx, "COMMIT")
+	return err
+}
+
+// contentDigest hashes the audited content of a command
+func contentDigest(cmd Command) string {
+	data, _ := json.Marshal(auditContent{
+		Timestamp: cmd.Timestamp, Command: cmd.Command, SessionID: cmd.SessionID, CWD: cmd.CWD,
+		ExitCode: cmd.ExitCode, Metadata: cmd.Metadata, DurationMs: cmd.DurationMs, ErrorType: cmd.ErrorType,
+		PipeStatus: formatPipeStatus(cmd.PipeStatus), Hostname: cmd.Hostname, Username: cmd.Username,
+		Shell: cmd.Shell, ShellVersion: cmd.ShellVersion, TTY: cmd.TTY, Env: cmd.Env,
+		GitRoot: cmd.GitRoot, GitRemote: cmd.GitRemote, GitBranch: cmd.GitBranch, GitCommit: cmd.GitCommit,
+	})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// chainHash links an entry to the one before it. The sequence number and
+// row ID are included so entries cannot be renumbered or swapped.
+func chainHash(prev string, seq, id int, digest string) string {
+	sum := sha256.Sum256([]byte(prev + ":" + strconv.Itoa(seq) + ":" + strconv.Itoa(id) + ":" + digest))
+	return hex.EncodeToString(sum[:])
+}
+
+// headMessage is what the head signature covers
+func headMessage(h auditHead) string {
+	return "head:" + strconv.Itoa(h.Seq) + ":" + h.Hash
+}
+
+// tombstoneMessage is what a tombstone signature covers
+func tombstoneMessage(hash, deletedAt string) string {
+	return "tombstone:" + hash + ":" + deletedAt
+}
+
+// appendToChain adds the command with the given ID to the end of the audit
+// chain. It runs inside the transaction that inserted the command.
+func (s *Store) appendToChain(q querier, id int) error {
+	ctx := context.Background()
+	var head auditHead
+	if _, err := getSetting(q, "audit_head", &head); err != nil {
+		return err
+	}
+
+	rows, err := q.QueryContext(ctx, `SELECT `+commandColumns+` FROM commands WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if !rows.Next() {
+		rows.Close()
+		return fmt.Errorf("command %d vanished", id)
+	}
+	cmd, err := scanCommand(rows)
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	seq := head.Seq + 1
+	digest := contentDigest(cmd)
+	hash := chainHash(head.Hash, seq, id, digest)
+	_, err = q.ExecContext(ctx,
+		`UPDATE commands SET audit_seq = ?, audit_prev = ?, audit_digest = ?, audit_hash = ?, audit_sig = ? WHERE id = ?`,
+		seq, head.Hash, digest, hash, s.sign(hash), id)
+	if err != nil {
+		return fmt.Errorf("recording audit hash: %w", err)
+	}
+
+	head = auditHead{Seq: seq, Hash: hash}
+	head.Signature = s.sign(headMessage(head))
+	return putSetting(q, "audit_head", head)
+}
+
+// EnableAudit turns on audit mode. Existing commands are added to the chain
+// in ID order. With a signer, every entry is signed from now on.
+func (s *Store) EnableAudit(signer ed25519.PrivateKey) error {
+	if s == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	if s.audit != nil {
+		return fmt.Errorf("audit mode is already on")
+	}
+
+	settings := &AuditSettings{Signed: signer != nil}
+
+	err := s.withImmediateTx(context.Background(), func(q querier) error {
+		if err := putSetting(q, "audit", settings); err != nil {
+			return err
+		}
+		rows, err := q.QueryContext(context.Background(), "SELECT id FROM commands WHERE audit_seq IS NULL ORDER BY id")
+		if err != nil {
+			return err
+		}
+		var ids []int
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		s.auditSigner = signer
+		for _, id := range ids {
+			if err := s.appendToChain(q, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		s.auditSigner = nil
+		return fmt.Errorf("enabling audit mode: %w", err)
+	}
+	s.audit = settings
+	return nil
+}
+
+// tombstoneCommands records a signed tombstone for every audited command
+// matching the WHERE clause, so verify reports a deletion instead of a gap.
+// It runs inside the transaction that deletes them.
+func (s *Store) tombstoneCommands(q querier, where string, args []interface{}) error {
+	deletedAt := time.Now().UTC().Format(time.RFC3339)
+	rows, err := q.QueryContext(context.Background(), `
+		SELECT id, audit_seq, audit_prev, audit_digest, audit_hash, COALESCE(audit_sig, '')
+		FROM commands`+where+` AND audit_seq IS NOT NULL`, args...)
+	if err != nil {
+		return err
+	}
+	type tombstone struct {
+		id, seq                 int
+		prev, digest, hash, sig string
+	}
+	var tombstones []tombstone
+	for rows.Next() {
+		var t tombstone
+		if err := rows.Scan(&t.id, &t.seq, &t.prev, &t.digest, &t.hash, &t.sig); err != nil {
+			rows.Close()
+			return err
+		}
+		tombstones = append(tombstones, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, t := range tombstones {
+		_, err := q.ExecContext(context.Background(), `
+			INSERT INTO audit_tombstones (seq, command_id, prev_hash, digest, hash, signature, deleted_at, tombstone_signature)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			t.seq, t.id, t.prev, t.digest, t.hash, t.sig, deletedAt, s.sign(tombstoneMessage(t.hash, deletedAt)))
+		if err != nil {
+			return fmt.Errorf("recording tombstone: %w", err)
+		}
+	}
+	return nil
+}
+
+// AuditProblem is a sign of tampering found by VerifyAudit
+type AuditProblem struct {
+	// Seq is the position in the chain, or 0 for rows outside it
+	Seq int `json:"seq"`
+	// ID is the command's row ID, or 0 when it is gone
+	ID      int    `json:"id"`
+	Message string `json:"message"`
+}
+
+// AuditReport is the result of VerifyAudit
+type AuditReport struct {
+	// Entries counts the entries in the chain, including deleted ones
+	Entries int `json:"entries"`
+	// Deleted counts the entries removed by clean, which left tombstones
+	Deleted  int            `json:"deleted"`
+	Head     string         `json:"head"`
+	Problems []AuditProblem `json:"problems"`
+}
+
+// auditEntry is a chain entry read back for verification
+type auditEntry struct {
+	seq, id                 int
+	prev, digest, hash, sig string
+	// cmd is the live command, nil for a tombstone
+	cmd *Command
+	// deletedAt and tombstoneSig describe a tombstone
+	deletedAt, tombstoneSig string
+}
+
+// VerifyAudit walks the audit chain and reports edited, missing, reordered
+// and unsigned entries, and commands that were inserted around the chain.
+// Signatures are only checked against trust.Keys.
+func (s *Store) VerifyAudit(trust AuditTrust) (*AuditReport, error) {
+	if s == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+	if s.audit == nil {
+		return nil, fmt.Errorf("audit mode is off")
+	}
+
+	entries, err := s.readAuditEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &AuditReport{Problems: []AuditProblem{}}
+	problem := func(seq, id int, format string, args ...any) {
+		report.Problems = append(report.Problems, AuditProblem{seq, id, fmt.Sprintf(format, args...)})
+	}
+
+	keys := make(map[string]ed25519.PublicKey)
+	for _, public := range trust.Keys {
+		keys[AuditKeyID(public)] = public
+	}
+	signed := len(keys) > 0
+	foundHead := trust.Head == ""
+
+	prev := auditEntry{}
+	for _, e := range entries {
+		report.Entries++
+		switch {
+		case e.seq == prev.seq:
+			problem(e.seq, e.id, "entry appears more than once")
+		case e.seq > prev.seq+1:
+			problem(prev.seq+1, 0, "entries %d to %d are missing without a tombstone", prev.seq+1, e.seq-1)
+		}
+		if e.id <= prev.id {
+			problem(e.seq, e.id, "out of order: row ID %d follows row ID %d", e.id, prev.id)
+		}
+		if e.prev != prev.hash {
+			problem(e.seq, e.id, "chain broken: does not link to the previous entry")
+		}
+
+		if e.cmd != nil {
+			if contentDigest(*e.cmd) != e.digest {
+				problem(e.seq, e.id, "content was modified")
+			}
+		} else {
+			report.Deleted++
+			if signed {
+				if err := verifySignature(keys, tombstoneMessage(e.hash, e.deletedAt), e.tombstoneSig); err != nil {
+					problem(e.seq, e.id, "tombstone: %v", err)
+				}
+			}
+		}
+		if chainHash(e.prev, e.seq, e.id, e.digest) != e.hash {
+			problem(e.seq, e.id, "hash does not match the entry")
+		}
+		if signed {
+			if err := verifySignature(keys, e.hash, e.sig); err != nil {
+				problem(e.seq, e.id, "%v", err)
+			}
+		}
+		if e.hash == trust.Head {
+			foundHead = true
+		}
+		prev = e
+	}
+	report.Head = prev.hash
+	if !foundHead {
+		problem(0, 0, "the chain does not contain the expected head %s: it was rebuilt or cut short", trust.Head)
+	}
+
+	var head auditHead
+	if _, err := getSetting(s.db, "audit_head", &head); err != nil {
+		return nil, err
+	}
+	if head.Seq != prev.seq || head.Hash != prev.hash {
+		problem(prev.seq+1, 0, "the chain ends at entry %d but its recorded head is entry %d: later entries were removed or the head was altered", prev.seq, head.Seq)
+	}
+	if signed && head.Seq > 0 {
+		if err := verifySignature(keys, headMessage(head), head.Signature); err != nil {
+			problem(head.Seq, 0, "head: %v", err)
+		}
+	}
+
+	// Rows inserted without going through consolidate are not in the chain
+	rows, err := s.db.Query("SELECT id FROM commands WHERE audit_seq IS NULL ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("finding unaudited commands: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		problem(0, id, "not in the audit chain")
+	}
+	return report, rows.Err()
+}
+
+// readAuditEntries reads the live and deleted entries of the chain in order
+func (s *Store) readAuditEntries() ([]auditEntry, error) {
+	rows, err := s.db.Query(`SELECT ` + commandColumns + `, audit_seq, COALESCE(audit_prev, ''), COALESCE(audit_digest, ''),
+		COALESCE(audit_hash, ''), COALESCE(audit_sig, '')
+		FROM commands WHERE audit_seq IS NOT NULL ORDER BY audit_seq`)
+	if err != nil {
+		return nil, fmt.Errorf("reading audit chain: %w", err)
+	}
+	var live []auditEntry
+	for rows.Next() {
+		var e auditEntry
+		cmd, err := scanCommand(rows, &e.seq, &e.prev, &e.digest, &e.hash, &e.sig)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("reading audit chain: %w", err)
+		}
+		e.id = cmd.ID
+		e.cmd = &cmd
+		live = append(live, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading audit chain: %w", err)
+	}
+
+	rows, err = s.db.Query(`SELECT seq, command_id, prev_hash, digest, hash, COALESCE(signature, ''), deleted_at,
+		COALESCE(tombstone_signature, '') FROM audit_tombstones ORDER BY seq`)
+	if err != nil {
+		return nil, fmt.Errorf("reading tombstones: %w", err)
+	}
+	defer rows.Close()
+	var deleted []auditEntry
+	for rows.Next() {
+		var e auditEntry
+		if err := rows.Scan(&e.seq, &e.id, &e.prev, &e.digest, &e.hash, &e.sig, &e.deletedAt, &e.tombstoneSig); err != nil {
+			return nil, fmt.Errorf("reading tombstones: %w", err)
+		}
+		deleted = append(deleted, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading tombstones: %w", err)
+	}
+
+	// Merge the two sorted lists by sequence number
+	entries := make([]auditEntry, 0, len(live)+len(deleted))
+	for len(live) > 0 || len(deleted) > 0 {
+		if len(deleted) == 0 || (len(live) > 0 && live[0].seq <= deleted[0].seq) {
+			entries, live = append(entries, live[0]), live[1:]
+		} else {
+			entries, deleted = append(entries, deleted[0]), deleted[1:]
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,199 @@
+//go:build cgo
+
+package storage
+
+import (
+	"crypto/ed25519"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// expectProblem fails unless verifying the store with trust reports a
+// problem containing text
+func expectProblem(t *testing.T, s *Store, trust AuditTrust, text string) {
+	t.Helper()
+	report, err := s.VerifyAudit(trust)
+	if err != nil {
+		t.Fatalf("VerifyAudit failed: %v", err)
+	}
+	for _, p := range report.Problems {
+		if strings.Contains(p.Message, text) {
+			return
+		}
+	}
+	t.Errorf("Expected a problem containing %q, got %+v", text, report.Problems)
+}
+
+func TestAuditChain(t *testing.T) {
+	s := openTestStore(t, filepath.Join(t.TempDir(), "history.db"))
+
+	for _, c := range []string{"whoami", "sudo systemctl restart nginx"} {
+		if err := s.SaveCommand(c, "s", "/", 0, ""); err != nil {
+			t.Fatalf("SaveCommand failed: %v", err)
+		}
+	}
+
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	if err := s.EnableAudit(key); err != nil {
+		t.Fatalf("EnableAudit failed: %v", err)
+	}
+	for _, c := range []string{"cat /etc/shadow", "ls", "exit"} {
+		if err := s.SaveCommand(c, "s", "/", 0, `{"ticket":"CHG-1"}`); err != nil {
+			t.Fatalf("SaveCommand failed: %v", err)
+		}
+	}
+
+	trust := AuditTrust{Keys: []ed25519.PublicKey{key.Public().(ed25519.PublicKey)}}
+	report, err := s.VerifyAudit(trust)
+	if err != nil {
+		t.Fatalf("VerifyAudit failed: %v", err)
+	}
+	if report.Entries != 5 || len(report.Problems) != 0 {
+		t.Fatalf("Expected 5 clean entries, got %+v", report)
+	}
+
+	// Cleaning leaves a tombstone rather than a gap
+	if _, err := s.CleanCommands(CleanCriteria{Meta: map[string]string{"ticket": "CHG-1"}, To: ptr(time.Now().Add(time.Hour))}); err != nil {
+		t.Fatalf("CleanCommands failed: %v", err)
+	}
+	report, err = s.VerifyAudit(trust)
+	if err != nil {
+		t.Fatalf("VerifyAudit failed: %v", err)
+	}
+	if report.Entries != 5 || report.Deleted != 3 || len(report.Problems) != 0 {
+		t.Fatalf("Expected 5 entries with 3 deleted and no problems, got %+v", report)
+	}
+	if err := s.SaveCommand("uptime", "s", "/", 0, ""); err != nil {
+		t.Fatalf("SaveCommand failed: %v", err)
+	}
+
+	if _, err := s.db.Exec("UPDATE commands SET command = 'ls' WHERE id = 2"); err != nil {
+		t.Fatalf("Tampering failed: %v", err)
+	}
+	expectProblem(t, s, trust, "content was modified")
+
+	if _, err := s.db.Exec("DELETE FROM commands WHERE id = 1"); err != nil {
+		t.Fatalf("Tampering failed: %v", err)
+	}
+	expectProblem(t, s, trust, "entries 1 to 1 are missing")
+
+	if _, err := s.db.Exec("INSERT INTO commands (command) VALUES ('backdoor')"); err != nil {
+		t.Fatalf("Tampering failed: %v", err)
+	}
+	expectProblem(t, s, trust, "not in the audit chain")
+
+	if _, err := s.db.Exec("DELETE FROM commands WHERE audit_seq = 6"); err != nil {
+		t.Fatalf("Tampering failed: %v", err)
+	}
+	expectProblem(t, s, trust, "later entries were removed")
+}
+
+func TestAuditSignatures(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	s := openTestStore(t, path)
+
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	if err := s.EnableAudit(key); err != nil {
+		t.Fatalf("EnableAudit failed: %v", err)
+	}
+	trust := AuditTrust{Keys: []ed25519.PublicKey{key.Public().(ed25519.PublicKey)}}
+	for _, c := range []string{"a", "b", "c"} {
+		if err := s.SaveCommand(c, "s", "/", 0, ""); err != nil {
+			t.Fatalf("SaveCommand failed: %v", err)
+		}
+	}
+
+	// Recomputing the hashes after an edit still leaves a bad signature
+	var prev string
+	if err := s.db.QueryRow("SELECT audit_prev FROM commands WHERE id = 2").Scan(&prev); err != nil {
+		t.Fatalf("Reading the chain failed: %v", err)
+	}
+	if _, err := s.db.Exec("UPDATE commands SET command = 'x' WHERE id = 2"); err != nil {
+		t.Fatalf("Tampering failed: %v", err)
+	}
+	rows, err := s.db.Query(`SELECT ` + commandColumns + ` FROM commands WHERE id = 2`)
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	rows.Next()
+	cmd, err := scanCommand(rows)
+	rows.Close()
+	if err != nil {
+		t.Fatalf("scanCommand failed: %v", err)
+	}
+	digest := contentDigest(cmd)
+	if _, err := s.db.Exec("UPDATE commands SET audit_digest = ?, audit_hash = ? WHERE id = 2", digest, chainHash(prev, 2, 2, digest)); err != nil {
+		t.Fatalf("Tampering failed: %v", err)
+	}
+	expectProblem(t, s, trust, "invalid signature")
+
+	// Reopening forgets the signer, so new entries go unsigned
+	s.Close()
+	s = openTestStore(t, path)
+	if err := s.SaveCommand("d", "s", "/", 0, ""); err != nil {
+		t.Fatalf("SaveCommand failed: %v", err)
+	}
+	expectProblem(t, s, trust, "not signed")
+
+	// Swapping two entries breaks the chain
+	if _, err := s.db.Exec("UPDATE commands SET audit_seq = -audit_seq WHERE id IN (1, 3)"); err != nil {
+		t.Fatalf("Tampering failed: %v", err)
+	}
+	if _, err := s.db.Exec("UPDATE commands SET audit_seq = CASE id WHEN 1 THEN 3 ELSE 1 END WHERE id IN (1, 3)"); err != nil {
+		t.Fatalf("Tampering failed: %v", err)
+	}
+	expectProblem(t, s, trust, "out of order")
+}
+
+func TestAuditTrust(t *testing.T) {
+	public, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	_, forged, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	trust := AuditTrust{Keys: []ed25519.PublicKey{public}}
+
+	// Whoever rewrites the database can sign with their own key or not at
+	// all, but neither passes with a key trusted from outside it
+	var s *Store
+	for _, signer := range []ed25519.PrivateKey{forged, nil} {
+		s = openTestStore(t, filepath.Join(t.TempDir(), "history.db"))
+		if err := s.EnableAudit(signer); err != nil {
+			t.Fatalf("EnableAudit failed: %v", err)
+		}
+		if err := s.SaveCommand("rm -rf /var/log", "s", "/", 0, ""); err != nil {
+			t.Fatalf("SaveCommand failed: %v", err)
+		}
+		if signer != nil {
+			expectProblem(t, s, trust, "signed with untrusted key")
+		} else {
+			expectProblem(t, s, trust, "not signed")
+		}
+	}
+
+	// A chain rebuilt from scratch lacks the head recorded earlier
+	report, err := s.VerifyAudit(AuditTrust{})
+	if err != nil {
+		t.Fatalf("VerifyAudit failed: %v", err)
+	}
+	head := report.Head
+	if report, err = s.VerifyAudit(AuditTrust{Head: head}); err != nil || len(report.Problems) != 0 {
+		t.Fatalf("Expected the head to be found, got %+v, %v", report, err)
+	}
+	expectProblem(t, s, AuditTrust{Head: strings.Repeat("0", len(head))}, "does not contain the expected head")
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"context"
+)
+
+// Backend keeps the history. Store keeps it in SQLite with every feature;
+// BoltStore keeps the commands alone in a bbolt file and needs no cgo.
+type Backend interface {
+	// Save records a command, assigning its ID, UID and Origin, and its
+	// Timestamp unless it is set
+	Save(ctx context.Context, cmd Command) error
+	// Query returns the commands matching the filter, newest first unless
+	// the filter asks for another order
+	Query(ctx context.Context, f Filter) ([]Command, error)
+	// Unique returns the distinct commands matching the filter, most
+	// recently used first, or least recently used first with f.Reverse
+	Unique(ctx context.Context, f Filter) ([]CommandSummary, error)
+	// Frecent returns the distinct commands matching the filter, ranked by
+	// how often and how recently they were run
+	Frecent(ctx context.Context, f Filter) ([]CommandSummary, error)
+	// Delete removes the command with the given ID
+	Delete(ctx context.Context, id int) error
+	// Stats summarizes the commands matching the filter, ignoring its
+	// Limit, Offset and ordering
+	Stats(ctx context.Context, f Filter) (*HistoryStats, error)
+	// Migrate creates the schema, or upgrades it from older versions. The
+	// Open functions call it, and calling it again does nothing.
+	Migrate(ctx context.Context) error
+	Close() error
+}
+
+// sqliteBackend is a Store seen as a Backend
+type sqliteBackend struct {
+	s *Store
+}
+
+// Backend returns the store as a Backend
+func (s *Store) Backend() Backend {
+	return sqliteBackend{s}
+}
+
+func (b sqliteBackend) Save(ctx context.Context, cmd Command) error {
+	return b.s.SaveEntryContext(ctx, cmd)
+}
+
+func (b sqliteBackend) Query(ctx context.Context, f Filter) ([]Command, error) {
+	return b.s.QueryCommandsContext(ctx, f)
+}
+
+func (b sqliteBackend) Unique(ctx context.Context, f Filter) ([]CommandSummary, error) {
+	return b.s.UniqueCommandsContext(ctx, f)
+}
+
+func (b sqliteBackend) Frecent(ctx context.Context, f Filter) ([]CommandSummary, error) {
+	return b.s.FrecentCommandsContext(ctx, f)
+}
+
+func (b sqliteBackend) Delete(ctx context.Context, id int) error {
+	return b.s.DeleteCommandContext(ctx, id)
+}
+
+func (b sqliteBackend) Stats(ctx context.Context, f Filter) (*HistoryStats, error) {
+	return b.s.StatsContext(ctx, f)
+}
+
+func (b sqliteBackend) Migrate(ctx context.Context) error {
+	return b.s.init()
+}
+
+func (b sqliteBackend) Close() error {
+	return b.s.Close()
+}
@@ -0,0 +1,15 @@
+//go:build cgo
+
+package storage
+
+import "testing"
+
+func TestSQLiteBackend(t *testing.T) {
+	s, err := Open(":memory:")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	b := s.Backend()
+	defer b.Close()
+	testBackend(t, b)
+}
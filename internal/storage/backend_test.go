@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testBackend checks the behavior every backend must share
+func testBackend(t *testing.T, b Backend) {
+	ctx := context.Background()
+	for _, cmd := range []Command{
+		{Command: "make", SessionID: "1", CWD: "/src", ExitCode: 2, Hostname: "laptop"},
+		{Command: "make  test", SessionID: "1", CWD: "/src/app", Hostname: "laptop", Metadata: `{"job":7}`},
+		{Command: "git push", SessionID: "2", CWD: "/src", Hostname: "server", PipeStatus: []int{0, 1}},
+		{Command: "make test", SessionID: "2", CWD: "/tmp", Hostname: "server"},
+		{Command: "LS", SessionID: "3", CWD: "/", Hostname: "laptop"},
+	} {
+		if err := b.Save(ctx, cmd); err != nil {
+			t.Fatalf("Save failed: %v", err)
+		}
+	}
+
+	ids := func(commands []Command) []int {
+		var out []int
+		for _, c := range commands {
+			out = append(out, c.ID)
+		}
+		return out
+	}
+	zero := 0
+	yesterday := time.Now().Add(-24 * time.Hour)
+	for _, tc := range []struct {
+		name     string
+		filter   Filter
+		expected []int
+	}{
+		{"all", Filter{Limit: 10}, []int{5, 4, 3, 2, 1}},
+		{"reverse", Filter{Limit: 2, Reverse: true}, []int{1, 2}},
+		{"offset", Filter{Limit: 2, Offset: 3}, []int{2, 1}},
+		{"text", Filter{Query: "ls", Limit: 10}, []int{5}},
+		{"failed", Filter{Failed: true, Limit: 10}, []int{3, 1}},
+		{"exit code", Filter{ExitCode: &zero, Limit: 10}, []int{5, 4, 3, 2}},
+		{"host", Filter{Host: "server", Limit: 10}, []int{4, 3}},
+		{"session", Filter{Session: "1", Limit: 10}, []int{2, 1}},
+		{"dir", Filter{Dir: "/src", Limit: 10}, []int{3, 1}},
+		{"subtree", Filter{Dir: "/src", Subtree: true, Limit: 10}, []int{3, 2, 1}},
+		{"meta", Filter{Meta: map[string]string{"job": "7"}, Limit: 10}, []int{2}},
+		{"after", Filter{AfterID: 3, Limit: 10}, []int{5, 4}},
+		{"before", Filter{BeforeID: 3, Limit: 10}, []int{2, 1}},
+		{"from", Filter{From: &yesterday, Limit: 10}, []int{5, 4, 3, 2, 1}},
+		{"to", Filter{To: &yesterday, Limit: 10}, nil},
+		{"frecency", Filter{Frecency: true, Limit: 2}, []int{4, 2}},
+	} {
+		commands, err := b.Query(ctx, tc.filter)
+		if err != nil {
+			t.Fatalf("%s: Query failed: %v", tc.name, err)
+		}
+		if got := ids(commands); !slices.Equal(got, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, got)
+		}
+	}
+
+	commands, _ := b.Query(ctx, Filter{Limit: 1})
+	if cmd := commands[0]; cmd.UID == "" || cmd.Origin == "" || cmd.Hostname != "laptop" ||
+		!strings.HasSuffix(cmd.Timestamp, "Z") {
+		t.Errorf("Unexpected saved command %+v", cmd)
+	}
+	// Saving a command again under its UID does nothing
+	if err := b.Save(ctx, commands[0]); err != nil {
+		t.Fatalf("Saving again failed: %v", err)
+	}
+	if again, _ := b.Query(ctx, Filter{Limit: 10}); len(again) != 5 {
+		t.Errorf("Expected the command saved once, got %d commands", len(again))
+	}
+
+	unique, err := b.Unique(ctx, Filter{Query: "make", Limit: 10})
+	if err != nil || len(unique) != 2 || unique[0].Command != "make test" || unique[0].Count != 2 ||
+		len(unique[0].Dirs) != 2 || unique[1].LastExitCode != 2 {
+		t.Errorf("Unexpected unique commands %+v (%v)", unique, err)
+	}
+	frecent, err := b.Frecent(ctx, Filter{Limit: 1})
+	if err != nil || len(frecent) != 1 || frecent[0].Command != "make test" || frecent[0].Score != 8 {
+		t.Errorf("Unexpected frecent commands %+v (%v)", frecent, err)
+	}
+
+	stats, err := b.Stats(ctx, Filter{})
+	if err != nil {
+		t.Fatalf("Stats failed: %v", err)
+	}
+	if stats.Commands != 5 || stats.Unique != 4 || stats.Failed != 2 || stats.Sessions != 3 || stats.Hosts != 2 ||
+		len(stats.PerDay) != 1 || stats.TopCommands[0].Command != "make test" || stats.TopDirs[0].Dir != "/src" ||
+		stats.TopDirs[0].Count != 2 || stats.First == "" {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	if err := b.Delete(ctx, 3); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := b.Delete(ctx, 3); err == nil {
+		t.Error("Expected an error deleting a missing command")
+	}
+	if commands, _ := b.Query(ctx, Filter{Host: "server", Limit: 10}); len(commands) != 1 {
+		t.Errorf("Expected the command deleted, got %v", commands)
+	}
+
+	if err := b.Migrate(ctx); err != nil {
+		t.Errorf("Migrating again failed: %v", err)
+	}
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := b.Query(canceled, Filter{Limit: 10}); err == nil {
+		t.Error("Expected a canceled query to fail")
+	}
+}
+
+func TestBoltBackend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.bolt")
+	b, err := OpenBolt(path)
+	if err != nil {
+		t.Fatalf("OpenBolt failed: %v", err)
+	}
+	testBackend(t, b)
+	origin := b.Origin()
+	b.Close()
+
+	// Reopening keeps the commands, the origin and the IDs
+	b, err = OpenBolt(path)
+	if err != nil {
+		t.Fatalf("OpenBolt failed: %v", err)
+	}
+	defer b.Close()
+	if b.Origin() != origin {
+		t.Errorf("Expected origin %s, got %s", origin, b.Origin())
+	}
+	if err := b.Save(context.Background(), Command{Command: "exit"}); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	commands, err := b.Query(context.Background(), Filter{Limit: 10})
+	if err != nil || len(commands) != 5 || commands[0].ID != 6 {
+		t.Errorf("Expected 5 commands, the newest with ID 6, got %v (%v)", commands, err)
+	}
+	if commands, _ := b.Query(context.Background(), Filter{Tags: []string{"x"}, Limit: 10}); len(commands) != 0 {
+		t.Errorf("Expected no tagged commands, got %v", commands)
+	}
+	// A store left open, as by 'history -f', does not lock out the others
+	other, err := OpenBolt(path)
+	if err != nil {
+		t.Fatalf("OpenBolt with the store still open failed: %v", err)
+	}
+	defer other.Close()
+	if err := other.Save(context.Background(), Command{Command: "uptime"}); err != nil {
+		t.Fatalf("Save with the store still open failed: %v", err)
+	}
+	if commands, err := b.Query(context.Background(), Filter{Limit: 1}); err != nil || len(commands) != 1 || commands[0].Command != "uptime" {
+		t.Errorf("Expected the other store's command, got %v (%v)", commands, err)
+	}
+}
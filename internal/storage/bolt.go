@@ -0,0 +1,542 @@
+package storage
+
+import (
+	"cmp"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/khelechy/consolidate/internal/ulid"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Buckets of a bolt database
+var (
+	// boltCommands maps big-endian IDs to commands encoded as JSON, so a
+	// cursor walks them in the order they were saved
+	boltCommands = []byte("commands")
+	// boltSettings holds the schema version and the origin
+	boltSettings = []byte("settings")
+	// boltUIDs maps the UID of every command to its key in boltCommands
+	boltUIDs = []byte("uids")
+)
+
+// boltVersion is the schema version Migrate upgrades bolt databases to
+const boltVersion = 2
+
+// boltLockTimeout is how long an operation waits for other processes to
+// release the file. A writer locks the whole file; readers share it.
+const boltLockTimeout = 10 * time.Second
+
+// BoltStore is a Backend keeping commands in a bbolt file, in pure Go. It
+// has no tags, notes, encryption, audit mode or sync; filters are applied
+// by reading every command, which suits histories of up to a few hundred
+// thousand commands.
+//
+// The file is opened for each operation rather than for the life of the
+// store, so a store kept open, as by 'history -f', does not hold the lock
+// other shells need to log commands.
+type BoltStore struct {
+	path   string
+	origin string
+}
+
+// OpenBolt opens the bolt database at path, creating it if it does not
+// exist
+func OpenBolt(path string) (*BoltStore, error) {
+	b := &BoltStore{path: path}
+	// A database that is up to date is only read, so shells opening it at
+	// once do not queue for the write lock
+	if b.current() {
+		return b, nil
+	}
+	if err := b.Migrate(context.Background()); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// current reports whether the database exists at the latest schema
+// version, loading its origin if so
+func (b *BoltStore) current() bool {
+	err := b.view(func(tx *bolt.Tx) error {
+		settings := tx.Bucket(boltSettings)
+		if settings == nil {
+			return errors.New("no settings")
+		}
+		origin := settings.Get([]byte("origin"))
+		if string(settings.Get([]byte("version"))) != strconv.Itoa(boltVersion) || origin == nil {
+			return errors.New("not current")
+		}
+		b.origin = string(origin)
+		return nil
+	})
+	return err == nil
+}
+
+// update runs fn in a read-write transaction, holding the file's exclusive
+// lock only for its duration
+func (b *BoltStore) update(fn func(*bolt.Tx) error) error {
+	db, err := bolt.Open(b.path, 0600, &bolt.Options{Timeout: boltLockTimeout})
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", b.path, err)
+	}
+	defer db.Close()
+	return db.Update(fn)
+}
+
+// view runs fn in a read-only transaction, sharing the file's lock with
+// other readers
+func (b *BoltStore) view(fn func(*bolt.Tx) error) error {
+	db, err := bolt.Open(b.path, 0600, &bolt.Options{Timeout: boltLockTimeout, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", b.path, err)
+	}
+	defer db.Close()
+	return db.View(fn)
+}
+
+// Migrate creates the buckets and the origin of a new database
+func (b *BoltStore) Migrate(ctx context.Context) error {
+	return b.update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltCommands); err != nil {
+			return err
+		}
+		settings, err := tx.CreateBucketIfNotExists(boltSettings)
+		if err != nil {
+			return err
+		}
+
+		version := 0
+		if v := settings.Get([]byte("version")); v != nil {
+			version, _ = strconv.Atoi(string(v))
+		}
+		if version > boltVersion {
+			return fmt.Errorf("database schema version %d is newer than this consolidate supports", version)
+		}
+		uids, err := tx.CreateBucketIfNotExists(boltUIDs)
+		if err != nil {
+			return err
+		}
+		if version < 2 {
+			// Index the UIDs of commands saved before there was an index
+			err := tx.Bucket(boltCommands).ForEach(func(key, data []byte) error {
+				var cmd Command
+				if err := json.Unmarshal(data, &cmd); err != nil {
+					return fmt.Errorf("decoding command %d: %w", binary.BigEndian.Uint64(key), err)
+				}
+				return uids.Put([]byte(cmd.UID), key)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if err := settings.Put([]byte("version"), []byte(strconv.Itoa(boltVersion))); err != nil {
+			return err
+		}
+
+		if origin := settings.Get([]byte("origin")); origin != nil {
+			b.origin = string(origin)
+			return nil
+		}
+		b.origin = ulid.New(time.Now())
+		return settings.Put([]byte("origin"), []byte(b.origin))
+	})
+}
+
+// Close releases the store. The file is only open during operations, so
+// there is nothing to close.
+func (b *BoltStore) Close() error {
+	return nil
+}
+
+// Origin returns the identifier of the database
+func (b *BoltStore) Origin() string {
+	return b.origin
+}
+
+func boltKey(id int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(id))
+	return key
+}
+
+// Save records a command. Tags and notes are not kept. A command whose UID
+// is already saved is skipped.
+func (b *BoltStore) Save(ctx context.Context, cmd Command) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	now := time.Now()
+	if t, err := time.Parse(time.RFC3339Nano, cmd.Timestamp); err == nil {
+		cmd.Timestamp = t.UTC().Format(time.RFC3339)
+	} else {
+		cmd.Timestamp = now.UTC().Format(time.RFC3339)
+	}
+	if cmd.UID == "" {
+		cmd.UID = ulid.New(now)
+	}
+	cmd.Origin = b.origin
+	cmd.Tags, cmd.Note = nil, ""
+
+	err := b.update(func(tx *bolt.Tx) error {
+		commands, uids := tx.Bucket(boltCommands), tx.Bucket(boltUIDs)
+		if uids.Get([]byte(cmd.UID)) != nil {
+			return nil
+		}
+		id, err := commands.NextSequence()
+		if err != nil {
+			return err
+		}
+		cmd.ID = int(id)
+		data, err := json.Marshal(cmd)
+		if err != nil {
+			return err
+		}
+		if err := uids.Put([]byte(cmd.UID), boltKey(cmd.ID)); err != nil {
+			return err
+		}
+		return commands.Put(boltKey(cmd.ID), data)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save command: %w", err)
+	}
+	return nil
+}
+
+// Delete removes the command with the given ID
+func (b *BoltStore) Delete(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return b.update(func(tx *bolt.Tx) error {
+		commands := tx.Bucket(boltCommands)
+		data := commands.Get(boltKey(id))
+		if data == nil {
+			return fmt.Errorf("no command with ID %d", id)
+		}
+		var cmd Command
+		if err := json.Unmarshal(data, &cmd); err == nil {
+			if err := tx.Bucket(boltUIDs).Delete([]byte(cmd.UID)); err != nil {
+				return err
+			}
+		}
+		return commands.Delete(boltKey(id))
+	})
+}
+
+// matching returns the commands matching the filter, oldest first
+func (b *BoltStore) matching(ctx context.Context, f Filter) ([]Command, error) {
+	var commands []Command
+	err := b.view(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltCommands).Cursor()
+		for key, data := c.First(); key != nil; key, data = c.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			var cmd Command
+			if err := json.Unmarshal(data, &cmd); err != nil {
+				return fmt.Errorf("decoding command %d: %w", binary.BigEndian.Uint64(key), err)
+			}
+			if f.matches(cmd) {
+				commands = append(commands, cmd)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return commands, nil
+}
+
+// Query returns the commands matching the filter, newest first unless the
+// filter asks for another order
+func (b *BoltStore) Query(ctx context.Context, f Filter) ([]Command, error) {
+	commands, err := b.matching(ctx, f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search commands: %w", err)
+	}
+
+	switch {
+	case f.Frecency:
+		scores := make(map[string]float64)
+		now := time.Now()
+		for _, cmd := range commands {
+			scores[normalizeCommand(cmd.Command)] += frecencyScore(cmd.Timestamp, now)
+		}
+		slices.SortStableFunc(commands, func(a, b Command) int {
+			return cmp.Or(cmp.Compare(scores[normalizeCommand(b.Command)], scores[normalizeCommand(a.Command)]),
+				cmp.Compare(b.ID, a.ID))
+		})
+	case !f.Reverse:
+		slices.Reverse(commands)
+	}
+	return page(commands, f), nil
+}
+
+// Unique returns the distinct commands matching the filter, most recently
+// used first, or least recently used first when f.Reverse is set
+func (b *BoltStore) Unique(ctx context.Context, f Filter) ([]CommandSummary, error) {
+	groups, err := b.summarize(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+	if !f.Reverse {
+		slices.Reverse(groups)
+	}
+	return summaries(page(groups, f)), nil
+}
+
+// Frecent returns the distinct commands matching the filter, ranked by
+// frecency
+func (b *BoltStore) Frecent(ctx context.Context, f Filter) ([]CommandSummary, error) {
+	groups, err := b.summarize(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+	sortByScore(groups)
+	return summaries(page(groups, f)), nil
+}
+
+// Stats summarizes the commands matching the filter
+func (b *BoltStore) Stats(ctx context.Context, f Filter) (*HistoryStats, error) {
+	commands, err := b.matching(ctx, f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count commands: %w", err)
+	}
+
+	stats := &HistoryStats{PerDay: []DayCount{}, TopDirs: []DirCount{}, TopCommands: []CommandSummary{}}
+	unique := make(map[string]bool)
+	sessions := make(map[string]bool)
+	hosts := make(map[string]bool)
+	days := make(map[string]int)
+	dirs := make(map[string]int)
+	for _, cmd := range commands {
+		stats.Commands++
+		unique[normalizeCommand(cmd.Command)] = true
+		sessions[cmd.SessionID] = true
+		hosts[cmd.Hostname] = true
+		if cmd.Failed() {
+			stats.Failed++
+		}
+		if stats.First == "" || cmd.Timestamp < stats.First {
+			stats.First = cmd.Timestamp
+		}
+		if cmd.Timestamp > stats.Last {
+			stats.Last = cmd.Timestamp
+		}
+		if t, err := time.Parse(time.RFC3339, cmd.Timestamp); err == nil {
+			t = t.UTC()
+			days[t.Format(time.DateOnly)]++
+			stats.PerHour[t.Hour()]++
+		}
+		dirs[cmd.CWD]++
+	}
+	stats.Unique, stats.Sessions, stats.Hosts = len(unique), len(sessions), len(hosts)
+
+	for _, day := range slices.Sorted(maps.Keys(days)) {
+		stats.PerDay = append(stats.PerDay, DayCount{Day: day, Count: days[day]})
+	}
+	for dir, count := range dirs {
+		stats.TopDirs = append(stats.TopDirs, DirCount{Dir: dir, Count: count})
+	}
+	slices.SortFunc(stats.TopDirs, func(a, b DirCount) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), strings.Compare(a.Dir, b.Dir))
+	})
+	stats.TopDirs = stats.TopDirs[:min(len(stats.TopDirs), topCount)]
+
+	groups := groupCommands(commands)
+	slices.SortStableFunc(groups, func(a, b *commandGroup) int {
+		return cmp.Or(cmp.Compare(b.count, a.count), cmp.Compare(b.latest.ID, a.latest.ID))
+	})
+	stats.TopCommands = append(stats.TopCommands, summaries(groups[:min(len(groups), topCount)])...)
+	return stats, nil
+}
+
+// commandGroup collects the runs of one normalized command text
+type commandGroup struct {
+	latest    Command
+	count     int
+	firstSeen string
+	dirs      []string
+	score     float64
+}
+
+// summarize groups the commands matching the filter by their normalized
+// text, in the order of their latest runs
+func (b *BoltStore) summarize(ctx context.Context, f Filter) ([]*commandGroup, error) {
+	commands, err := b.matching(ctx, f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to summarize commands: %w", err)
+	}
+	return groupCommands(commands), nil
+}
+
+// groupCommands groups commands given oldest first by their normalized
+// text, ordered by the ID of their latest run
+func groupCommands(commands []Command) []*commandGroup {
+	byText := make(map[string]*commandGroup)
+	now := time.Now()
+	for _, cmd := range commands {
+		text := normalizeCommand(cmd.Command)
+		g := byText[text]
+		if g == nil {
+			g = &commandGroup{firstSeen: cmd.Timestamp}
+			byText[text] = g
+		}
+		g.latest = cmd
+		g.count++
+		g.score += frecencyScore(cmd.Timestamp, now)
+		if !slices.Contains(g.dirs, cmd.CWD) {
+			g.dirs = append(g.dirs, cmd.CWD)
+		}
+	}
+	groups := slices.Collect(maps.Values(byText))
+	slices.SortFunc(groups, func(a, b *commandGroup) int { return cmp.Compare(a.latest.ID, b.latest.ID) })
+	return groups
+}
+
+// sortByScore orders groups by frecency, breaking ties by the latest run
+func sortByScore(groups []*commandGroup) {
+	slices.SortStableFunc(groups, func(a, b *commandGroup) int {
+		return cmp.Or(cmp.Compare(b.score, a.score), cmp.Compare(b.latest.ID, a.latest.ID))
+	})
+}
+
+func summaries(groups []*commandGroup) []CommandSummary {
+	var out []CommandSummary
+	for _, g := range groups {
+		out = append(out, CommandSummary{
+			Command:      g.latest.Command,
+			Count:        g.count,
+			FirstSeen:    g.firstSeen,
+			LastSeen:     g.latest.Timestamp,
+			LastExitCode: g.latest.ExitCode,
+			Dirs:         g.dirs,
+			Score:        g.score,
+		})
+	}
+	return out
+}
+
+// page applies the filter's Offset and Limit
+func page[T any](items []T, f Filter) []T {
+	if f.Offset >= len(items) {
+		return nil
+	}
+	items = items[f.Offset:]
+	return items[:min(len(items), max(f.Limit, 0))]
+}
+
+// frecencyScore weighs a run by its age like frecencyWeight
+func frecencyScore(timestamp string, now time.Time) float64 {
+	t, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return 0.25
+	}
+	switch age := now.Sub(t); {
+	case age < time.Hour:
+		return 4
+	case age < 24*time.Hour:
+		return 2
+	case age < 7*24*time.Hour:
+		return 1
+	case age < 30*24*time.Hour:
+		return 0.5
+	default:
+		return 0.25
+	}
+}
+
+// matches reports whether the filter selects the command, like the WHERE
+// clause built by where
+func (f Filter) matches(c Command) bool {
+	// LIKE ignores the case of ASCII letters
+	if f.Query != "" && !strings.Contains(strings.ToLower(c.Command), strings.ToLower(f.Query)) {
+		return false
+	}
+	if f.Failed && !c.Failed() {
+		return false
+	}
+	for _, field := range []struct{ want, got string }{
+		{f.Session, c.SessionID}, {f.Host, c.Hostname}, {f.User, c.Username}, {f.Repo, c.GitRoot},
+		{f.Branch, c.GitBranch},
+	} {
+		if field.want != "" && field.want != field.got {
+			return false
+		}
+	}
+	if f.Dir != "" && c.CWD != f.Dir {
+		dir := strings.TrimRight(f.Dir, `/\`)
+		if !f.Subtree || !(strings.HasPrefix(c.CWD, dir+"/") || strings.HasPrefix(c.CWD, dir+`\`)) {
+			return false
+		}
+	}
+	if f.ExitCode != nil && c.ExitCode != *f.ExitCode {
+		return false
+	}
+	if f.From != nil || f.To != nil {
+		t, err := time.Parse(time.RFC3339, c.Timestamp)
+		if err != nil {
+			return false
+		}
+		// Timestamps are kept to the second
+		if f.From != nil && t.Before(f.From.Truncate(time.Second)) {
+			return false
+		}
+		if f.To != nil && t.After(f.To.Truncate(time.Second)) {
+			return false
+		}
+	}
+	if len(f.Tags) > 0 || f.Starred {
+		// Bolt databases keep no tags
+		return false
+	}
+	if len(f.Meta) > 0 && !metaMatches(c.Metadata, f.Meta) {
+		return false
+	}
+	if f.AfterID > 0 && c.ID <= f.AfterID {
+		return false
+	}
+	if f.BeforeID > 0 && c.ID >= f.BeforeID {
+		return false
+	}
+	return true
+}
+
+// metaMatches reports whether metadata is a JSON object holding every key
+// with its value, compared as text like metaWhere
+func metaMatches(metadata string, meta map[string]string) bool {
+	var object map[string]any
+	if err := json.Unmarshal([]byte(metadata), &object); err != nil {
+		return false
+	}
+	for key, want := range meta {
+		value, ok := object[key]
+		if !ok {
+			return false
+		}
+		var got string
+		switch v := value.(type) {
+		case string:
+			got = v
+		case nil:
+			return false
+		default:
+			data, _ := json.Marshal(v)
+			got = string(data)
+		}
+		if got != want {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	berrors "go.etcd.io/bbolt/errors"
+)
+
+// busyTimeout is how long a connection waits for another one to release
+// its lock before failing with SQLITE_BUSY. The shell hooks log before
+// showing the prompt, so with the retries below a write gives up within
+// about six seconds and log spools the command instead.
+const busyTimeout = time.Second
+
+// connParams configures every new connection. WAL lets readers and a writer
+// work at the same time, so shells logging at the same moment rarely wait;
+// the setting is kept in the database file.
+var connParams = fmt.Sprintf("_busy_timeout=%d&_journal_mode=WAL", busyTimeout.Milliseconds())
+
+// Writes that still find the database busy are retried busyRetries times,
+// after busyBackoff and then twice as long each time
+const (
+	busyRetries = 4
+	busyBackoff = 50 * time.Millisecond
+)
+
+// IsBusy reports whether err comes from another connection or process
+// holding the database, so that trying again later may succeed
+func IsBusy(err error) bool {
+	return sqliteBusy(err) || errors.Is(err, berrors.ErrTimeout)
+}
+
+// retryBusy calls fn until it succeeds, fails with an error other than a
+// busy database, or runs out of retries
+func retryBusy(ctx context.Context, fn func() error) error {
+	delay := busyBackoff
+	for retry := 0; ; retry++ {
+		err := fn()
+		if err == nil || retry == busyRetries || !IsBusy(err) {
+			return err
+		}
+		// Jitter keeps writers that collided from colliding again
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay/2 + rand.N(delay)):
+		}
+		delay *= 2
+	}
+}
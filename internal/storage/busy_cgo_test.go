@@ -0,0 +1,128 @@
+//go:build cgo
+
+package storage
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// writerDBVar makes the test binary a writer process of
+// TestConcurrentWrites, logging to the database it names
+const writerDBVar = "CONSOLIDATE_TEST_WRITER_DB"
+
+const (
+	writerProcesses  = 4
+	writerGoroutines = 4
+	writerCommands   = 15
+)
+
+// logCommands logs writerCommands commands from each of writerGoroutines
+// goroutines, each opening the database for every command like the shell
+// hooks do
+func logCommands(path, writer string) error {
+	var wg sync.WaitGroup
+	errs := make(chan error, writerGoroutines)
+	for g := range writerGoroutines {
+		wg.Go(func() {
+			for i := range writerCommands {
+				s, err := Open(path)
+				if err != nil {
+					errs <- err
+					return
+				}
+				err = s.SaveEntry(Command{Command: fmt.Sprintf("echo %s %d %d", writer, g, i), SessionID: writer})
+				s.Close()
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		})
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	if path := os.Getenv(writerDBVar); path != "" {
+		if err := logCommands(path, strconv.Itoa(os.Getpid())); err != nil {
+			t.Fatalf("Logging failed: %v", err)
+		}
+		return
+	}
+
+	path := filepath.Join(t.TempDir(), "history.db")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer s.Close()
+
+	var processes []*exec.Cmd
+	for range writerProcesses {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestConcurrentWrites$")
+		cmd.Env = append(os.Environ(), writerDBVar+"="+path)
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("Starting writer failed: %v", err)
+		}
+		processes = append(processes, cmd)
+	}
+	if err := logCommands(path, "parent"); err != nil {
+		t.Errorf("Logging failed: %v", err)
+	}
+	for _, cmd := range processes {
+		if err := cmd.Wait(); err != nil {
+			t.Errorf("Writer process failed: %v", err)
+		}
+	}
+
+	expected := (writerProcesses + 1) * writerGoroutines * writerCommands
+	var count, uids int
+	s.db.QueryRow("SELECT COUNT(*), COUNT(DISTINCT uid) FROM commands").Scan(&count, &uids)
+	if count != expected || uids != expected {
+		t.Errorf("Expected %d commands with distinct UIDs, got %d with %d", expected, count, uids)
+	}
+	var mode string
+	s.db.QueryRow("PRAGMA journal_mode").Scan(&mode)
+	if mode != "wal" {
+		t.Errorf("Expected WAL journal mode, got %q", mode)
+	}
+}
+
+func TestConcurrentSavesOfOneUID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	const uids = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, writerGoroutines)
+	for range writerGoroutines {
+		s := openTestStore(t, path)
+		wg.Go(func() {
+			// Every goroutine saves the same commands, like drains racing
+			// over a spool
+			for i := range uids {
+				if err := s.SaveEntry(Command{Command: "make", UID: fmt.Sprintf("uid-%d", i)}); err != nil {
+					errs <- err
+					return
+				}
+			}
+		})
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		t.Fatalf("SaveEntry failed: %v", err)
+	}
+
+	var count int
+	openTestStore(t, path).db.QueryRow("SELECT COUNT(*) FROM commands").Scan(&count)
+	if count != uids {
+		t.Errorf("Expected %d commands, got %d", uids, count)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !cgo
+
+package storage
+
+// sqliteBusy reports whether err is SQLite's SQLITE_BUSY or SQLITE_LOCKED,
+// which builds without cgo, and so without SQLite, never return
+func sqliteBusy(err error) bool {
+	return false
+}
@@ -0,0 +1,39 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	berrors "go.etcd.io/bbolt/errors"
+)
+
+func TestRetryBusy(t *testing.T) {
+	busy := berrors.ErrTimeout
+	calls := 0
+	err := retryBusy(context.Background(), func() error {
+		calls++
+		if calls < 3 {
+			return fmt.Errorf("saving: %w", busy)
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("Expected success on the third call, got %v after %d", err, calls)
+	}
+
+	calls = 0
+	err = retryBusy(context.Background(), func() error {
+		calls++
+		return fmt.Errorf("no such table")
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("Expected other errors not to be retried, got %v after %d calls", err, calls)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := retryBusy(ctx, func() error { return busy }); err != context.Canceled {
+		t.Errorf("Expected the canceled context to stop retrying, got %v", err)
+	}
+}
@@ -0,0 +1,471 @@
+package storage
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// connector opens connections to the database of a store, with
+// consolidate's SQL functions registered on every connection
+type connector struct {
+	dsn    string
+	driver *sqlite3.SQLiteDriver
+}
+
+func newConnector(s *Store, dsn string) *connector {
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+	return &connector{dsn: dsn + sep + connParams, driver: &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			// decrypt() uses the keys of the store the connection belongs to
+			return conn.RegisterFunc("decrypt", s.decryptValue, true)
+		},
+	}}
+}
+
+func (c *connector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c *connector) Driver() driver.Driver {
+	return c.driver
+}
+
+// Key derivation functions of an encrypted database
+const (
+	// KDFArgon2id derives the key from a passphrase
+	KDFArgon2id = "argon2id"
+	// KDFKeyFile uses a random 32-byte key read from a file
+	KDFKeyFile = "keyfile"
+)
+
+// KeySize is the length of the key in a key file
+const KeySize = 32
+
+// checkText is sealed with the key when a database is encrypted, so a
+// wrong key is recognised before anything is read or written
+const checkText = "consolidate"
+
+// encryptionVersion prefixes every sealed value, leaving room to change the
+// format later
+const encryptionVersion = 1
+
+// EncryptionSettings describes how the key of an encrypted database is
+// derived. It is stored in the database itself; none of it is secret.
+type EncryptionSettings struct {
+	KDF     string `json:"kdf"`
+	Salt    []byte `json:"salt,omitempty"`
+	Time    uint32 `json:"time,omitempty"`
+	Memory  uint32 `json:"memory,omitempty"` // KiB
+	Threads uint8  `json:"threads,omitempty"`
+	Check   []byte `json:"check"`
+}
+
+// keys are derived from the secret of an encrypted database
+type keys struct {
+	// aead encrypts column values with XChaCha20-Poly1305
+	aead cipher.AEAD
+	// index keys the hashes that stand in for the normalized command text,
+	// so identical commands can still be grouped
+	index []byte
+}
+
+// Encryption returns the encryption settings of the database, or nil if it
+// is not encrypted
+func (s *Store) Encryption() *EncryptionSettings {
+	s.keysMu.RLock()
+	defer s.keysMu.RUnlock()
+	return s.encryption
+}
+
+// loadEncryption reads the encryption settings of a newly opened database
+func (s *Store) loadEncryption() error {
+	var value string
+	err := s.db.QueryRow("SELECT value FROM settings WHERE name = 'encryption'").Scan(&value)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("reading encryption settings: %w", err)
+	}
+
+	var settings *EncryptionSettings
+	if err == nil {
+		settings = &EncryptionSettings{}
+		if err := json.Unmarshal([]byte(value), settings); err != nil {
+			return fmt.Errorf("decoding encryption settings: %w", err)
+		}
+	}
+
+	s.keysMu.Lock()
+	defer s.keysMu.Unlock()
+	s.encryption = settings
+	return nil
+}
+
+// CacheID identifies the passphrase settings in a KeyCache. It changes
+// whenever a database is encrypted anew.
+func (settings *EncryptionSettings) CacheID() string {
+	sum := sha256.Sum256(settings.Salt)
+	return hex.EncodeToString(sum[:16])
+}
+
+// KeyCache keeps the master keys derived from passphrases, by CacheID, so
+// that opening a database again skips the deliberately slow derivation
+type KeyCache interface {
+	// Key returns the cached key, or nil
+	Key(id string) []byte
+	SetKey(id string, key []byte)
+}
+
+// Unlock derives the keys of an encrypted database from its secret: the
+// passphrase, or the key file's key. It fails if the secret is wrong.
+func (s *Store) Unlock(secret []byte) error {
+	settings := s.Encryption()
+	if settings == nil {
+		return fmt.Errorf("database is not encrypted")
+	}
+	master, err := DeriveKey(settings, secret)
+	if err != nil {
+		return err
+	}
+	return s.UnlockKey(master)
+}
+
+// UnlockKey unlocks an encrypted database with its master key, as returned
+// by DeriveKey. It fails if the key is wrong.
+func (s *Store) UnlockKey(master []byte) error {
+	settings := s.Encryption()
+	if settings == nil {
+		return fmt.Errorf("database is not encrypted")
+	}
+	k, err := keysFromMaster(master)
+	if err != nil {
+		return err
+	}
+	if check, err := k.open(settings.Check); err != nil || check != checkText {
+		return fmt.Errorf("wrong passphrase or key")
+	}
+
+	s.keysMu.Lock()
+	defer s.keysMu.Unlock()
+	s.unlocked = k
+	return nil
+}
+
+// UnlockWith unlocks an encrypted database with a key from cache, which may
+// be nil, or else with the secret returned by secret, caching the key
+// derived from a passphrase
+func (s *Store) UnlockWith(secret func(kdf string) ([]byte, error), cache KeyCache) error {
+	settings := s.Encryption()
+	if settings == nil {
+		return fmt.Errorf("database is not encrypted")
+	}
+	if settings.KDF != KDFArgon2id {
+		cache = nil
+	}
+	if cache != nil {
+		if master := cache.Key(settings.CacheID()); master != nil && s.UnlockKey(master) == nil {
+			return nil
+		}
+	}
+
+	if secret == nil {
+		return fmt.Errorf("the database is encrypted and no secret was given")
+	}
+	value, err := secret(settings.KDF)
+	if err != nil {
+		return err
+	}
+	master, err := DeriveKey(settings, value)
+	if err == nil {
+		err = s.UnlockKey(master)
+	}
+	if err != nil {
+		return fmt.Errorf("unlocking database: %w", err)
+	}
+	if cache != nil {
+		cache.SetKey(settings.CacheID(), master)
+	}
+	return nil
+}
+
+// DeriveKey turns the secret of an encrypted database into its master key:
+// the passphrase through Argon2id, or the key file's key as it is
+func DeriveKey(settings *EncryptionSettings, secret []byte) ([]byte, error) {
+	switch settings.KDF {
+	case KDFArgon2id:
+		if len(secret) == 0 {
+			return nil, fmt.Errorf("passphrase cannot be empty")
+		}
+		return argon2.IDKey(secret, settings.Salt, settings.Time, settings.Memory, settings.Threads, KeySize), nil
+	case KDFKeyFile:
+		if len(secret) != KeySize {
+			return nil, fmt.Errorf("key must be %d bytes, got %d", KeySize, len(secret))
+		}
+		return secret, nil
+	default:
+		return nil, fmt.Errorf("unknown key derivation %q", settings.KDF)
+	}
+}
+
+// deriveKeys turns the secret into the encryption and index keys
+func deriveKeys(settings *EncryptionSettings, secret []byte) (*keys, error) {
+	master, err := DeriveKey(settings, secret)
+	if err != nil {
+		return nil, err
+	}
+	return keysFromMaster(master)
+}
+
+// keysFromMaster expands the master key into the encryption and index keys
+func keysFromMaster(master []byte) (*keys, error) {
+	if len(master) != KeySize {
+		return nil, fmt.Errorf("key must be %d bytes, got %d", KeySize, len(master))
+	}
+	encKey, err := hkdf.Key(sha256.New, master, nil, "consolidate encryption", chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	indexKey, err := hkdf.Key(sha256.New, master, nil, "consolidate index", sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(encKey)
+	if err != nil {
+		return nil, err
+	}
+	return &keys{aead: aead, index: indexKey}, nil
+}
+
+// seal encrypts s into a version byte, a random nonce and the ciphertext
+func (k *keys) seal(s string) []byte {
+	out := make([]byte, 1+k.aead.NonceSize(), 1+k.aead.NonceSize()+len(s)+k.aead.Overhead())
+	out[0] = encryptionVersion
+	rand.Read(out[1:])
+	return k.aead.Seal(out, out[1:], []byte(s), nil)
+}
+
+// open decrypts a value made by seal
+func (k *keys) open(sealed []byte) (string, error) {
+	nonceSize := k.aead.NonceSize()
+	if len(sealed) < 1+nonceSize || sealed[0] != encryptionVersion {
+		return "", fmt.Errorf("unrecognised encrypted value")
+	}
+	plain, err := k.aead.Open(nil, sealed[1:1+nonceSize], sealed[1+nonceSize:], nil)
+	if err != nil {
+		return "", fmt.Errorf("decrypting value: %w", err)
+	}
+	return string(plain), nil
+}
+
+// token returns the keyed hash stored in place of the normalized text
+func (k *keys) token(normalized string) string {
+	mac := hmac.New(sha256.New, k.index)
+	mac.Write([]byte(normalized))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// writeKeys returns the keys to encrypt new values with, nil when the
+// database is not encrypted. Writing to a locked encrypted database fails
+// rather than storing plaintext.
+func (s *Store) writeKeys() (*keys, error) {
+	s.keysMu.RLock()
+	defer s.keysMu.RUnlock()
+	if s.encryption == nil {
+		return nil, nil
+	}
+	if s.unlocked == nil {
+		return nil, fmt.Errorf("database is encrypted and locked")
+	}
+	return s.unlocked, nil
+}
+
+// sealText encrypts a column value when the database is encrypted. Empty
+// values are stored as they are.
+func sealText(k *keys, s string) interface{} {
+	if k == nil || s == "" {
+		return s
+	}
+	return k.seal(s)
+}
+
+// normalizedValue returns what is stored in the normalized column: the
+// normalized text, or its keyed hash in an encrypted database
+func normalizedValue(k *keys, command string) string {
+	if k == nil {
+		return normalizeCommand(command)
+	}
+	return k.token(normalizeCommand(command))
+}
+
+// decryptValue implements the decrypt() SQL function. Encrypted values are
+// blobs; text, numbers and NULL are passed through, so the same queries
+// work on plain and encrypted databases.
+func (s *Store) decryptValue(v interface{}) (interface{}, error) {
+	sealed, ok := v.([]byte)
+	if !ok {
+		return v, nil
+	}
+	// The driver passes NULL as a nil blob
+	if sealed == nil {
+		return nil, nil
+	}
+
+	s.keysMu.RLock()
+	k := s.unlocked
+	s.keysMu.RUnlock()
+	if k == nil {
+		return nil, fmt.Errorf("database is encrypted and locked")
+	}
+	return k.open(sealed)
+}
+
+// NewEncryptionSettings prepares the settings for encrypting a database
+// with the given key derivation, choosing a fresh salt
+func NewEncryptionSettings(kdf string) (*EncryptionSettings, error) {
+	settings := &EncryptionSettings{KDF: kdf}
+	switch kdf {
+	case KDFArgon2id:
+		// The second recommended option of RFC 9106
+		settings.Salt = make([]byte, 16)
+		rand.Read(settings.Salt)
+		settings.Time = 3
+		settings.Memory = 64 * 1024
+		settings.Threads = 4
+	case KDFKeyFile:
+	default:
+		return nil, fmt.Errorf("unknown key derivation %q", kdf)
+	}
+	return settings, nil
+}
+
+// EncryptDatabase encrypts the command text, working directory, metadata,
+// environment variables, git root and remote, notes and snippets of a plain
+// database in place, and leaves it unlocked.
+// The database is vacuumed afterwards so the plaintext does not linger in
+// free pages.
+func (s *Store) EncryptDatabase(settings *EncryptionSettings, secret []byte) error {
+	if s == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	if s.Encryption() != nil {
+		return fmt.Errorf("database is already encrypted")
+	}
+
+	k, err := deriveKeys(settings, secret)
+	if err != nil {
+		return err
+	}
+	settings.Check = k.seal(checkText)
+	value, err := json.Marshal(settings)
+	if err != nil {
+		return fmt.Errorf("encoding encryption settings: %w", err)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("INSERT INTO settings (name, value) VALUES ('encryption', ?)", string(value)); err != nil {
+		return fmt.Errorf("saving encryption settings: %w", err)
+	}
+	if err := encryptRows(tx,
+		`SELECT id, command, COALESCE(cwd, ''), COALESCE(metadata, ''), COALESCE(env, ''), COALESCE(git_root, ''),
+			COALESCE(git_remote, '') FROM commands`,
+		func(id interface{}, values []string) (string, []interface{}) {
+			return `UPDATE commands SET command = ?, cwd = ?, metadata = ?, env = ?, git_root = ?, git_remote = ?,
+				normalized = ? WHERE id = ?`,
+				[]interface{}{sealText(k, values[0]), sealText(k, values[1]), sealText(k, values[2]),
+					sealText(k, values[3]), sealText(k, values[4]), sealText(k, values[5]),
+					normalizedValue(k, values[0]), id}
+		}); err != nil {
+		return fmt.Errorf("encrypting commands: %w", err)
+	}
+	if err := encryptRows(tx, "SELECT command_id, note FROM notes",
+		func(id interface{}, values []string) (string, []interface{}) {
+			return "UPDATE notes SET note = ? WHERE command_id = ?", []interface{}{sealText(k, values[0]), id}
+		}); err != nil {
+		return fmt.Errorf("encrypting notes: %w", err)
+	}
+	if err := encryptRows(tx, "SELECT name, command, COALESCE(description, '') FROM snippets",
+		func(name interface{}, values []string) (string, []interface{}) {
+			return "UPDATE snippets SET command = ?, description = ? WHERE name = ?",
+				[]interface{}{sealText(k, values[0]), sealText(k, values[1]), name}
+		}); err != nil {
+		return fmt.Errorf("encrypting snippets: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	s.keysMu.Lock()
+	s.encryption = settings
+	s.unlocked = k
+	s.keysMu.Unlock()
+
+	if _, err := s.db.Exec("VACUUM"); err != nil {
+		return fmt.Errorf("vacuuming database: %w", err)
+	}
+	return nil
+}
+
+// encryptRows reads every row selected by query, a key followed by text
+// columns, and runs the update that update builds for it
+func encryptRows(tx *sql.Tx, query string, update func(key interface{}, values []string) (string, []interface{})) error {
+	rows, err := tx.Query(query)
+	if err != nil {
+		return err
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		rows.Close()
+		return err
+	}
+
+	type row struct {
+		key    interface{}
+		values []string
+	}
+	var all []row
+	for rows.Next() {
+		r := row{values: make([]string, len(columns)-1)}
+		dest := []interface{}{&r.key}
+		for i := range r.values {
+			dest = append(dest, &r.values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			rows.Close()
+			return err
+		}
+		all = append(all, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, r := range all {
+		query, args := update(r.key, r.values)
+		if _, err := tx.Exec(query, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
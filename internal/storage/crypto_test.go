@@ -0,0 +1,191 @@
+//go:build cgo
+
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncryptDatabase(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "history.db")
+	s := openTestStore(t, dbPath)
+
+	if err := s.SaveEntry(Command{Command: "curl -H 'token: hunter2' https://api", SessionID: "s", CWD: "/srv/secret-project",
+		Metadata: `{"job":"42"}`, Env: map[string]string{"AWS_PROFILE": "prod-admin"}, GitRoot: "/srv/secret-project",
+		GitRemote: "https://example.com/secret-project.git"}); err != nil {
+		t.Fatalf("SaveEntry failed: %v", err)
+	}
+	if err := s.SaveCommand("curl   -H 'token: hunter2'   https://api", "s", "/srv/secret-project", 0, ""); err != nil {
+		t.Fatalf("SaveCommand failed: %v", err)
+	}
+	if err := s.SetNote(1, "rotate hunter2"); err != nil {
+		t.Fatalf("SetNote failed: %v", err)
+	}
+	if err := s.SaveSnippet(Snippet{Name: "api", Command: "curl -H 'token: {{token}}' https://api"}, false); err != nil {
+		t.Fatalf("SaveSnippet failed: %v", err)
+	}
+
+	settings, err := NewEncryptionSettings(KDFArgon2id)
+	if err != nil {
+		t.Fatalf("NewEncryptionSettings failed: %v", err)
+	}
+	// Keep the test fast
+	settings.Time, settings.Memory, settings.Threads = 1, 64, 1
+	passphrase := []byte("correct horse")
+	if err := s.EncryptDatabase(settings, passphrase); err != nil {
+		t.Fatalf("EncryptDatabase failed: %v", err)
+	}
+	if err := s.EncryptDatabase(settings, passphrase); err == nil {
+		t.Error("Expected an error encrypting twice")
+	}
+	if err := s.SaveEntry(Command{Command: "echo hunter2", SessionID: "s", CWD: "/srv/secret-project",
+		Env: map[string]string{"AWS_PROFILE": "prod-admin"}, GitRoot: "/srv/secret-project"}); err != nil {
+		t.Fatalf("SaveEntry after encrypting failed: %v", err)
+	}
+
+	var plain int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM commands WHERE typeof(command) != 'blob' OR typeof(cwd) != 'blob'`).Scan(&plain); err != nil {
+		t.Fatalf("Counting plaintext rows failed: %v", err)
+	}
+	if plain != 0 {
+		t.Errorf("Expected every command and cwd to be encrypted, %d are not", plain)
+	}
+
+	// Reopening leaves the database locked
+	s.Close()
+	s = openTestStore(t, dbPath)
+	if s.Encryption() == nil {
+		t.Fatal("Expected the database to be encrypted")
+	}
+	if _, err := s.QueryCommands(Filter{Limit: 10}); err == nil {
+		t.Error("Expected reading a locked database to fail")
+	}
+	if err := s.SaveCommand("ls", "s", "/", 0, ""); err == nil {
+		t.Error("Expected writing to a locked database to fail")
+	}
+	if err := s.Unlock([]byte("wrong")); err == nil {
+		t.Error("Expected a wrong passphrase to fail")
+	}
+	if err := s.Unlock(passphrase); err != nil {
+		t.Fatalf("Unlock failed: %v", err)
+	}
+
+	results, err := s.QueryCommands(Filter{Query: "hunter2", Limit: 10, Dir: "/srv/secret-project"})
+	if err != nil {
+		t.Fatalf("QueryCommands failed: %v", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("Expected 3 results, got %d", len(results))
+	}
+	if results[2].Command != "curl -H 'token: hunter2' https://api" || results[2].Note != "rotate hunter2" || results[2].Metadata != `{"job":"42"}` {
+		t.Errorf("Unexpected decrypted command: %+v", results[2])
+	}
+	if results[2].Env["AWS_PROFILE"] != "prod-admin" || results[2].GitRemote != "https://example.com/secret-project.git" {
+		t.Errorf("Expected the environment and git remote decrypted, got %+v", results[2])
+	}
+	results, err = s.QueryCommands(Filter{Limit: 10, Repo: "/srv/secret-project"})
+	if err != nil || len(results) != 2 {
+		t.Errorf("Expected the repository filter to match 2 commands, got %d (%v)", len(results), err)
+	}
+	results, err = s.QueryCommands(Filter{Limit: 10, Meta: map[string]string{"job": "42"}})
+	if err != nil || len(results) != 1 {
+		t.Errorf("Expected the metadata filter to match 1 command, got %d (%v)", len(results), err)
+	}
+
+	// Repeats are still grouped through the keyed hash
+	summaries, err := s.UniqueCommands(Filter{Query: "curl", Limit: 10})
+	if err != nil {
+		t.Fatalf("UniqueCommands failed: %v", err)
+	}
+	if len(summaries) != 1 || summaries[0].Count != 2 {
+		t.Errorf("Expected one group of 2, got %v", summaries)
+	}
+
+	snippet, err := s.GetSnippet("api")
+	if err != nil || snippet.Command != "curl -H 'token: {{token}}' https://api" {
+		t.Errorf("Unexpected snippet %+v (%v)", snippet, err)
+	}
+
+	s.db.Close()
+	data, err := os.ReadFile(dbPath)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	for _, secret := range []string{"hunter2", "secret-project", `"job"`, "prod-admin"} {
+		if bytes.Contains(data, []byte(secret)) {
+			t.Errorf("Database file still contains %q", secret)
+		}
+	}
+}
+
+func TestEncryptDatabaseKeyFile(t *testing.T) {
+	s := openTestStore(t, ":memory:")
+
+	settings, err := NewEncryptionSettings(KDFKeyFile)
+	if err != nil {
+		t.Fatalf("NewEncryptionSettings failed: %v", err)
+	}
+	if err := s.EncryptDatabase(settings, []byte("too short")); err == nil {
+		t.Error("Expected an error for a short key")
+	}
+	if err := s.EncryptDatabase(settings, bytes.Repeat([]byte{7}, KeySize)); err != nil {
+		t.Fatalf("EncryptDatabase failed: %v", err)
+	}
+	if err := s.SaveCommand("ls", "s", "/", 0, ""); err != nil {
+		t.Fatalf("SaveCommand failed: %v", err)
+	}
+	if err := s.Unlock(bytes.Repeat([]byte{8}, KeySize)); err == nil {
+		t.Error("Expected a wrong key to fail")
+	}
+	results, err := s.SearchCommands("ls", 10)
+	if err != nil || len(results) != 1 {
+		t.Errorf("Expected 1 result, got %d (%v)", len(results), err)
+	}
+}
+
+func TestStoresAreIndependent(t *testing.T) {
+	dir := t.TempDir()
+	plain, err := Open(filepath.Join(dir, "plain.db"))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer plain.Close()
+	encrypted, err := Open(filepath.Join(dir, "encrypted.db"))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer encrypted.Close()
+
+	settings, err := NewEncryptionSettings(KDFKeyFile)
+	if err != nil {
+		t.Fatalf("NewEncryptionSettings failed: %v", err)
+	}
+	if err := encrypted.EncryptDatabase(settings, bytes.Repeat([]byte{7}, KeySize)); err != nil {
+		t.Fatalf("EncryptDatabase failed: %v", err)
+	}
+	if plain.Encryption() != nil {
+		t.Error("Encrypting one store changed the other")
+	}
+
+	if err := plain.SaveCommand("make", "1", "/src", 0, ""); err != nil {
+		t.Fatalf("SaveCommand failed: %v", err)
+	}
+	if err := encrypted.SaveCommand("make deploy", "1", "/srv", 0, ""); err != nil {
+		t.Fatalf("SaveCommand failed: %v", err)
+	}
+	for store, expected := range map[*Store]string{plain: "make", encrypted: "make deploy"} {
+		commands, err := store.QueryCommands(Filter{Limit: 10})
+		if err != nil {
+			t.Fatalf("QueryCommands failed: %v", err)
+		}
+		if len(commands) != 1 || commands[0].Command != expected {
+			t.Errorf("Expected only %q, got %v", expected, commands)
+		}
+	}
+	if plain.Origin() == encrypted.Origin() {
+		t.Error("Expected each database to have its own origin")
+	}
+}
@@ -1,26 +1,62 @@
 package storage
 
 import (
+	"context"
+	"crypto/ed25519"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"maps"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/khelechy/consolidate/internal/ulid"
 )
 
-var db *sql.DB
+// Store is an open history database
+type Store struct {
+	db *sql.DB
+	// origin identifies the database in synced histories. It is created the
+	// first time the database is opened.
+	origin string
 
-// InitDB initializes the SQLite database and creates the necessary tables
-func InitDB(dbPath string) error {
-	if db != nil {
-		db.Close()
-	}
-	var err error
-	db, err = sql.Open("sqlite3", dbPath)
-	if err != nil {
-		return fmt.Errorf("failed to open database: %w", err)
+	keysMu sync.RWMutex
+	// encryption is the settings of the database, nil when it is not
+	// encrypted
+	encryption *EncryptionSettings
+	// unlocked holds the keys once Unlock succeeds
+	unlocked *keys
+
+	// audit is the audit settings of the database, nil when audit mode is
+	// off
+	audit *AuditSettings
+	// auditSigner signs new entries and tombstones, if a key is available
+	auditSigner ed25519.PrivateKey
+}
+
+// Open opens the SQLite database at dbPath, creating the necessary tables
+// and migrating it from older versions
+func Open(dbPath string) (*Store, error) {
+	s := &Store{}
+	s.db = sql.OpenDB(newConnector(s, dbPath))
+	// Shells opening a new database together race to create its tables
+	if err := retryBusy(context.Background(), s.init); err != nil {
+		s.db.Close()
+		return nil, err
 	}
+	return s, nil
+}
+
+// Close closes the database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// init creates the tables and loads the settings of a newly opened database
+func (s *Store) init() error {
 
 	// Create table for command history
 	createTableSQL := `
@@ -33,26 +69,335 @@ func InitDB(dbPath string) error {
 		exit_code INTEGER,
 		metadata TEXT
 	);
+
+	CREATE TABLE IF NOT EXISTS tags (
+		command_id INTEGER NOT NULL REFERENCES commands(id) ON DELETE CASCADE,
+		tag TEXT NOT NULL,
+		PRIMARY KEY (command_id, tag)
+	);
+	CREATE INDEX IF NOT EXISTS idx_tags_tag ON tags(tag);
+
+	CREATE TABLE IF NOT EXISTS notes (
+		command_id INTEGER PRIMARY KEY REFERENCES commands(id) ON DELETE CASCADE,
+		note TEXT NOT NULL,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS settings (
+		name TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS audit_tombstones (
+		seq INTEGER PRIMARY KEY,
+		command_id INTEGER NOT NULL,
+		prev_hash TEXT NOT NULL,
+		digest TEXT NOT NULL,
+		hash TEXT NOT NULL,
+		signature TEXT,
+		deleted_at TEXT NOT NULL,
+		tombstone_signature TEXT
+	);
+
+	CREATE TABLE IF NOT EXISTS sync_tombstones (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		uid TEXT NOT NULL UNIQUE,
+		origin TEXT NOT NULL,
+		deleted_at TEXT NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS sync_peers (
+		peer TEXT PRIMARY KEY,
+		address TEXT,
+		pulled_commands INTEGER NOT NULL DEFAULT 0,
+		pulled_tombstones INTEGER NOT NULL DEFAULT 0,
+		pushed_commands INTEGER NOT NULL DEFAULT 0,
+		pushed_tombstones INTEGER NOT NULL DEFAULT 0,
+		synced_at TEXT
+	);
+
+	CREATE TABLE IF NOT EXISTS sync_segments (
+		dir TEXT NOT NULL,
+		host TEXT NOT NULL,
+		segment INTEGER NOT NULL,
+		PRIMARY KEY (dir, host)
+	);
+
+	CREATE TABLE IF NOT EXISTS snippets (
+		name TEXT PRIMARY KEY,
+		command TEXT NOT NULL,
+		description TEXT,
+		source_id INTEGER,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
 	`
 
-	_, err = db.Exec(createTableSQL)
+	_, err := s.db.Exec(createTableSQL)
 	if err != nil {
 		return fmt.Errorf("failed to create tables: %w", err)
 	}
 
+	if err := s.loadOrigin(); err != nil {
+		return err
+	}
+	if err := s.migrate(); err != nil {
+		return fmt.Errorf("failed to migrate database: %w", err)
+	}
+
+	if err := s.loadEncryption(); err != nil {
+		return err
+	}
+	if err := s.loadAudit(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// addedColumns lists the columns introduced after the initial schema, in the
+// order they were added. Databases created by older versions get them on open.
+var addedColumns = []struct {
+	name       string
+	definition string
+}{
+	{"duration_ms", "INTEGER"},
+	{"error_type", "TEXT"},
+	{"pipestatus", "TEXT"},
+	{"hostname", "TEXT"},
+	{"username", "TEXT"},
+	{"shell", "TEXT"},
+	{"shell_version", "TEXT"},
+	{"tty", "TEXT"},
+	{"env", "TEXT"},
+	{"git_root", "TEXT"},
+	{"git_remote", "TEXT"},
+	{"git_branch", "TEXT"},
+	{"git_commit", "TEXT"},
+	{"normalized", "TEXT"},
+	{"audit_seq", "INTEGER"},
+	{"audit_prev", "TEXT"},
+	{"audit_digest", "TEXT"},
+	{"audit_hash", "TEXT"},
+	{"audit_sig", "TEXT"},
+	{"uid", "TEXT"},
+	{"origin", "TEXT"},
+}
+
+// migrate adds any missing columns to the commands table
+func (s *Store) migrate() error {
+	rows, err := s.db.Query("PRAGMA table_info(commands)")
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var (
+			cid        int
+			name, typ  string
+			notNull    int
+			defaultVal sql.NullString
+			pk         int
+		)
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &defaultVal, &pk); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, col := range addedColumns {
+		if existing[col.name] {
+			continue
+		}
+		if _, err := s.db.Exec(fmt.Sprintf("ALTER TABLE commands ADD COLUMN %s %s", col.name, col.definition)); err != nil {
+			return fmt.Errorf("adding column %s: %w", col.name, err)
+		}
+	}
+
+	// Rows written before the normalized column existed need it filled in
+	if !existing["normalized"] {
+		if err := s.backfillNormalized(); err != nil {
+			return fmt.Errorf("normalizing commands: %w", err)
+		}
+	}
+
+	if _, err := s.db.Exec("CREATE INDEX IF NOT EXISTS idx_commands_normalized ON commands(normalized)"); err != nil {
+		return fmt.Errorf("creating index: %w", err)
+	}
+	if _, err := s.db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_commands_audit_seq ON commands(audit_seq)"); err != nil {
+		return fmt.Errorf("creating index: %w", err)
+	}
+	if _, err := s.db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_commands_uid ON commands(uid)"); err != nil {
+		return fmt.Errorf("creating index: %w", err)
+	}
+
+	// Rows written before sync existed need a unique ID; they are taken to
+	// come from this database
+	if err := s.backfillUIDs(); err != nil {
+		return fmt.Errorf("assigning command IDs: %w", err)
+	}
 	return nil
 }
 
+// backfillNormalized sets the normalized text of rows that lack it
+func (s *Store) backfillNormalized() error {
+	rows, err := s.db.Query("SELECT id, command FROM commands WHERE normalized IS NULL")
+	if err != nil {
+		return err
+	}
+	normalized := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var command string
+		if err := rows.Scan(&id, &command); err != nil {
+			rows.Close()
+			return err
+		}
+		normalized[id] = normalizeCommand(command)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for id, text := range normalized {
+		if _, err := tx.Exec("UPDATE commands SET normalized = ? WHERE id = ?", text, id); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// normalizeCommand returns the text used to recognise repeats of a command:
+// surrounding whitespace is dropped and inner runs of whitespace collapse to
+// a single space
+func normalizeCommand(command string) string {
+	return strings.Join(strings.Fields(command), " ")
+}
+
+// commandColumns is the select list matching scanCommand. Columns added by
+// migrations are NULL on older rows, so they are coalesced to zero values.
+// Columns that may be encrypted go through decrypt().
+const commandColumns = `id, timestamp, decrypt(command), COALESCE(session_id, ''), COALESCE(decrypt(cwd), ''),
+		COALESCE(exit_code, 0), COALESCE(decrypt(metadata), ''), COALESCE(duration_ms, 0), COALESCE(error_type, ''),
+		COALESCE(pipestatus, ''), COALESCE(hostname, ''), COALESCE(username, ''), COALESCE(shell, ''),
+		COALESCE(shell_version, ''), COALESCE(tty, ''), COALESCE(decrypt(env), ''), COALESCE(decrypt(git_root), ''),
+		COALESCE(decrypt(git_remote), ''), COALESCE(git_branch, ''), COALESCE(git_commit, ''),
+		COALESCE(uid, ''), COALESCE(origin, ''),
+		COALESCE((SELECT group_concat(tag, ' ') FROM tags WHERE command_id = commands.id), ''),
+		COALESCE((SELECT decrypt(note) FROM notes WHERE command_id = commands.id), '')`
+
+// scanCommand scans a row selected with commandColumns, followed by any
+// extra columns into extra
+func scanCommand(rows *sql.Rows, extra ...any) (Command, error) {
+	var cmd Command
+	var pipeStatus, env, tags string
+	dest := []any{&cmd.ID, &cmd.Timestamp, &cmd.Command, &cmd.SessionID, &cmd.CWD, &cmd.ExitCode, &cmd.Metadata,
+		&cmd.DurationMs, &cmd.ErrorType, &pipeStatus, &cmd.Hostname, &cmd.Username, &cmd.Shell, &cmd.ShellVersion,
+		&cmd.TTY, &env, &cmd.GitRoot, &cmd.GitRemote, &cmd.GitBranch, &cmd.GitCommit,
+		&cmd.UID, &cmd.Origin, &tags, &cmd.Note}
+	err := rows.Scan(append(dest, extra...)...)
+	if err != nil {
+		return cmd, err
+	}
+	if cmd.PipeStatus, err = ParsePipeStatus(pipeStatus); err != nil {
+		return cmd, fmt.Errorf("decoding pipestatus of command %d: %w", cmd.ID, err)
+	}
+	if tags != "" {
+		cmd.Tags = strings.Fields(tags)
+		slices.Sort(cmd.Tags)
+	}
+	if env != "" {
+		if err := json.Unmarshal([]byte(env), &cmd.Env); err != nil {
+			return cmd, fmt.Errorf("decoding env of command %d: %w", cmd.ID, err)
+		}
+	}
+	return cmd, nil
+}
+
+// ParsePipeStatus parses space separated pipeline exit statuses, as the
+// shell hooks pass them to log
+func ParsePipeStatus(s string) ([]int, error) {
+	var statuses []int
+	for _, field := range strings.Fields(s) {
+		status, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exit status %q", field)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// formatPipeStatus is the inverse of ParsePipeStatus
+func formatPipeStatus(statuses []int) string {
+	fields := make([]string, len(statuses))
+	for i, status := range statuses {
+		fields[i] = strconv.Itoa(status)
+	}
+	return strings.Join(fields, " ")
+}
+
 // SaveCommand saves a command to the database
-func SaveCommand(command, sessionID, cwd string, exitCode int, metadata string) error {
-	if db == nil {
+func (s *Store) SaveCommand(command, sessionID, cwd string, exitCode int, metadata string) error {
+	return s.SaveEntry(Command{
+		Command:   command,
+		SessionID: sessionID,
+		CWD:       cwd,
+		ExitCode:  exitCode,
+		Metadata:  metadata,
+	})
+}
+
+// SaveEntry saves a command together with its execution details. ID and
+// Origin are assigned here, and UID and Timestamp too unless they are set.
+// A command whose UID is already saved is skipped, so saving it again does
+// not duplicate it. Writes that find the database busy are retried with
+// backoff.
+func (s *Store) SaveEntry(entry Command) error {
+	return s.SaveEntryContext(context.Background(), entry)
+}
+
+// SaveEntryContext is SaveEntry with a context
+func (s *Store) SaveEntryContext(ctx context.Context, entry Command) error {
+	if s == nil {
 		return fmt.Errorf("database not initialized")
 	}
 
-	_, err := db.Exec(
-		"INSERT INTO commands (command, session_id, cwd, exit_code, metadata) VALUES (?, ?, ?, ?, ?)",
-		command, sessionID, cwd, exitCode, metadata,
-	)
+	k, err := s.writeKeys()
+	if err != nil {
+		return err
+	}
+
+	if entry.UID == "" {
+		entry.UID = ulid.New(time.Now())
+	}
+	entry.Origin = s.origin
+	// The UID is checked and the row written in one transaction, so that
+	// two processes saving the same command cannot both insert it; in audit
+	// mode its place in the chain is written with it
+	err = retryBusy(ctx, func() error {
+		return s.withImmediateTx(ctx, func(q querier) error {
+			if saved, err := uidSaved(ctx, q, entry.UID); saved || err != nil {
+				return err
+			}
+			id, err := insertCommand(ctx, q, k, entry)
+			if err != nil || s.audit == nil {
+				return err
+			}
+			return s.appendToChain(q, int(id))
+		})
+	})
 	if err != nil {
 		return fmt.Errorf("failed to save command: %w", err)
 	}
@@ -60,19 +405,247 @@ func SaveCommand(command, sessionID, cwd string, exitCode int, metadata string)
 	return nil
 }
 
+// uidSaved reports whether a command with the UID is in the database
+func uidSaved(ctx context.Context, q querier, uid string) (bool, error) {
+	var n int
+	if err := q.QueryRowContext(ctx, "SELECT COUNT(*) FROM commands WHERE uid = ?", uid).Scan(&n); err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// insertCommand inserts a row for the entry, sealing its text with k if the
+// database is encrypted, and returns its ID. An empty Timestamp means now.
+func insertCommand(ctx context.Context, q querier, k *keys, entry Command) (int64, error) {
+	var env string
+	if len(entry.Env) > 0 {
+		data, err := json.Marshal(entry.Env)
+		if err != nil {
+			return 0, fmt.Errorf("encoding env: %w", err)
+		}
+		env = string(data)
+	}
+
+	// Timestamps are read back in RFC 3339 but stored the way SQLite's
+	// CURRENT_TIMESTAMP writes them, so they compare alike
+	var timestamp interface{}
+	if entry.Timestamp != "" {
+		timestamp = entry.Timestamp
+		if t, err := time.Parse(time.RFC3339Nano, entry.Timestamp); err == nil {
+			timestamp = t.UTC().Format(time.DateTime)
+		}
+	}
+
+	result, err := q.ExecContext(ctx,
+		`INSERT INTO commands (timestamp, command, session_id, cwd, exit_code, metadata, duration_ms, error_type, pipestatus,
+			hostname, username, shell, shell_version, tty, env, git_root, git_remote, git_branch, git_commit, normalized,
+			uid, origin)
+		VALUES (COALESCE(?, CURRENT_TIMESTAMP), ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		timestamp, sealText(k, entry.Command), entry.SessionID, sealText(k, entry.CWD), entry.ExitCode,
+		sealText(k, entry.Metadata), entry.DurationMs, entry.ErrorType,
+		formatPipeStatus(entry.PipeStatus), entry.Hostname, entry.Username, entry.Shell, entry.ShellVersion,
+		entry.TTY, sealText(k, env), sealText(k, entry.GitRoot), sealText(k, entry.GitRemote), entry.GitBranch, entry.GitCommit,
+		normalizedValue(k, entry.Command), entry.UID, entry.Origin,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// Filter selects the commands returned by QueryCommands
+type Filter struct {
+	// Query matches commands containing this text; empty matches everything
+	Query string
+	// Limit is the maximum number of commands returned
+	Limit int
+	// Offset skips this many matching commands before the first one returned
+	Offset int
+	// Failed keeps only commands with a non-zero exit code in any pipeline stage
+	Failed bool
+	// Session keeps only commands logged by this shell session
+	Session string
+	// Host keeps only commands run on this hostname
+	Host string
+	// User keeps only commands run by this user
+	User string
+	// Repo keeps only commands run inside the git work tree with this root
+	Repo string
+	// Branch keeps only commands run while this git branch was checked out
+	Branch string
+	// Dir keeps only commands run in this working directory
+	Dir string
+	// Subtree extends Dir to the directories below it
+	Subtree bool
+	// ExitCode keeps only commands that exited with this status
+	ExitCode *int
+	// From and To keep only commands run in this time range, inclusively
+	From, To *time.Time
+	// AfterID and BeforeID keep only commands with a larger or smaller ID,
+	// for keyset pagination: pass the last ID of one page to get the next
+	AfterID  int
+	BeforeID int
+	// Tags keeps only commands carrying every one of these tags
+	Tags []string
+	// Starred keeps only starred commands
+	Starred bool
+	// Meta keeps only commands whose metadata is a JSON object holding all
+	// of these keys with these values
+	Meta map[string]string
+	// Reverse returns the oldest commands first
+	Reverse bool
+	// Frecency orders commands by how often and how recently their
+	// normalized command text was run, instead of newest first
+	Frecency bool
+}
+
+// where builds the WHERE clause and its arguments for the filter
+func (f Filter) where() (string, []interface{}) {
+	conditions := []string{"decrypt(command) LIKE ?"}
+	args := []interface{}{"%" + f.Query + "%"}
+
+	if f.Failed {
+		// Stripping the zeros and separators from the pipeline statuses
+		// leaves something behind only if a stage failed
+		conditions = append(conditions,
+			"(exit_code != 0 OR REPLACE(REPLACE(COALESCE(pipestatus, ''), '0', ''), ' ', '') != '')")
+	}
+	if f.Session != "" {
+		conditions = append(conditions, "session_id = ?")
+		args = append(args, f.Session)
+	}
+	if f.Host != "" {
+		conditions = append(conditions, "hostname = ?")
+		args = append(args, f.Host)
+	}
+	if f.User != "" {
+		conditions = append(conditions, "username = ?")
+		args = append(args, f.User)
+	}
+	if f.Repo != "" {
+		conditions = append(conditions, "decrypt(git_root) = ?")
+		args = append(args, f.Repo)
+	}
+	if f.Branch != "" {
+		conditions = append(conditions, "git_branch = ?")
+		args = append(args, f.Branch)
+	}
+	if f.Dir != "" {
+		if f.Subtree {
+			dir := strings.TrimRight(f.Dir, `/\`)
+			conditions = append(conditions, `(decrypt(cwd) = ? OR decrypt(cwd) LIKE ? ESCAPE '!' OR decrypt(cwd) LIKE ? ESCAPE '!')`)
+			args = append(args, f.Dir, escapeLike(dir)+"/%", escapeLike(dir)+`\%`)
+		} else {
+			conditions = append(conditions, "decrypt(cwd) = ?")
+			args = append(args, f.Dir)
+		}
+	}
+	if f.ExitCode != nil {
+		conditions = append(conditions, "COALESCE(exit_code, 0) = ?")
+		args = append(args, *f.ExitCode)
+	}
+	// Timestamps are stored in UTC the way CURRENT_TIMESTAMP writes them
+	if f.From != nil {
+		conditions = append(conditions, "timestamp >= ?")
+		args = append(args, f.From.UTC().Format(time.DateTime))
+	}
+	if f.To != nil {
+		conditions = append(conditions, "timestamp <= ?")
+		args = append(args, f.To.UTC().Format(time.DateTime))
+	}
+	tags := f.Tags
+	if f.Starred {
+		tags = append(slices.Clone(tags), StarredTag)
+	}
+	for _, tag := range tags {
+		conditions = append(conditions, "id IN (SELECT command_id FROM tags WHERE tag = ?)")
+		args = append(args, tag)
+	}
+	metaConditions, metaArgs := metaWhere(f.Meta)
+	conditions = append(conditions, metaConditions...)
+	args = append(args, metaArgs...)
+	if f.AfterID > 0 {
+		conditions = append(conditions, "id > ?")
+		args = append(args, f.AfterID)
+	}
+	if f.BeforeID > 0 {
+		conditions = append(conditions, "id < ?")
+		args = append(args, f.BeforeID)
+	}
+
+	return "WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// metaWhere builds a condition for each metadata key and value to match.
+// Values are compared as text, so numbers and booleans written by other tools
+// match their usual spelling, and metadata that is not JSON never matches.
+func metaWhere(meta map[string]string) ([]string, []interface{}) {
+	keys := slices.Sorted(maps.Keys(meta))
+	var conditions []string
+	var args []interface{}
+	for _, key := range keys {
+		conditions = append(conditions, `EXISTS (
+			SELECT 1 FROM json_each(CASE WHEN json_valid(decrypt(metadata)) THEN decrypt(metadata) ELSE '{}' END)
+			WHERE key = ? AND CASE type WHEN 'true' THEN 'true' WHEN 'false' THEN 'false' ELSE CAST(value AS TEXT) END = ?
+		)`)
+		args = append(args, key, meta[key])
+	}
+	return conditions, args
+}
+
+// escapeLike escapes the LIKE wildcards in s, for use with ESCAPE '!'
+func escapeLike(s string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(s)
+}
+
 // SearchCommands searches for commands matching the query
-func SearchCommands(query string, limit int) ([]Command, error) {
-	if db == nil {
+func (s *Store) SearchCommands(query string, limit int) ([]Command, error) {
+	return s.QueryCommands(Filter{Query: query, Limit: limit})
+}
+
+// QueryCommands returns the commands matching the filter, newest first
+// unless the filter asks for another order
+func (s *Store) QueryCommands(f Filter) ([]Command, error) {
+	return s.QueryCommandsContext(context.Background(), f)
+}
+
+// QueryCommandsContext is QueryCommands with a context
+func (s *Store) QueryCommandsContext(ctx context.Context, f Filter) ([]Command, error) {
+	if s == nil {
 		return nil, fmt.Errorf("database not initialized")
 	}
 
-	rows, err := db.Query(`
-		SELECT id, timestamp, command, session_id, cwd, exit_code, metadata
+	order := "id DESC"
+	if f.Reverse {
+		order = "id ASC"
+	}
+
+	where, args := f.where()
+	query := `
+		SELECT ` + commandColumns + `
+		FROM commands
+		` + where + `
+		ORDER BY ` + order + `
+		LIMIT ? OFFSET ?`
+	if f.Frecency {
+		// Rank every row by the score of its command text among the rows
+		// the filter selects
+		query = `
+		SELECT ` + commandColumns + `
 		FROM commands
-		WHERE command LIKE ?
-		ORDER BY id DESC
-		LIMIT ?
-	`, "%"+query+"%", limit)
+		JOIN (
+			SELECT normalized AS ranked, SUM(` + frecencyWeight + `) AS score
+			FROM commands
+			` + where + `
+			GROUP BY normalized
+		) ON ranked = normalized
+		` + where + `
+		ORDER BY score DESC, id DESC
+		LIMIT ? OFFSET ?`
+		args = append(args, args...)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, append(args, f.Limit, f.Offset)...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to search commands: %w", err)
 	}
@@ -80,60 +653,165 @@ func SearchCommands(query string, limit int) ([]Command, error) {
 
 	var commands []Command
 	for rows.Next() {
-		var cmd Command
-		err := rows.Scan(&cmd.ID, &cmd.Timestamp, &cmd.Command, &cmd.SessionID, &cmd.CWD, &cmd.ExitCode, &cmd.Metadata)
+		cmd, err := scanCommand(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan command: %w", err)
 		}
 		commands = append(commands, cmd)
 	}
 
-	return commands, nil
+	return commands, rows.Err()
+}
+
+// GetCommand returns the command with the given ID
+func (s *Store) GetCommand(id int) (*Command, error) {
+	if s == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+
+	rows, err := s.db.Query(`SELECT `+commandColumns+` FROM commands WHERE id = ?`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get command: %w", err)
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to get command: %w", err)
+		}
+		return nil, fmt.Errorf("no command with ID %d", id)
+	}
+	cmd, err := scanCommand(rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan command: %w", err)
+	}
+	return &cmd, nil
+}
+
+// Failed reports whether the command or any stage of its pipeline exited
+// with a non-zero status
+func (c Command) Failed() bool {
+	if c.ExitCode != 0 {
+		return true
+	}
+	for _, status := range c.PipeStatus {
+		if status != 0 {
+			return true
+		}
+	}
+	return false
 }
 
 // CleanHistory removes commands from history based on datetime range or all commands
-func CleanHistory(fromTime, toTime *time.Time, all, dryRun bool) (int64, error) {
-	if db == nil {
+func (s *Store) CleanHistory(fromTime, toTime *time.Time, all, dryRun bool) (int64, error) {
+	return s.CleanCommands(CleanCriteria{From: fromTime, To: toTime, All: all, DryRun: dryRun})
+}
+
+// CleanCriteria selects the commands removed by CleanCommands
+type CleanCriteria struct {
+	// From and To bound the timestamps of the removed commands, inclusively
+	From, To *time.Time
+	// Meta removes only commands with these metadata keys and values
+	Meta map[string]string
+	// All removes every command
+	All bool
+	// DryRun counts the commands that would be removed without removing them
+	DryRun bool
+}
+
+// CleanCommands removes the commands matching the criteria and returns how
+// many there were. At least a time bound, a metadata filter or All is
+// required.
+func (s *Store) CleanCommands(c CleanCriteria) (int64, error) {
+	if s == nil {
 		return 0, fmt.Errorf("database not initialized")
 	}
 
-	var query string
+	var conditions []string
 	var args []interface{}
+	// Timestamps are stored in UTC the way CURRENT_TIMESTAMP writes them
+	if c.From != nil {
+		conditions = append(conditions, "timestamp >= ?")
+		args = append(args, c.From.UTC().Format(time.DateTime))
+	}
+	if c.To != nil {
+		conditions = append(conditions, "timestamp <= ?")
+		args = append(args, c.To.UTC().Format(time.DateTime))
+	}
+	metaConditions, metaArgs := metaWhere(c.Meta)
+	conditions = append(conditions, metaConditions...)
+	args = append(args, metaArgs...)
 
-	if all {
-		query = "DELETE FROM commands"
-	} else if fromTime != nil && toTime != nil {
-		query = "DELETE FROM commands WHERE timestamp BETWEEN ? AND ?"
-		args = []interface{}{fromTime.Format(time.RFC3339), toTime.Format(time.RFC3339)}
-	} else if fromTime != nil {
-		query = "DELETE FROM commands WHERE timestamp >= ?"
-		args = []interface{}{fromTime.Format(time.RFC3339)}
-	} else if toTime != nil {
-		query = "DELETE FROM commands WHERE timestamp <= ?"
-		args = []interface{}{toTime.Format(time.RFC3339)}
-	} else {
+	where := ""
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	} else if !c.All {
 		return 0, fmt.Errorf("at least one datetime range must be specified or use --all flag")
 	}
 
-	if dryRun {
+	if c.DryRun {
 		// For dry run, count instead of delete
-		var countQuery string
-		if all {
-			countQuery = "SELECT COUNT(*) FROM commands"
-		} else {
-			countQuery = strings.Replace(query, "DELETE FROM commands", "SELECT COUNT(*) FROM commands", 1)
-		}
 		var count int64
-		err := db.QueryRow(countQuery, args...).Scan(&count)
+		err := s.db.QueryRow("SELECT COUNT(*) FROM commands"+where, args...).Scan(&count)
 		return count, err
 	}
 
-	result, err := db.Exec(query, args...)
+	if where == "" {
+		where = " WHERE 1"
+	}
+	deleted, err := s.deleteWhere(context.Background(), where, args)
 	if err != nil {
 		return 0, fmt.Errorf("failed to clean history: %w", err)
 	}
+	return deleted, nil
+}
 
-	return result.RowsAffected()
+// DeleteCommand removes the command with the given ID
+func (s *Store) DeleteCommand(id int) error {
+	return s.DeleteCommandContext(context.Background(), id)
+}
+
+// DeleteCommandContext is DeleteCommand with a context
+func (s *Store) DeleteCommandContext(ctx context.Context, id int) error {
+	if err := s.requireCommand(id); err != nil {
+		return err
+	}
+	if _, err := s.deleteWhere(ctx, " WHERE id = ?", []interface{}{id}); err != nil {
+		return fmt.Errorf("failed to delete command: %w", err)
+	}
+	return nil
+}
+
+// deleteWhere removes the commands matching the WHERE clause, leaving
+// tombstones for synced peers and the audit chain, and returns how many
+// there were
+func (s *Store) deleteWhere(ctx context.Context, where string, args []interface{}) (int64, error) {
+	var deleted int64
+	err := s.withImmediateTx(ctx, func(q querier) error {
+		// Synced peers delete the commands too when they see the tombstones
+		if err := s.recordSyncTombstones(q, where, args); err != nil {
+			return err
+		}
+		// Deleted entries leave signed tombstones so the chain has no gaps
+		if s.audit != nil {
+			if err := s.tombstoneCommands(q, where, args); err != nil {
+				return err
+			}
+		}
+		result, err := q.ExecContext(ctx, "DELETE FROM commands"+where, args...)
+		if err != nil {
+			return err
+		}
+		deleted, err = result.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := s.deleteOrphanedAnnotations(); err != nil {
+		return 0, err
+	}
+	return deleted, nil
 }
 
 // Command represents a stored command
@@ -145,4 +823,33 @@ type Command struct {
 	CWD       string `json:"cwd"`
 	ExitCode  int    `json:"exit_code"`
 	Metadata  string `json:"metadata"`
+	// DurationMs is the wall-clock run time reported by the hook, if any
+	DurationMs int64 `json:"duration_ms"`
+	// ErrorType identifies the kind of failure when the shell reports one,
+	// e.g. the exception type of a PowerShell error record
+	ErrorType string `json:"error_type"`
+	// PipeStatus holds the exit status of every stage of a pipeline, in order
+	PipeStatus []int `json:"pipestatus,omitempty"`
+	// Hostname and Username identify where and by whom the command was run
+	Hostname string `json:"hostname"`
+	Username string `json:"username"`
+	// Shell, ShellVersion and TTY describe the session the command ran in
+	Shell        string `json:"shell"`
+	ShellVersion string `json:"shell_version"`
+	TTY          string `json:"tty"`
+	// Env holds the allowlisted environment variables set at the time
+	Env map[string]string `json:"env,omitempty"`
+	// GitRoot, GitRemote, GitBranch and GitCommit describe the git work tree
+	// the command ran in, if any
+	GitRoot   string `json:"git_root"`
+	GitRemote string `json:"git_remote"`
+	GitBranch string `json:"git_branch"`
+	GitCommit string `json:"git_commit"`
+	// UID identifies the command across synced databases, and Origin is the
+	// database it was first logged in
+	UID    string `json:"uid"`
+	Origin string `json:"origin"`
+	// Tags and Note are added after the fact to curate the history
+	Tags []string `json:"tags,omitempty"`
+	Note string   `json:"note,omitempty"`
 }
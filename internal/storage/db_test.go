@@ -1,53 +1,58 @@
+//go:build cgo
+
 package storage
 
 import (
+	"database/sql"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
-func TestInitDB(t *testing.T) {
-	// Use in-memory database for testing
-	dbPath := ":memory:"
-
-	err := InitDB(dbPath)
+// openTestStore opens the database at path, or a new one in memory for
+// ":memory:", until the test ends
+func openTestStore(t *testing.T, path string) *Store {
+	t.Helper()
+	s, err := Open(path)
 	if err != nil {
-		t.Fatalf("InitDB failed: %v", err)
+		t.Fatalf("Open failed: %v", err)
 	}
+	t.Cleanup(func() { s.Close() })
+	return s
 }
 
-func TestSaveCommand(t *testing.T) {
-	dbPath := ":memory:"
-
-	err := InitDB(dbPath)
-	if err != nil {
-		t.Fatalf("InitDB failed: %v", err)
+func TestOpen(t *testing.T) {
+	// Use in-memory database for testing
+	s := openTestStore(t, ":memory:")
+	if s.Origin() == "" {
+		t.Error("Expected the database to get an origin")
 	}
+}
+
+func TestSaveCommand(t *testing.T) {
+	s := openTestStore(t, ":memory:")
 
 	// Test saving a command
-	err = SaveCommand("ls -la", "session1", "/home", 0, "")
+	err := s.SaveCommand("ls -la", "session1", "/home", 0, "")
 	if err != nil {
 		t.Errorf("SaveCommand failed: %v", err)
 	}
 
 	// Test saving another command
-	err = SaveCommand("echo hello", "session1", "/home", 0, "test metadata")
+	err = s.SaveCommand("echo hello", "session1", "/home", 0, "test metadata")
 	if err != nil {
 		t.Errorf("SaveCommand failed: %v", err)
 	}
 
 	// Test saving with empty fields
-	err = SaveCommand("", "", "", 1, "")
+	err = s.SaveCommand("", "", "", 1, "")
 	if err != nil {
 		t.Errorf("SaveCommand with empty fields failed: %v", err)
 	}
 }
 
 func TestSearchCommands(t *testing.T) {
-	dbPath := ":memory:"
-
-	err := InitDB(dbPath)
-	if err != nil {
-		t.Fatalf("InitDB failed: %v", err)
-	}
+	s := openTestStore(t, ":memory:")
 
 	// Save some test commands
 	commands := []struct {
@@ -64,14 +69,14 @@ func TestSearchCommands(t *testing.T) {
 	}
 
 	for _, c := range commands {
-		err := SaveCommand(c.cmd, c.sess, c.cwd, c.exit, c.meta)
+		err := s.SaveCommand(c.cmd, c.sess, c.cwd, c.exit, c.meta)
 		if err != nil {
 			t.Fatalf("SaveCommand failed: %v", err)
 		}
 	}
 
 	// Test search for "git"
-	results, err := SearchCommands("git", 10)
+	results, err := s.SearchCommands("git", 10)
 	if err != nil {
 		t.Errorf("SearchCommands failed: %v", err)
 	}
@@ -83,7 +88,7 @@ func TestSearchCommands(t *testing.T) {
 	}
 
 	// Test search for "echo"
-	results, err = SearchCommands("echo", 10)
+	results, err = s.SearchCommands("echo", 10)
 	if err != nil {
 		t.Errorf("SearchCommands failed: %v", err)
 	}
@@ -92,7 +97,7 @@ func TestSearchCommands(t *testing.T) {
 	}
 
 	// Test search for "ls"
-	results, err = SearchCommands("ls", 10)
+	results, err = s.SearchCommands("ls", 10)
 	if err != nil {
 		t.Errorf("SearchCommands failed: %v", err)
 	}
@@ -101,7 +106,7 @@ func TestSearchCommands(t *testing.T) {
 	}
 
 	// Test search with no matches
-	results, err = SearchCommands("nonexistent", 10)
+	results, err = s.SearchCommands("nonexistent", 10)
 	if err != nil {
 		t.Errorf("SearchCommands failed: %v", err)
 	}
@@ -110,7 +115,7 @@ func TestSearchCommands(t *testing.T) {
 	}
 
 	// Test limit
-	results, err = SearchCommands("", 2) // Empty query should match all, but limit to 2
+	results, err = s.SearchCommands("", 2) // Empty query should match all, but limit to 2
 	if err != nil {
 		t.Errorf("SearchCommands failed: %v", err)
 	}
@@ -119,7 +124,7 @@ func TestSearchCommands(t *testing.T) {
 	}
 
 	// Test with limit 0 (should return nothing)
-	results, err = SearchCommands("git", 0)
+	results, err = s.SearchCommands("git", 0)
 	if err != nil {
 		t.Errorf("SearchCommands failed: %v", err)
 	}
@@ -129,19 +134,14 @@ func TestSearchCommands(t *testing.T) {
 }
 
 func TestSearchCommandsOrder(t *testing.T) {
-	dbPath := ":memory:"
-
-	err := InitDB(dbPath)
-	if err != nil {
-		t.Fatalf("InitDB failed: %v", err)
-	}
+	s := openTestStore(t, ":memory:")
 
 	// Save commands (assuming timestamps are sequential)
-	SaveCommand("first", "s", "/", 0, "")
-	SaveCommand("second", "s", "/", 0, "")
-	SaveCommand("third", "s", "/", 0, "")
+	s.SaveCommand("first", "s", "/", 0, "")
+	s.SaveCommand("second", "s", "/", 0, "")
+	s.SaveCommand("third", "s", "/", 0, "")
 
-	results, err := SearchCommands("", 10)
+	results, err := s.SearchCommands("", 10)
 	if err != nil {
 		t.Errorf("SearchCommands failed: %v", err)
 	}
@@ -154,3 +154,387 @@ func TestSearchCommandsOrder(t *testing.T) {
 		t.Errorf("Results not in correct order: %v", results)
 	}
 }
+
+func TestSaveEntry(t *testing.T) {
+	s := openTestStore(t, ":memory:")
+
+	err := s.SaveEntry(Command{
+		Command:    "Get-Item missing",
+		SessionID:  "1234",
+		CWD:        `C:\Users`,
+		ExitCode:   1,
+		DurationMs: 42,
+		ErrorType:  "System.Management.Automation.ItemNotFoundException",
+	})
+	if err != nil {
+		t.Fatalf("SaveEntry failed: %v", err)
+	}
+
+	results, err := s.SearchCommands("Get-Item", 10)
+	if err != nil {
+		t.Fatalf("SearchCommands failed: %v", err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("Expected 1 result, got %d", len(results))
+	}
+	if results[0].DurationMs != 42 {
+		t.Errorf("Expected duration 42, got %d", results[0].DurationMs)
+	}
+	if results[0].ErrorType != "System.Management.Automation.ItemNotFoundException" {
+		t.Errorf("Unexpected error type '%s'", results[0].ErrorType)
+	}
+}
+
+func TestOpenMigratesOldSchema(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "old.db")
+
+	// Create a database with the original schema and one row
+	old, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatalf("Opening database failed: %v", err)
+	}
+	_, err = old.Exec(`
+	CREATE TABLE commands (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+		command TEXT NOT NULL,
+		session_id TEXT,
+		cwd TEXT,
+		exit_code INTEGER,
+		metadata TEXT
+	);
+	INSERT INTO commands (command, session_id, cwd, exit_code, metadata) VALUES ('old command', 's', '/', 0, '');
+	INSERT INTO commands (command, session_id, cwd, exit_code, metadata) VALUES ('old  command ', 's', '/', 0, '');
+	`)
+	old.Close()
+	if err != nil {
+		t.Fatalf("Creating old schema failed: %v", err)
+	}
+
+	s := openTestStore(t, dbPath)
+	if err := s.SaveEntry(Command{Command: "new command", DurationMs: 5}); err != nil {
+		t.Fatalf("SaveEntry failed: %v", err)
+	}
+
+	results, err := s.SearchCommands("command", 10)
+	if err != nil {
+		t.Fatalf("SearchCommands failed: %v", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("Expected 3 results, got %d", len(results))
+	}
+	if results[2].Command != "old command" || results[2].DurationMs != 0 {
+		t.Errorf("Old row not read correctly: %+v", results[2])
+	}
+
+	// Old rows are normalized during the migration, so repeats group together
+	summaries, err := s.UniqueCommands(Filter{Query: "old", Limit: 10})
+	if err != nil {
+		t.Fatalf("UniqueCommands failed: %v", err)
+	}
+	if len(summaries) != 1 || summaries[0].Count != 2 {
+		t.Errorf("Old rows not normalized: %+v", summaries)
+	}
+}
+
+func TestQueryCommandsFailed(t *testing.T) {
+	s := openTestStore(t, ":memory:")
+
+	entries := []Command{
+		{Command: "make | tee build.log", ExitCode: 0, PipeStatus: []int{2, 0}},
+		{Command: "cat file | grep x | wc -l", ExitCode: 0, PipeStatus: []int{0, 0, 0}},
+		{Command: "false", ExitCode: 1},
+		{Command: "true", ExitCode: 0},
+		{Command: "yes | head -1", ExitCode: 0, PipeStatus: []int{141, 0}},
+	}
+	for _, e := range entries {
+		if err := s.SaveEntry(e); err != nil {
+			t.Fatalf("SaveEntry failed: %v", err)
+		}
+	}
+
+	results, err := s.QueryCommands(Filter{Limit: 10, Failed: true})
+	if err != nil {
+		t.Fatalf("QueryCommands failed: %v", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("Expected 3 failed commands, got %d: %v", len(results), results)
+	}
+	if results[0].Command != "yes | head -1" || results[1].Command != "false" || results[2].Command != "make | tee build.log" {
+		t.Errorf("Unexpected failed commands: %v", results)
+	}
+	if len(results[2].PipeStatus) != 2 || results[2].PipeStatus[0] != 2 {
+		t.Errorf("Pipe status not stored: %v", results[2].PipeStatus)
+	}
+}
+
+func TestQueryCommandsHostAndUser(t *testing.T) {
+	s := openTestStore(t, ":memory:")
+
+	entries := []Command{
+		{Command: "uptime", Hostname: "web-1", Username: "deploy", Shell: "bash", TTY: "/dev/pts/0",
+			Env: map[string]string{"AWS_PROFILE": "prod"}},
+		{Command: "uptime", Hostname: "web-2", Username: "deploy"},
+		{Command: "uptime", Hostname: "web-1", Username: "root"},
+	}
+	for _, e := range entries {
+		if err := s.SaveEntry(e); err != nil {
+			t.Fatalf("SaveEntry failed: %v", err)
+		}
+	}
+
+	results, err := s.QueryCommands(Filter{Limit: 10, Host: "web-1"})
+	if err != nil {
+		t.Fatalf("QueryCommands failed: %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 commands on web-1, got %d", len(results))
+	}
+
+	results, err = s.QueryCommands(Filter{Limit: 10, Host: "web-1", User: "deploy"})
+	if err != nil {
+		t.Fatalf("QueryCommands failed: %v", err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("Expected 1 command by deploy on web-1, got %d", len(results))
+	}
+	if results[0].Shell != "bash" || results[0].TTY != "/dev/pts/0" || results[0].Env["AWS_PROFILE"] != "prod" {
+		t.Errorf("Context not stored: %+v", results[0])
+	}
+}
+
+func TestQueryCommandsRepoAndBranch(t *testing.T) {
+	s := openTestStore(t, ":memory:")
+
+	entries := []Command{
+		{Command: "npm install", CWD: "/src/app", GitRoot: "/src/app", GitBranch: "main", GitCommit: "abc"},
+		{Command: "npm test", CWD: "/src/app/web", GitRoot: "/src/app", GitBranch: "feature"},
+		{Command: "make", CWD: "/src/lib", GitRoot: "/src/lib", GitBranch: "main"},
+		{Command: "ls", CWD: "/tmp"},
+	}
+	for _, e := range entries {
+		if err := s.SaveEntry(e); err != nil {
+			t.Fatalf("SaveEntry failed: %v", err)
+		}
+	}
+
+	results, err := s.QueryCommands(Filter{Limit: 10, Repo: "/src/app"})
+	if err != nil {
+		t.Fatalf("QueryCommands failed: %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 commands in /src/app, got %d", len(results))
+	}
+
+	results, err = s.QueryCommands(Filter{Limit: 10, Branch: "main"})
+	if err != nil {
+		t.Fatalf("QueryCommands failed: %v", err)
+	}
+	if len(results) != 2 || results[1].GitCommit != "abc" {
+		t.Errorf("Unexpected commands on main: %+v", results)
+	}
+}
+
+func TestQueryCommandsAfterIDReverse(t *testing.T) {
+	s := openTestStore(t, ":memory:")
+
+	for _, c := range []string{"first", "second", "third", "fourth"} {
+		if err := s.SaveCommand(c, "s", "/", 0, ""); err != nil {
+			t.Fatalf("SaveCommand failed: %v", err)
+		}
+	}
+
+	results, err := s.QueryCommands(Filter{Limit: 10, AfterID: 2, Reverse: true})
+	if err != nil {
+		t.Fatalf("QueryCommands failed: %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 results after ID 2, got %d", len(results))
+	}
+	if results[0].Command != "third" || results[1].Command != "fourth" {
+		t.Errorf("Expected oldest first, got %v", results)
+	}
+}
+
+func TestQueryCommandsOffsetAndBeforeID(t *testing.T) {
+	s := openTestStore(t, ":memory:")
+
+	for _, c := range []string{"first", "second", "third", "fourth", "fifth"} {
+		if err := s.SaveCommand(c, "s", "/", 0, ""); err != nil {
+			t.Fatalf("SaveCommand failed: %v", err)
+		}
+	}
+
+	results, err := s.QueryCommands(Filter{Limit: 2, Offset: 2})
+	if err != nil {
+		t.Fatalf("QueryCommands failed: %v", err)
+	}
+	if len(results) != 2 || results[0].Command != "third" || results[1].Command != "second" {
+		t.Errorf("Expected third and second, got %v", results)
+	}
+
+	// Keyset paging continues from the last ID shown
+	results, err = s.QueryCommands(Filter{Limit: 2, BeforeID: results[1].ID})
+	if err != nil {
+		t.Fatalf("QueryCommands failed: %v", err)
+	}
+	if len(results) != 1 || results[0].Command != "first" {
+		t.Errorf("Expected only first, got %v", results)
+	}
+
+	summaries, err := s.UniqueCommands(Filter{Limit: 10, Offset: 3, Reverse: true})
+	if err != nil {
+		t.Fatalf("UniqueCommands failed: %v", err)
+	}
+	if len(summaries) != 2 || summaries[0].Command != "fourth" {
+		t.Errorf("Expected fourth and fifth, got %v", summaries)
+	}
+}
+
+func TestGetCommand(t *testing.T) {
+	s := openTestStore(t, ":memory:")
+
+	if err := s.SaveCommand("make test", "s", "/project", 2, ""); err != nil {
+		t.Fatalf("SaveCommand failed: %v", err)
+	}
+
+	cmd, err := s.GetCommand(1)
+	if err != nil {
+		t.Fatalf("GetCommand failed: %v", err)
+	}
+	if cmd.Command != "make test" || cmd.CWD != "/project" || cmd.ExitCode != 2 {
+		t.Errorf("Unexpected command: %+v", cmd)
+	}
+
+	if _, err := s.GetCommand(2); err == nil {
+		t.Error("Expected an error for a missing ID")
+	}
+}
+
+func TestQueryCommandsSession(t *testing.T) {
+	s := openTestStore(t, ":memory:")
+
+	if err := s.SaveCommand("ls", "100", "/", 0, ""); err != nil {
+		t.Fatalf("SaveCommand failed: %v", err)
+	}
+	if err := s.SaveCommand("pwd", "200", "/", 0, ""); err != nil {
+		t.Fatalf("SaveCommand failed: %v", err)
+	}
+
+	results, err := s.QueryCommands(Filter{Limit: 10, Session: "200"})
+	if err != nil {
+		t.Fatalf("QueryCommands failed: %v", err)
+	}
+	if len(results) != 1 || results[0].Command != "pwd" {
+		t.Errorf("Expected only pwd, got %v", results)
+	}
+}
+
+func TestQueryCommandsMeta(t *testing.T) {
+	s := openTestStore(t, ":memory:")
+
+	for _, metadata := range []string{
+		`{"job":"42","ticket":"OPS-7"}`,
+		`{"job":42,"retry":true}`,
+		`{"job":"43"}`,
+		`not json`,
+		``,
+	} {
+		if err := s.SaveCommand("make", "s", "/", 0, metadata); err != nil {
+			t.Fatalf("SaveCommand failed: %v", err)
+		}
+	}
+
+	tests := []struct {
+		meta     map[string]string
+		expected int
+	}{
+		{map[string]string{"job": "42"}, 2},
+		{map[string]string{"job": "42", "ticket": "OPS-7"}, 1},
+		{map[string]string{"retry": "true"}, 1},
+		{map[string]string{"job": "44"}, 0},
+	}
+	for _, tt := range tests {
+		results, err := s.QueryCommands(Filter{Limit: 10, Meta: tt.meta})
+		if err != nil {
+			t.Fatalf("QueryCommands failed: %v", err)
+		}
+		if len(results) != tt.expected {
+			t.Errorf("Expected %d commands for %v, got %d", tt.expected, tt.meta, len(results))
+		}
+	}
+
+	deleted, err := s.CleanCommands(CleanCriteria{Meta: map[string]string{"job": "42"}})
+	if err != nil {
+		t.Fatalf("CleanCommands failed: %v", err)
+	}
+	if deleted != 2 {
+		t.Errorf("Expected 2 commands deleted, got %d", deleted)
+	}
+}
+
+func TestDeleteCommand(t *testing.T) {
+	s := openTestStore(t, ":memory:")
+	for _, c := range []string{"ls", "rm -rf /tmp/x"} {
+		if err := s.SaveCommand(c, "1", "/", 0, ""); err != nil {
+			t.Fatalf("SaveCommand failed: %v", err)
+		}
+	}
+	if err := s.AddTags(2, "oops"); err != nil {
+		t.Fatalf("AddTags failed: %v", err)
+	}
+
+	if err := s.DeleteCommand(2); err != nil {
+		t.Fatalf("DeleteCommand failed: %v", err)
+	}
+	if _, err := s.GetCommand(2); err == nil {
+		t.Error("Expected the command to be gone")
+	}
+	if err := s.DeleteCommand(2); err == nil {
+		t.Error("Expected an error deleting a missing command")
+	}
+	changes, err := s.ChangesSince(SyncCursor{}, 10)
+	if err != nil || len(changes.Tombstones) != 1 || len(changes.Commands) != 1 {
+		t.Errorf("Expected a tombstone for the synced peers, got %+v (%v)", changes, err)
+	}
+}
+
+func TestQueryCommandsExitCodeAndTime(t *testing.T) {
+	s := openTestStore(t, ":memory:")
+	for _, r := range []struct {
+		timestamp string
+		command   string
+		exitCode  any
+	}{
+		{"2024-03-01 08:00:00", "make", 2},
+		{"2024-03-02 12:00:00", "make test", 0},
+		{"2024-03-03 23:59:00", "make lint", nil},
+	} {
+		if _, err := s.db.Exec("INSERT INTO commands (timestamp, command, exit_code) VALUES (?, ?, ?)",
+			r.timestamp, r.command, r.exitCode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	zero, two := 0, 2
+	if commands, err := s.QueryCommands(Filter{ExitCode: &two, Limit: 10}); err != nil || len(commands) != 1 ||
+		commands[0].Command != "make" {
+		t.Errorf("Expected only make, got %v (%v)", commands, err)
+	}
+	// A missing exit code counts as success
+	if commands, _ := s.QueryCommands(Filter{ExitCode: &zero, Limit: 10}); len(commands) != 2 {
+		t.Errorf("Expected 2 successful commands, got %v", commands)
+	}
+
+	from := time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2024, 3, 3, 23, 59, 59, 0, time.UTC)
+	commands, err := s.QueryCommands(Filter{From: &from, To: &to, Limit: 10})
+	if err != nil || len(commands) != 2 || commands[0].Command != "make lint" {
+		t.Errorf("Expected the commands of March 2 and 3, got %v (%v)", commands, err)
+	}
+	// Times in other zones are compared in UTC
+	to = time.Date(2024, 3, 2, 13, 0, 0, 0, time.FixedZone("CET", 3600))
+	if commands, _ := s.QueryCommands(Filter{From: &from, To: &to, Limit: 10}); len(commands) != 1 {
+		t.Errorf("Expected only make test, got %v", commands)
+	}
+}
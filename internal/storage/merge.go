@@ -0,0 +1,355 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/khelechy/consolidate/internal/ulid"
+)
+
+// mergeBatchSize is the number of commands written per transaction
+const mergeBatchSize = 500
+
+// MergeOptions configures MergeDatabase
+type MergeOptions struct {
+	// DryRun counts what would be merged without writing anything
+	DryRun bool
+	// Progress, if set, is called after every batch with the number of
+	// commands read so far and the total
+	Progress func(done, total int)
+}
+
+// MergeResult counts what MergeDatabase did
+type MergeResult struct {
+	// Read counts the commands in the other database
+	Read int
+	// Added counts the commands copied over
+	Added int
+	// Duplicates counts the commands already present, or deleted here
+	Duplicates int
+	// RemappedSessions counts the session IDs renamed because they were
+	// already in use here
+	RemappedSessions int
+}
+
+// mergeColumns are read from the other database, with the value used when
+// its schema predates the column
+var mergeColumns = []struct {
+	name, fallback string
+}{
+	{"timestamp", "NULL"}, {"command", "''"}, {"session_id", "''"}, {"cwd", "''"}, {"exit_code", "0"},
+	{"metadata", "''"}, {"duration_ms", "0"}, {"error_type", "''"}, {"pipestatus", "''"}, {"hostname", "''"},
+	{"username", "''"}, {"shell", "''"}, {"shell_version", "''"}, {"tty", "''"}, {"env", "''"},
+	{"git_root", "''"}, {"git_remote", "''"}, {"git_branch", "''"}, {"git_commit", "''"}, {"uid", "''"},
+	{"origin", "''"},
+}
+
+// mergeKey identifies a command for duplicate detection
+func mergeKey(timestamp time.Time, command, session, host string) string {
+	return strings.Join([]string{timestamp.UTC().Format(time.RFC3339), command, session, host}, "\x00")
+}
+
+// MergeDatabase copies the commands of another consolidate database, of any
+// schema version, into the open one. A command is a duplicate if one with
+// the same timestamp, command text, session and host, or the same UID, is
+// already here. Session IDs of the other database that are in use here get
+// a suffix, since shells on different machines reuse the same PIDs.
+//
+// The keys and UIDs of every command here, and of those merged so far, are
+// held in memory while merging: about the size of the command texts. The
+// commands themselves are copied in batches.
+func (s *Store) MergeDatabase(path string, opts MergeOptions) (*MergeResult, error) {
+	if s == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+	k, err := s.writeKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	dsn, err := readOnlyDSN(path)
+	if err != nil {
+		return nil, err
+	}
+	other, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+	defer other.Close()
+
+	tables, err := tableColumns(other)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	columns := tables["commands"]
+	if !columns["command"] {
+		return nil, fmt.Errorf("%s is not a consolidate database", path)
+	}
+	var otherOrigin string
+	if tables["settings"]["name"] {
+		var encrypted bool
+		if err := other.QueryRow("SELECT EXISTS (SELECT 1 FROM settings WHERE name = 'encryption')").Scan(&encrypted); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+		if encrypted {
+			return nil, fmt.Errorf("%s is encrypted; sync with it instead", path)
+		}
+		if _, err := getSetting(other, "origin", &otherOrigin); err != nil {
+			return nil, err
+		}
+		if otherOrigin == s.origin {
+			return nil, fmt.Errorf("%s is this database", path)
+		}
+	}
+
+	// What is already here
+	existing, sessions, err := s.mergeIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	var selects []string
+	for _, c := range mergeColumns {
+		if c.name == "timestamp" && columns[c.name] {
+			// COALESCE would hide the declared type the driver parses times by
+			selects = append(selects, c.name)
+		} else if columns[c.name] {
+			selects = append(selects, fmt.Sprintf("COALESCE(%s, %s)", c.name, c.fallback))
+		} else {
+			selects = append(selects, c.fallback)
+		}
+	}
+	tagsSelect, noteSelect := "''", "''"
+	if tables["tags"]["tag"] {
+		tagsSelect = "COALESCE((SELECT group_concat(tag, ' ') FROM tags WHERE command_id = commands.id), '')"
+	}
+	if tables["notes"]["note"] {
+		noteSelect = "COALESCE((SELECT note FROM notes WHERE command_id = commands.id), '')"
+	}
+
+	var total int
+	if err := other.QueryRow("SELECT COUNT(*) FROM commands").Scan(&total); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	rows, err := other.Query(`SELECT ` + strings.Join(selects, ", ") + `, ` + tagsSelect + `, ` + noteSelect + `
+		FROM commands ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	defer rows.Close()
+
+	// Rows of databases from before sync get an origin standing for the
+	// other database, and remapped sessions a suffix derived from it, so
+	// merging the same file again maps them the same way
+	suffix := ""
+	remapped := make(map[string]string)
+	counted := make(map[string]bool)
+	result := &MergeResult{}
+	var batch []Command
+	flush := func() error {
+		if !opts.DryRun && len(batch) > 0 {
+			if err := s.insertMerged(k, batch); err != nil {
+				return err
+			}
+		}
+		batch = batch[:0]
+		if opts.Progress != nil {
+			opts.Progress(result.Read, total)
+		}
+		return nil
+	}
+
+	for rows.Next() {
+		var cmd Command
+		var timestamp sql.NullTime
+		var pipeStatus, env, tags string
+		if err := rows.Scan(&timestamp, &cmd.Command, &cmd.SessionID, &cmd.CWD, &cmd.ExitCode, &cmd.Metadata,
+			&cmd.DurationMs, &cmd.ErrorType, &pipeStatus, &cmd.Hostname, &cmd.Username, &cmd.Shell,
+			&cmd.ShellVersion, &cmd.TTY, &env, &cmd.GitRoot, &cmd.GitRemote, &cmd.GitBranch, &cmd.GitCommit,
+			&cmd.UID, &cmd.Origin, &tags, &cmd.Note); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+		result.Read++
+		if !timestamp.Valid {
+			timestamp.Time = time.Now()
+		}
+		cmd.Timestamp = timestamp.Time.UTC().Format(time.RFC3339)
+		cmd.PipeStatus, _ = ParsePipeStatus(pipeStatus)
+		cmd.Tags = strings.Fields(tags)
+		if env != "" {
+			if err := json.Unmarshal([]byte(env), &cmd.Env); err != nil {
+				cmd.Env = nil
+			}
+		}
+
+		if suffix == "" {
+			seed := otherOrigin
+			if seed == "" {
+				seed = cmd.Timestamp + "\x00" + cmd.Command
+			}
+			sum := sha256.Sum256([]byte(seed))
+			suffix = hex.EncodeToString(sum[:3])
+			if otherOrigin == "" {
+				otherOrigin = "merge-" + hex.EncodeToString(sum[:8])
+			}
+		}
+
+		session := cmd.SessionID
+		if mapped, ok := remapped[session]; ok {
+			cmd.SessionID = mapped
+		} else if session != "" && sessions[session] {
+			cmd.SessionID = session + "-" + suffix
+			remapped[session] = cmd.SessionID
+		} else {
+			remapped[session] = session
+		}
+
+		// Either key may be the one a previous merge of this file stored
+		original := mergeKey(timestamp.Time, cmd.Command, session, cmd.Hostname)
+		key := mergeKey(timestamp.Time, cmd.Command, cmd.SessionID, cmd.Hostname)
+		if existing[original] || existing[key] || (cmd.UID != "" && existing["uid:"+cmd.UID]) {
+			result.Duplicates++
+			continue
+		}
+		existing[key] = true
+
+		if cmd.UID == "" {
+			cmd.UID = ulid.New(timestamp.Time)
+		}
+		existing["uid:"+cmd.UID] = true
+		if cmd.Origin == "" {
+			cmd.Origin = otherOrigin
+		}
+		if cmd.SessionID != session && !counted[session] {
+			counted[session] = true
+			result.RemappedSessions++
+		}
+		batch = append(batch, cmd)
+		result.Added++
+		if len(batch) == mergeBatchSize {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// readOnlyDSN returns the URI that opens the database at path read-only.
+// The path is escaped, so names containing '?', '#' or '%' open that file.
+func readOnlyDSN(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("resolving %s: %w", path, err)
+	}
+	abs = filepath.ToSlash(abs)
+	if !strings.HasPrefix(abs, "/") {
+		// A Windows drive letter, as in file:///C:/Users
+		abs = "/" + abs
+	}
+	u := url.URL{Scheme: "file", Path: abs, RawQuery: "mode=ro"}
+	return u.String(), nil
+}
+
+// tableColumns returns the columns of every table in a database
+func tableColumns(q *sql.DB) (map[string]map[string]bool, error) {
+	rows, err := q.Query("SELECT m.name, p.name FROM sqlite_master m JOIN pragma_table_info(m.name) p WHERE m.type = 'table'")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tables := make(map[string]map[string]bool)
+	for rows.Next() {
+		var table, column string
+		if err := rows.Scan(&table, &column); err != nil {
+			return nil, err
+		}
+		if tables[table] == nil {
+			tables[table] = make(map[string]bool)
+		}
+		tables[table][column] = true
+	}
+	return tables, rows.Err()
+}
+
+// mergeIndex returns the duplicate keys and UIDs of the commands here,
+// including deleted ones, and the session IDs in use
+func (s *Store) mergeIndex() (map[string]bool, map[string]bool, error) {
+	existing := make(map[string]bool)
+	sessions := make(map[string]bool)
+	rows, err := s.db.Query(`SELECT timestamp, decrypt(command), COALESCE(session_id, ''), COALESCE(hostname, ''),
+		COALESCE(uid, '') FROM commands`)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading commands: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var timestamp sql.NullTime
+		var command, session, host, uid string
+		if err := rows.Scan(&timestamp, &command, &session, &host, &uid); err != nil {
+			return nil, nil, fmt.Errorf("reading commands: %w", err)
+		}
+		existing[mergeKey(timestamp.Time, command, session, host)] = true
+		if uid != "" {
+			existing["uid:"+uid] = true
+		}
+		sessions[session] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("reading commands: %w", err)
+	}
+
+	tombstones, err := s.db.Query("SELECT uid FROM sync_tombstones")
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading tombstones: %w", err)
+	}
+	defer tombstones.Close()
+	for tombstones.Next() {
+		var uid string
+		if err := tombstones.Scan(&uid); err != nil {
+			return nil, nil, fmt.Errorf("reading tombstones: %w", err)
+		}
+		existing["uid:"+uid] = true
+	}
+	return existing, sessions, tombstones.Err()
+}
+
+// insertMerged writes a batch of merged commands in one transaction
+func (s *Store) insertMerged(k *keys, batch []Command) error {
+	ctx := context.Background()
+	err := s.withImmediateTx(ctx, func(q querier) error {
+		for _, cmd := range batch {
+			id, err := insertCommand(ctx, q, k, cmd)
+			if err != nil {
+				return err
+			}
+			if err := insertAnnotations(q, k, id, cmd); err != nil {
+				return err
+			}
+			if s.audit != nil {
+				if err := s.appendToChain(q, int(id)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("saving merged commands: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+//go:build cgo
+
+package storage
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// createOldDatabase creates a database with the schema of the first release
+func createOldDatabase(t *testing.T, path string, rows [][3]string) {
+	t.Helper()
+	old, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	if _, err := old.Exec(`CREATE TABLE commands (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+		command TEXT NOT NULL,
+		session_id TEXT,
+		cwd TEXT,
+		exit_code INTEGER,
+		metadata TEXT
+	)`); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range rows {
+		if _, err := old.Exec("INSERT INTO commands (timestamp, command, session_id, cwd, exit_code) VALUES (?, ?, ?, '/', 0)",
+			r[0], r[1], r[2]); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMergeDatabase(t *testing.T) {
+	dir := t.TempDir()
+	oldPath := filepath.Join(dir, "old.db")
+	createOldDatabase(t, oldPath, [][3]string{
+		{"2024-01-01 10:00:00", "git clone repo", "100"},
+		{"2024-01-01 10:01:00", "make", "100"},
+		{"2024-01-01 10:02:00", "make", "200"},
+		{"2024-01-01 10:02:00", "make", "200"},
+		{"2024-01-02 09:00:00", "ls", "300"},
+	})
+
+	s := openTestStore(t, filepath.Join(dir, "new.db"))
+	// Session 100 is in use here by another shell, and one command was
+	// already copied over by hand
+	if err := s.SaveCommand("vim", "100", "/", 0, ""); err != nil {
+		t.Fatalf("SaveCommand failed: %v", err)
+	}
+	if _, err := s.db.Exec("INSERT INTO commands (timestamp, command, session_id, uid, origin) VALUES ('2024-01-02 09:00:00', 'ls', '300', 'x', 'y')"); err != nil {
+		t.Fatal(err)
+	}
+
+	var progress []int
+	dry, err := s.MergeDatabase(oldPath, MergeOptions{DryRun: true, Progress: func(done, total int) {
+		progress = append(progress, done, total)
+	}})
+	if err != nil {
+		t.Fatalf("MergeDatabase failed: %v", err)
+	}
+	expected := MergeResult{Read: 5, Added: 3, Duplicates: 2, RemappedSessions: 1}
+	if *dry != expected {
+		t.Errorf("Expected %+v, got %+v", expected, *dry)
+	}
+	if len(progress) != 2 || progress[0] != 5 || progress[1] != 5 {
+		t.Errorf("Unexpected progress %v", progress)
+	}
+	if commands, _ := s.QueryCommands(Filter{Limit: 100}); len(commands) != 2 {
+		t.Fatalf("Dry run wrote to the database: %d commands", len(commands))
+	}
+
+	result, err := s.MergeDatabase(oldPath, MergeOptions{})
+	if err != nil {
+		t.Fatalf("MergeDatabase failed: %v", err)
+	}
+	if *result != expected {
+		t.Errorf("Expected %+v, got %+v", expected, *result)
+	}
+
+	merged, err := s.QueryCommands(Filter{Query: "git clone", Limit: 1})
+	if err != nil || len(merged) != 1 {
+		t.Fatalf("Expected the merged command, got %v (%v)", merged, err)
+	}
+	cmd := merged[0]
+	if !strings.HasPrefix(cmd.SessionID, "100-") || cmd.Timestamp != "2024-01-01T10:00:00Z" || cmd.UID == "" ||
+		cmd.Origin == "" || cmd.Origin == s.Origin() {
+		t.Errorf("Unexpected merged command %+v", cmd)
+	}
+	if others, _ := s.QueryCommands(Filter{Session: "200", Limit: 10}); len(others) != 1 {
+		t.Errorf("Expected session 200 to keep its ID, got %v", others)
+	}
+
+	// Merging again adds nothing
+	again, err := s.MergeDatabase(oldPath, MergeOptions{})
+	if err != nil {
+		t.Fatalf("MergeDatabase failed: %v", err)
+	}
+	if again.Added != 0 || again.Duplicates != 5 || again.RemappedSessions != 0 {
+		t.Errorf("Expected only duplicates, got %+v", again)
+	}
+}
+
+func TestMergeCurrentSchema(t *testing.T) {
+	dir := t.TempDir()
+	otherPath := filepath.Join(dir, "other.db")
+	other := openTestStore(t, otherPath)
+	if err := other.SaveEntry(Command{Command: "kubectl get pods", SessionID: "1", Hostname: "laptop",
+		Env: map[string]string{"KUBECONTEXT": "prod"}}); err != nil {
+		t.Fatalf("SaveEntry failed: %v", err)
+	}
+	if err := other.AddTags(1, "k8s"); err != nil {
+		t.Fatalf("AddTags failed: %v", err)
+	}
+	if err := other.SetNote(1, "check before deploys"); err != nil {
+		t.Fatalf("SetNote failed: %v", err)
+	}
+	source, err := other.GetCommand(1)
+	if err != nil {
+		t.Fatalf("GetCommand failed: %v", err)
+	}
+	if _, err := other.MergeDatabase(otherPath, MergeOptions{}); err == nil {
+		t.Error("Expected an error merging a database into itself")
+	}
+
+	other.Close()
+	s := openTestStore(t, filepath.Join(dir, "new.db"))
+	result, err := s.MergeDatabase(otherPath, MergeOptions{})
+	if err != nil {
+		t.Fatalf("MergeDatabase failed: %v", err)
+	}
+	if result.Added != 1 {
+		t.Fatalf("Expected 1 added, got %+v", result)
+	}
+	got, err := s.GetCommand(1)
+	if err != nil {
+		t.Fatalf("GetCommand failed: %v", err)
+	}
+	if got.UID != source.UID || got.Origin != source.Origin || got.Hostname != "laptop" ||
+		got.Env["KUBECONTEXT"] != "prod" || got.Note != "check before deploys" || len(got.Tags) != 1 {
+		t.Errorf("Merged command differs: %+v vs %+v", got, source)
+	}
+
+	if _, err := s.MergeDatabase(filepath.Join(dir, "missing.db"), MergeOptions{}); err == nil {
+		t.Error("Expected an error for a missing database")
+	}
+}
+
+func TestMergeEscapedPath(t *testing.T) {
+	dir := t.TempDir()
+	// Created under a plain name, since the driver would cut this one at '?'
+	plain := filepath.Join(dir, "old.db")
+	createOldDatabase(t, plain, [][3]string{{"2024-01-01 10:00:00", "make", "100"}})
+	// A decoy with the name the path would open if it were not escaped
+	createOldDatabase(t, filepath.Join(dir, "odd"), [][3]string{{"2024-01-01 10:00:00", "decoy", "100"}})
+	path := filepath.Join(dir, "odd?name#1%20.db")
+	if err := os.Rename(plain, path); err != nil {
+		t.Fatal(err)
+	}
+
+	s := openTestStore(t, filepath.Join(dir, "new.db"))
+	result, err := s.MergeDatabase(path, MergeOptions{})
+	if err != nil {
+		t.Fatalf("MergeDatabase failed: %v", err)
+	}
+	commands, _ := s.QueryCommands(Filter{Limit: 10})
+	if result.Added != 1 || len(commands) != 1 || commands[0].Command != "make" {
+		t.Errorf("Expected the command of %s, got %+v", path, commands)
+	}
+}
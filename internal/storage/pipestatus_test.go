@@ -0,0 +1,16 @@
+package storage
+
+import "testing"
+
+func TestParsePipeStatus(t *testing.T) {
+	statuses, err := ParsePipeStatus(" 0  141 2 ")
+	if err != nil || len(statuses) != 3 || statuses[1] != 141 {
+		t.Errorf("Expected [0 141 2], got %v (%v)", statuses, err)
+	}
+	if statuses, err := ParsePipeStatus(""); err != nil || statuses != nil {
+		t.Errorf("Expected no statuses, got %v (%v)", statuses, err)
+	}
+	if _, err := ParsePipeStatus("0 x"); err == nil {
+		t.Error("Expected an error for a status that is not a number")
+	}
+}
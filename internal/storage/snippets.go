@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Snippet is a named, reusable command with {{placeholder}} parameters
+type Snippet struct {
+	Name        string `json:"name"`
+	Command     string `json:"command"`
+	Description string `json:"description,omitempty"`
+	// SourceID is the history entry the snippet was saved from, if any
+	SourceID  int    `json:"source_id,omitempty"`
+	CreatedAt string `json:"created_at"`
+	UpdatedAt string `json:"updated_at"`
+}
+
+// snippetColumns is the select list matching scanSnippet
+const snippetColumns = `name, decrypt(command), COALESCE(decrypt(description), ''), COALESCE(source_id, 0), created_at, updated_at`
+
+// scanSnippet scans a row selected with snippetColumns
+func scanSnippet(row interface{ Scan(...any) error }) (Snippet, error) {
+	var s Snippet
+	err := row.Scan(&s.Name, &s.Command, &s.Description, &s.SourceID, &s.CreatedAt, &s.UpdatedAt)
+	return s, err
+}
+
+// SaveSnippet stores a snippet. An existing snippet with the same name is
+// only replaced when replace is set.
+func (s *Store) SaveSnippet(snippet Snippet, replace bool) error {
+	if s == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	if snippet.Name == "" || strings.ContainsFunc(snippet.Name, unicode.IsSpace) {
+		return fmt.Errorf("invalid snippet name %q: names cannot be empty or contain spaces", snippet.Name)
+	}
+	if strings.TrimSpace(snippet.Command) == "" {
+		return fmt.Errorf("snippet %q has no command", snippet.Name)
+	}
+
+	k, err := s.writeKeys()
+	if err != nil {
+		return err
+	}
+
+	var sourceID interface{}
+	if snippet.SourceID > 0 {
+		sourceID = snippet.SourceID
+	}
+	query := `INSERT INTO snippets (name, command, description, source_id) VALUES (?, ?, ?, ?)`
+	if replace {
+		query += ` ON CONFLICT (name) DO UPDATE SET command = excluded.command,
+			description = excluded.description, source_id = excluded.source_id,
+			updated_at = CURRENT_TIMESTAMP`
+	} else if _, err := s.GetSnippet(snippet.Name); err == nil {
+		return fmt.Errorf("snippet %q already exists", snippet.Name)
+	}
+
+	if _, err := s.db.Exec(query, snippet.Name, sealText(k, snippet.Command), sealText(k, snippet.Description), sourceID); err != nil {
+		return fmt.Errorf("failed to save snippet: %w", err)
+	}
+	return nil
+}
+
+// GetSnippet returns the snippet with the given name
+func (s *Store) GetSnippet(name string) (*Snippet, error) {
+	if s == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+
+	snippet, err := scanSnippet(s.db.QueryRow(`SELECT `+snippetColumns+` FROM snippets WHERE name = ?`, name))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("no snippet named %q", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get snippet: %w", err)
+	}
+	return &snippet, nil
+}
+
+// ListSnippets returns the snippets whose name, command or description
+// contains the query, in name order. An empty query lists them all.
+func (s *Store) ListSnippets(query string) ([]Snippet, error) {
+	if s == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+
+	pattern := "%" + escapeLike(query) + "%"
+	rows, err := s.db.Query(`
+		SELECT `+snippetColumns+`
+		FROM snippets
+		WHERE name LIKE ? ESCAPE '!' OR decrypt(command) LIKE ? ESCAPE '!' OR decrypt(description) LIKE ? ESCAPE '!'
+		ORDER BY name`, pattern, pattern, pattern)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snippets: %w", err)
+	}
+	defer rows.Close()
+
+	var snippets []Snippet
+	for rows.Next() {
+		snippet, err := scanSnippet(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan snippet: %w", err)
+		}
+		snippets = append(snippets, snippet)
+	}
+	return snippets, rows.Err()
+}
+
+// DeleteSnippet removes the snippet with the given name
+func (s *Store) DeleteSnippet(name string) error {
+	if s == nil {
+		return fmt.Errorf("database not initialized")
+	}
+
+	result, err := s.db.Exec(`DELETE FROM snippets WHERE name = ?`, name)
+	if err != nil {
+		return fmt.Errorf("failed to delete snippet: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("no snippet named %q", name)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+//go:build cgo
+
+package storage
+
+import "testing"
+
+func TestSnippets(t *testing.T) {
+	s := openTestStore(t, ":memory:")
+
+	deploy := Snippet{Name: "deploy", Command: "kubectl rollout restart deploy/{{app}}", Description: "Restart an app", SourceID: 7}
+	if err := s.SaveSnippet(deploy, false); err != nil {
+		t.Fatalf("SaveSnippet failed: %v", err)
+	}
+	if err := s.SaveSnippet(Snippet{Name: "logs", Command: "docker logs -f {{container}}"}, false); err != nil {
+		t.Fatalf("SaveSnippet failed: %v", err)
+	}
+	if err := s.SaveSnippet(Snippet{Name: "deploy", Command: "other"}, false); err == nil {
+		t.Error("Expected an error when saving over an existing snippet")
+	}
+
+	if err := s.SaveSnippet(Snippet{Name: "two words", Command: "ls"}, false); err == nil {
+		t.Error("Expected an error for a name with a space")
+	}
+
+	snippet, err := s.GetSnippet("deploy")
+	if err != nil {
+		t.Fatalf("GetSnippet failed: %v", err)
+	}
+	if snippet.Command != deploy.Command || snippet.Description != "Restart an app" || snippet.SourceID != 7 {
+		t.Errorf("Unexpected snippet: %+v", snippet)
+	}
+
+	deploy.Command = "kubectl -n {{namespace}} rollout restart deploy/{{app}}"
+	if err := s.SaveSnippet(deploy, true); err != nil {
+		t.Fatalf("Replacing the snippet failed: %v", err)
+	}
+
+	snippets, err := s.ListSnippets("namespace")
+	if err != nil {
+		t.Fatalf("ListSnippets failed: %v", err)
+	}
+	if len(snippets) != 1 || snippets[0].Name != "deploy" {
+		t.Errorf("Expected the replaced deploy snippet, got %v", snippets)
+	}
+	snippets, err = s.ListSnippets("")
+	if err != nil {
+		t.Fatalf("ListSnippets failed: %v", err)
+	}
+	if len(snippets) != 2 || snippets[0].Name != "deploy" || snippets[1].Name != "logs" {
+		t.Errorf("Expected both snippets in name order, got %v", snippets)
+	}
+
+	if err := s.DeleteSnippet("logs"); err != nil {
+		t.Fatalf("DeleteSnippet failed: %v", err)
+	}
+	if err := s.DeleteSnippet("logs"); err == nil {
+		t.Error("Expected an error deleting a missing snippet")
+	}
+	if _, err := s.GetSnippet("logs"); err == nil {
+		t.Error("Expected an error getting a deleted snippet")
+	}
+}
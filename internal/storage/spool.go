@@ -0,0 +1,236 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/khelechy/consolidate/internal/ulid"
+)
+
+// staleClaim is how long a spooled command may stay claimed before another
+// drain takes it over from a process that died while saving it
+const staleClaim = time.Minute
+
+// claimSuffix marks a spooled command that a drain is saving
+const claimSuffix = ".saving"
+
+// quarantineDir is where Drain moves spooled commands that can never be
+// saved, inside the spool
+const quarantineDir = "quarantine"
+
+// Suffixes of spooled commands, kept as JSON or sealed with the key of an
+// encrypted database
+const (
+	plainSuffix  = ".json"
+	sealedSuffix = ".sealed"
+)
+
+// Spool keeps commands that could not be saved because the database was
+// busy, one file each, until a later drain saves them. Several processes
+// may add and drain at the same time.
+type Spool struct {
+	dir string
+	// keys seal the commands of an encrypted database; nil keeps them as
+	// plain JSON
+	keys *keys
+}
+
+// QuarantineError is returned by Drain when it moved spooled commands that
+// can never be saved, such as damaged files or commands the database
+// rejects, to the quarantine directory of the spool instead of retrying
+// them on every drain. Only the drain that moves them reports them.
+type QuarantineError struct {
+	// Dir is the quarantine directory, which keeps the commands
+	Dir string
+	// Problems tells why each command could not be saved
+	Problems []error
+	// Err is the error the drain stopped on, if any
+	Err error
+}
+
+func (e *QuarantineError) Error() string {
+	problems := make([]string, len(e.Problems))
+	for i, problem := range e.Problems {
+		problems[i] = problem.Error()
+	}
+	return fmt.Sprintf("moved %d spooled command(s) that cannot be saved to %s: %s", len(e.Problems), e.Dir, strings.Join(problems, "; "))
+}
+
+func (e *QuarantineError) Unwrap() error {
+	return e.Err
+}
+
+// NewSpool returns the spool kept in dir, which is created on the first
+// Add, for a database that is not encrypted
+func NewSpool(dir string) *Spool {
+	return &Spool{dir: dir}
+}
+
+// Spool returns the spool kept in dir for the store. If the database is
+// encrypted, spooled commands are sealed with its key rather than left on
+// disk in plaintext, and it must be unlocked.
+func (s *Store) Spool(dir string) (*Spool, error) {
+	k, err := s.writeKeys()
+	if err != nil {
+		return nil, err
+	}
+	return &Spool{dir: dir, keys: k}, nil
+}
+
+// Add spools a command, stamping it with a UID and with the current time
+// unless they are set. The UID keeps a drain that dies after saving the
+// command from saving it again, and the time keeps its place in the history.
+func (sp *Spool) Add(cmd Command) error {
+	now := time.Now()
+	if cmd.UID == "" {
+		cmd.UID = ulid.New(now)
+	}
+	if cmd.Timestamp == "" {
+		cmd.Timestamp = now.UTC().Format(time.RFC3339)
+	}
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	suffix := plainSuffix
+	if sp.keys != nil {
+		data = sp.keys.seal(string(data))
+		suffix = sealedSuffix
+	}
+	if err := os.MkdirAll(sp.dir, 0700); err != nil {
+		return err
+	}
+
+	// Write under a temporary name so a drain never reads a partial file
+	tmp, err := os.CreateTemp(sp.dir, ".spool-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	// Names sort in time order, so commands are drained in the order they
+	// ran; the UID keeps names of commands spooled at once apart
+	name := fmt.Sprintf("%019d-%s%s", now.UnixNano(), cmd.UID, suffix)
+	return os.Rename(tmp.Name(), filepath.Join(sp.dir, name))
+}
+
+// Drain saves the spooled commands, oldest first, and returns how many were
+// saved. It stops at the first command save fails on because the database
+// is busy or ctx is done, leaving it and the rest for a later drain; a
+// command that fails otherwise, or cannot be read, is quarantined and the
+// drain goes on. Commands keep the UID given by Add, and save must skip
+// UIDs it already has, so that a drain dying between saving a command and
+// removing its file does not duplicate it. Sealed commands are left for a
+// spool with the key to drain.
+func (sp *Spool) Drain(ctx context.Context, save func(context.Context, Command) error) (int, error) {
+	entries, err := os.ReadDir(sp.dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		base := strings.TrimSuffix(name, claimSuffix)
+		switch {
+		case strings.HasSuffix(base, sealedSuffix) && sp.keys == nil:
+			continue
+		case !strings.HasSuffix(base, plainSuffix) && !strings.HasSuffix(base, sealedSuffix):
+			continue
+		}
+		if name == base {
+			names = append(names, name)
+		} else if info, err := entry.Info(); err == nil && time.Since(info.ModTime()) > staleClaim {
+			// Release the claim, so it is taken again below
+			os.Rename(filepath.Join(sp.dir, name), filepath.Join(sp.dir, base))
+			names = append(names, base)
+		}
+	}
+	slices.Sort(names)
+
+	saved := 0
+	var quarantined []error
+	// done reports the commands quarantined along with the error the drain
+	// stopped on
+	done := func(err error) (int, error) {
+		if len(quarantined) == 0 {
+			return saved, err
+		}
+		return saved, &QuarantineError{Dir: filepath.Join(sp.dir, quarantineDir), Problems: quarantined, Err: err}
+	}
+	for _, name := range names {
+		path := filepath.Join(sp.dir, name)
+		claimed := path + claimSuffix
+		// Renaming claims the command; it fails if another drain took it first
+		if err := os.Rename(path, claimed); err != nil {
+			continue
+		}
+		// Renaming keeps the modification time, which tells stale claims apart
+		now := time.Now()
+		os.Chtimes(claimed, now, now)
+
+		data, err := os.ReadFile(claimed)
+		if err != nil {
+			os.Rename(claimed, path)
+			return done(err)
+		}
+		if strings.HasSuffix(name, sealedSuffix) {
+			plain, err := sp.keys.open(data)
+			if err != nil {
+				// Sealed with another key
+				quarantined = append(quarantined, sp.quarantine(claimed, name, err))
+				continue
+			}
+			data = []byte(plain)
+		}
+		var cmd Command
+		if err := json.Unmarshal(data, &cmd); err != nil {
+			quarantined = append(quarantined, sp.quarantine(claimed, name, err))
+			continue
+		}
+		if err := save(ctx, cmd); IsBusy(err) || ctx.Err() != nil {
+			os.Rename(claimed, path)
+			return done(err)
+		} else if err != nil {
+			quarantined = append(quarantined, sp.quarantine(claimed, name, err))
+			continue
+		}
+		os.Remove(claimed)
+		saved++
+	}
+	return done(nil)
+}
+
+// quarantine moves the claimed command that failed with err out of the
+// way of later drains, and returns the problem to report. If it cannot be
+// moved, it is put back to be tried again.
+func (sp *Spool) quarantine(claimed, name string, err error) error {
+	dir := filepath.Join(sp.dir, quarantineDir)
+	moveErr := os.MkdirAll(dir, 0700)
+	if moveErr == nil {
+		moveErr = os.Rename(claimed, filepath.Join(dir, name))
+	}
+	if moveErr != nil {
+		os.Rename(claimed, filepath.Join(sp.dir, name))
+		return fmt.Errorf("%s: %w (left in the spool: %v)", name, err, moveErr)
+	}
+	return fmt.Errorf("%s: %w", name, err)
+}
@@ -0,0 +1,64 @@
+//go:build cgo
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSpoolSealed(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "history.db")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer s.Close()
+	settings, _ := NewEncryptionSettings(KDFKeyFile)
+	if err := s.EncryptDatabase(settings, bytes.Repeat([]byte{7}, KeySize)); err != nil {
+		t.Fatalf("EncryptDatabase failed: %v", err)
+	}
+
+	dir := t.TempDir()
+	spool, err := s.Spool(dir)
+	if err != nil {
+		t.Fatalf("Spool failed: %v", err)
+	}
+	if err := spool.Add(Command{Command: "vault login -token=s3cret"}); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Fatalf("Expected one spooled command, got %d", len(entries))
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, entries[0].Name()))
+	if bytes.Contains(data, []byte("s3cret")) {
+		t.Error("Expected the spooled command to be sealed")
+	}
+
+	// Without the key the command is left alone
+	if n, err := NewSpool(dir).Drain(ctx, s.SaveEntryContext); n != 0 || err != nil {
+		t.Errorf("Expected nothing drained without the key, got %d (%v)", n, err)
+	}
+	if n, err := spool.Drain(ctx, s.SaveEntryContext); n != 1 || err != nil {
+		t.Fatalf("Expected the command drained, got %d (%v)", n, err)
+	}
+	commands, err := s.QueryCommandsContext(ctx, Filter{Limit: 10})
+	if err != nil || len(commands) != 1 || commands[0].Command != "vault login -token=s3cret" {
+		t.Errorf("Expected the spooled command, got %+v (%v)", commands, err)
+	}
+
+	// A locked database cannot spool
+	locked, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer locked.Close()
+	if _, err := locked.Spool(dir); err == nil {
+		t.Error("Expected an error spooling for a locked database")
+	}
+}
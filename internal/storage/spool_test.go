@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	berrors "go.etcd.io/bbolt/errors"
+)
+
+func TestSpool(t *testing.T) {
+	ctx := context.Background()
+	dir := filepath.Join(t.TempDir(), "spool")
+	spool := NewSpool(dir)
+	if n, err := spool.Drain(ctx, nil); n != 0 || err != nil {
+		t.Errorf("Expected an empty spool before the first Add, got %d (%v)", n, err)
+	}
+
+	if err := spool.Add(Command{Command: "make", Timestamp: "2024-05-01T10:00:00Z"}); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if err := spool.Add(Command{Command: "make test"}); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+
+	// A busy database leaves the command spooled
+	if n, err := spool.Drain(ctx, func(context.Context, Command) error {
+		return berrors.ErrTimeout
+	}); n != 0 || !IsBusy(err) {
+		t.Errorf("Expected the failed save to stop the drain, got %d (%v)", n, err)
+	}
+
+	b, err := OpenBolt(filepath.Join(t.TempDir(), "history.bolt"))
+	if err != nil {
+		t.Fatalf("OpenBolt failed: %v", err)
+	}
+	defer b.Close()
+	if n, err := spool.Drain(ctx, b.Save); n != 2 || err != nil {
+		t.Fatalf("Expected 2 commands drained, got %d (%v)", n, err)
+	}
+	if n, _ := spool.Drain(ctx, b.Save); n != 0 {
+		t.Errorf("Expected the spool empty after draining, got %d more", n)
+	}
+
+	commands, _ := b.Query(ctx, Filter{Limit: 10, Reverse: true})
+	if len(commands) != 2 || commands[0].Command != "make" || commands[0].Timestamp != "2024-05-01T10:00:00Z" ||
+		commands[1].Command != "make test" {
+		t.Errorf("Expected both commands in order with their timestamps, got %+v", commands)
+	}
+}
+
+func TestSpoolSavesOnce(t *testing.T) {
+	ctx := context.Background()
+	spool := NewSpool(t.TempDir())
+	if err := spool.Add(Command{Command: "make"}); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	b, err := OpenBolt(filepath.Join(t.TempDir(), "history.bolt"))
+	if err != nil {
+		t.Fatalf("OpenBolt failed: %v", err)
+	}
+	defer b.Close()
+
+	// The drain dies after saving the command but before removing its file
+	if _, err := spool.Drain(ctx, func(ctx context.Context, cmd Command) error {
+		if err := b.Save(ctx, cmd); err != nil {
+			return err
+		}
+		return berrors.ErrTimeout
+	}); err == nil {
+		t.Fatal("Expected the drain to fail")
+	}
+	if _, err := spool.Drain(ctx, b.Save); err != nil {
+		t.Fatalf("Drain failed: %v", err)
+	}
+	if commands, _ := b.Query(ctx, Filter{Limit: 10}); len(commands) != 1 {
+		t.Errorf("Expected the command saved once, got %+v", commands)
+	}
+}
+
+func TestSpoolQuarantine(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	spool := NewSpool(dir)
+	for _, c := range []string{"make", "rejected", "make test"} {
+		if err := spool.Add(Command{Command: c}); err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "0-damaged.json"), []byte("{"), 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	var saved []string
+	save := func(_ context.Context, cmd Command) error {
+		if cmd.Command == "rejected" {
+			return errors.New("constraint failed")
+		}
+		saved = append(saved, cmd.Command)
+		return nil
+	}
+	n, err := spool.Drain(ctx, save)
+	var quarantined *QuarantineError
+	if !errors.As(err, &quarantined) || len(quarantined.Problems) != 2 || quarantined.Err != nil {
+		t.Fatalf("Expected the damaged and rejected commands quarantined, got %v", err)
+	}
+	if n != 2 || len(saved) != 2 || saved[0] != "make" || saved[1] != "make test" {
+		t.Errorf("Expected the other commands saved in order, got %d %q", n, saved)
+	}
+	if entries, _ := os.ReadDir(quarantined.Dir); len(entries) != 2 {
+		t.Errorf("Expected 2 files in quarantine, got %d", len(entries))
+	}
+
+	// Quarantined commands are reported once
+	if n, err := spool.Drain(ctx, save); n != 0 || err != nil {
+		t.Errorf("Expected nothing more to drain, got %d (%v)", n, err)
+	}
+}
+
+func TestSpoolStaleClaim(t *testing.T) {
+	dir := t.TempDir()
+	spool := NewSpool(dir)
+	if err := spool.Add(Command{Command: "ls"}); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	entries, _ := os.ReadDir(dir)
+	path := filepath.Join(dir, entries[0].Name())
+	// A drain claimed the command, then died
+	claimed := path + claimSuffix
+	os.Rename(path, claimed)
+
+	count := func() int {
+		n, _ := spool.Drain(context.Background(), func(context.Context, Command) error { return nil })
+		return n
+	}
+	if n := count(); n != 0 {
+		t.Errorf("Expected a fresh claim to be left alone, got %d drained", n)
+	}
+	old := time.Now().Add(-2 * staleClaim)
+	os.Chtimes(claimed, old, old)
+	if n := count(); n != 1 {
+		t.Errorf("Expected the stale claim to be drained, got %d", n)
+	}
+}
@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+)
+
+// topCount is the number of commands and directories listed in HistoryStats
+const topCount = 10
+
+// DayCount is the number of commands run on a day
+type DayCount struct {
+	// Day is the date in UTC, as YYYY-MM-DD
+	Day   string `json:"day"`
+	Count int    `json:"count"`
+}
+
+// DirCount is the number of commands run in a directory
+type DirCount struct {
+	Dir   string `json:"dir"`
+	Count int    `json:"count"`
+}
+
+// HistoryStats summarizes the commands matching a filter
+type HistoryStats struct {
+	Commands int `json:"commands"`
+	// Unique counts the distinct normalized commands
+	Unique int `json:"unique"`
+	// Failed counts the commands that failed in any pipeline stage
+	Failed   int `json:"failed"`
+	Sessions int `json:"sessions"`
+	Hosts    int `json:"hosts"`
+	// First and Last are the timestamps of the oldest and newest command
+	First string `json:"first,omitempty"`
+	Last  string `json:"last,omitempty"`
+	// PerDay counts the commands of every day that has any, oldest first
+	PerDay []DayCount `json:"per_day"`
+	// PerHour counts the commands by hour of the day, in UTC
+	PerHour [24]int `json:"per_hour"`
+	// TopCommands are the most often run commands
+	TopCommands []CommandSummary `json:"top_commands"`
+	// TopDirs are the directories most commands were run in
+	TopDirs []DirCount `json:"top_dirs"`
+}
+
+// Stats summarizes the commands matching the filter. Its Limit, Offset and
+// ordering are ignored.
+func (s *Store) Stats(f Filter) (*HistoryStats, error) {
+	return s.StatsContext(context.Background(), f)
+}
+
+// StatsContext is Stats with a context
+func (s *Store) StatsContext(ctx context.Context, f Filter) (*HistoryStats, error) {
+	if s == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+
+	where, args := f.where()
+	stats := &HistoryStats{PerDay: []DayCount{}, TopDirs: []DirCount{}}
+	var first, last *string
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COUNT(*), COUNT(DISTINCT normalized),
+			COALESCE(SUM(exit_code != 0 OR REPLACE(REPLACE(COALESCE(pipestatus, ''), '0', ''), ' ', '') != ''), 0),
+			COUNT(DISTINCT session_id), COUNT(DISTINCT hostname),
+			strftime('%Y-%m-%dT%H:%M:%SZ', MIN(timestamp)), strftime('%Y-%m-%dT%H:%M:%SZ', MAX(timestamp))
+		FROM commands `+where, args...).Scan(&stats.Commands, &stats.Unique, &stats.Failed, &stats.Sessions,
+		&stats.Hosts, &first, &last)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count commands: %w", err)
+	}
+	if first != nil {
+		stats.First, stats.Last = *first, *last
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT date(timestamp), COUNT(*) FROM commands `+where+`
+		GROUP BY date(timestamp) ORDER BY date(timestamp)`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count commands per day: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var day DayCount
+		if err := rows.Scan(&day.Day, &day.Count); err != nil {
+			return nil, fmt.Errorf("failed to count commands per day: %w", err)
+		}
+		stats.PerDay = append(stats.PerDay, day)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	hours, err := s.db.QueryContext(ctx, `SELECT CAST(strftime('%H', timestamp) AS INTEGER), COUNT(*) FROM commands `+where+`
+		GROUP BY 1`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count commands per hour: %w", err)
+	}
+	defer hours.Close()
+	for hours.Next() {
+		var hour, count int
+		if err := hours.Scan(&hour, &count); err != nil {
+			return nil, fmt.Errorf("failed to count commands per hour: %w", err)
+		}
+		if hour >= 0 && hour < 24 {
+			stats.PerHour[hour] = count
+		}
+	}
+	if err := hours.Err(); err != nil {
+		return nil, err
+	}
+
+	dirs, err := s.db.QueryContext(ctx, `SELECT COALESCE(decrypt(cwd), '') AS dir, COUNT(*) AS count FROM commands `+where+`
+		GROUP BY dir ORDER BY count DESC, dir LIMIT ?`, append(args, topCount)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count directories: %w", err)
+	}
+	defer dirs.Close()
+	for dirs.Next() {
+		var dir DirCount
+		if err := dirs.Scan(&dir.Dir, &dir.Count); err != nil {
+			return nil, fmt.Errorf("failed to count directories: %w", err)
+		}
+		stats.TopDirs = append(stats.TopDirs, dir)
+	}
+	if err := dirs.Err(); err != nil {
+		return nil, err
+	}
+
+	f.Limit, f.Offset = topCount, 0
+	stats.TopCommands, err = s.summarize(ctx, f, "g.count DESC, g.last_id DESC")
+	if err != nil {
+		return nil, err
+	}
+	if stats.TopCommands == nil {
+		stats.TopCommands = []CommandSummary{}
+	}
+	return stats, nil
+}
@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// frecencyWeight scores a single run of a command by its age: recent runs
+// count for more, and old runs never drop to zero
+const frecencyWeight = `CASE
+		WHEN julianday('now') - julianday(timestamp) < 1.0 / 24 THEN 4.0
+		WHEN julianday('now') - julianday(timestamp) < 1 THEN 2.0
+		WHEN julianday('now') - julianday(timestamp) < 7 THEN 1.0
+		WHEN julianday('now') - julianday(timestamp) < 30 THEN 0.5
+		ELSE 0.25
+	END`
+
+// CommandSummary aggregates every run of the same normalized command text
+type CommandSummary struct {
+	// Command is the text of the most recent run
+	Command      string   `json:"command"`
+	Count        int      `json:"count"`
+	FirstSeen    string   `json:"first_seen"`
+	LastSeen     string   `json:"last_seen"`
+	LastExitCode int      `json:"last_exit_code"`
+	Dirs         []string `json:"dirs"`
+	Score        float64  `json:"score"`
+}
+
+// UniqueCommands returns the distinct commands matching the filter, most
+// recently used first, or least recently used first when f.Reverse is set
+func (s *Store) UniqueCommands(f Filter) ([]CommandSummary, error) {
+	return s.UniqueCommandsContext(context.Background(), f)
+}
+
+// UniqueCommandsContext is UniqueCommands with a context
+func (s *Store) UniqueCommandsContext(ctx context.Context, f Filter) ([]CommandSummary, error) {
+	if f.Reverse {
+		return s.summarize(ctx, f, "g.last_id ASC")
+	}
+	return s.summarize(ctx, f, "g.last_id DESC")
+}
+
+// FrecentCommands returns the distinct commands matching the filter, ranked
+// by frecency: how often they were run, weighted by how recently
+func (s *Store) FrecentCommands(f Filter) ([]CommandSummary, error) {
+	return s.FrecentCommandsContext(context.Background(), f)
+}
+
+// FrecentCommandsContext is FrecentCommands with a context
+func (s *Store) FrecentCommandsContext(ctx context.Context, f Filter) ([]CommandSummary, error) {
+	return s.summarize(ctx, f, "g.score DESC, g.last_id DESC")
+}
+
+// summarize groups the commands matching the filter by their normalized
+// text. The grouping happens in SQL so it stays fast on large histories; the
+// latest run of each group is joined back in for its text and exit code.
+func (s *Store) summarize(ctx context.Context, f Filter, orderBy string) ([]CommandSummary, error) {
+	if s == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+
+	where, args := f.where()
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT decrypt(latest.command), g.count, g.first_seen, g.last_seen, COALESCE(latest.exit_code, 0), g.dirs, g.score
+		FROM (
+			SELECT
+				MAX(id) AS last_id,
+				COUNT(*) AS count,
+				strftime('%Y-%m-%dT%H:%M:%SZ', MIN(timestamp)) AS first_seen,
+				strftime('%Y-%m-%dT%H:%M:%SZ', MAX(timestamp)) AS last_seen,
+				json_group_array(DISTINCT COALESCE(decrypt(cwd), '')) AS dirs,
+				SUM(`+frecencyWeight+`) AS score
+			FROM commands
+			`+where+`
+			GROUP BY normalized
+		) AS g
+		JOIN commands AS latest ON latest.id = g.last_id
+		ORDER BY `+orderBy+`
+		LIMIT ? OFFSET ?
+	`, append(args, f.Limit, f.Offset)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to summarize commands: %w", err)
+	}
+	defer rows.Close()
+
+	var summaries []CommandSummary
+	for rows.Next() {
+		var summary CommandSummary
+		var dirs string
+		if err := rows.Scan(&summary.Command, &summary.Count, &summary.FirstSeen, &summary.LastSeen,
+			&summary.LastExitCode, &dirs, &summary.Score); err != nil {
+			return nil, fmt.Errorf("failed to scan command summary: %w", err)
+		}
+		if err := json.Unmarshal([]byte(dirs), &summary.Dirs); err != nil {
+			return nil, fmt.Errorf("failed to decode directories: %w", err)
+		}
+		summaries = append(summaries, summary)
+	}
+
+	return summaries, rows.Err()
+}
+
+// SessionSummary describes the commands of one shell session on one host
+type SessionSummary struct {
+	SessionID string `json:"session_id"`
+	Hostname  string `json:"hostname"`
+	Username  string `json:"username"`
+	Commands  int    `json:"commands"`
+	Failed    int    `json:"failed"`
+	// First and Last are the timestamps of the first and last command
+	First string `json:"first"`
+	Last  string `json:"last"`
+	// LastCommand is the text of the last command
+	LastCommand string `json:"last_command"`
+}
+
+// Sessions returns the sessions with commands matching the filter, most
+// recently active first. Shells on different hosts can reuse a session ID,
+// so a session is told apart by its host too.
+func (s *Store) Sessions(f Filter) ([]SessionSummary, error) {
+	if s == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+
+	where, args := f.where()
+	rows, err := s.db.Query(`
+		SELECT g.session_id, g.hostname, COALESCE(latest.username, ''), g.count, g.failed, g.first, g.last,
+			decrypt(latest.command)
+		FROM (
+			SELECT
+				COALESCE(session_id, '') AS session_id,
+				COALESCE(hostname, '') AS hostname,
+				MAX(id) AS last_id,
+				COUNT(*) AS count,
+				SUM(exit_code != 0 OR REPLACE(REPLACE(COALESCE(pipestatus, ''), '0', ''), ' ', '') != '') AS failed,
+				strftime('%Y-%m-%dT%H:%M:%SZ', MIN(timestamp)) AS first,
+				strftime('%Y-%m-%dT%H:%M:%SZ', MAX(timestamp)) AS last
+			FROM commands
+			`+where+`
+			GROUP BY 1, 2
+		) AS g
+		JOIN commands AS latest ON latest.id = g.last_id
+		ORDER BY g.last_id DESC
+		LIMIT ? OFFSET ?
+	`, append(args, f.Limit, f.Offset)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+	defer rows.Close()
+
+	var sessions []SessionSummary
+	for rows.Next() {
+		var session SessionSummary
+		if err := rows.Scan(&session.SessionID, &session.Hostname, &session.Username, &session.Commands,
+			&session.Failed, &session.First, &session.Last, &session.LastCommand); err != nil {
+			return nil, fmt.Errorf("failed to scan session: %w", err)
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
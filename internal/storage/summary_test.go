@@ -0,0 +1,208 @@
+//go:build cgo
+
+package storage
+
+import (
+	"testing"
+)
+
+func TestFrecentCommands(t *testing.T) {
+	s := openTestStore(t, ":memory:")
+
+	// "make" ran three times a long time ago, "go test" twice just now
+	for _, e := range []Command{
+		{Command: "make", CWD: "/proj"},
+		{Command: "make", CWD: "/proj"},
+		{Command: "make", CWD: "/proj"},
+		{Command: "go test", CWD: "/proj"},
+		{Command: "go test", CWD: "/proj/sub"},
+		{Command: "ls", CWD: "/elsewhere"},
+		{Command: "ls", CWD: "/project"},
+	} {
+		if err := s.SaveEntry(e); err != nil {
+			t.Fatalf("SaveEntry failed: %v", err)
+		}
+	}
+	if _, err := s.db.Exec("UPDATE commands SET timestamp = datetime('now', '-90 days') WHERE command = 'make'"); err != nil {
+		t.Fatalf("Ageing commands failed: %v", err)
+	}
+
+	summaries, err := s.FrecentCommands(Filter{Limit: 10, Dir: "/proj", Subtree: true})
+	if err != nil {
+		t.Fatalf("FrecentCommands failed: %v", err)
+	}
+	if len(summaries) != 2 {
+		t.Fatalf("Expected 2 commands under /proj, got %d: %v", len(summaries), summaries)
+	}
+	if summaries[0].Command != "go test" || summaries[0].Count != 2 {
+		t.Errorf("Expected recent 'go test' first, got %+v", summaries[0])
+	}
+	if summaries[1].Command != "make" || summaries[1].Count != 3 {
+		t.Errorf("Expected 'make' second, got %+v", summaries[1])
+	}
+
+	// Without the subtree only /proj itself counts
+	summaries, err = s.FrecentCommands(Filter{Limit: 10, Dir: "/proj"})
+	if err != nil {
+		t.Fatalf("FrecentCommands failed: %v", err)
+	}
+	if len(summaries) != 2 || summaries[0].Count != 1 {
+		t.Errorf("Unexpected summaries for /proj: %v", summaries)
+	}
+}
+
+func TestQueryCommandsFrecency(t *testing.T) {
+	s := openTestStore(t, ":memory:")
+
+	for _, c := range []string{"vim main.go", "go build", "go build", "vim main.go", "go build"} {
+		if err := s.SaveEntry(Command{Command: c, CWD: "/proj"}); err != nil {
+			t.Fatalf("SaveEntry failed: %v", err)
+		}
+	}
+
+	results, err := s.QueryCommands(Filter{Limit: 10, Dir: "/proj", Frecency: true})
+	if err != nil {
+		t.Fatalf("QueryCommands failed: %v", err)
+	}
+	if len(results) != 5 {
+		t.Fatalf("Expected 5 results, got %d", len(results))
+	}
+	if results[0].Command != "go build" || results[2].Command != "go build" || results[3].Command != "vim main.go" {
+		t.Errorf("Results not ranked by frecency: %v", results)
+	}
+	if results[0].ID < results[1].ID {
+		t.Errorf("Ties should be broken newest first: %v", results)
+	}
+}
+
+func TestUniqueCommands(t *testing.T) {
+	s := openTestStore(t, ":memory:")
+
+	for _, e := range []Command{
+		{Command: "git status", CWD: "/a", ExitCode: 0},
+		{Command: "ls", CWD: "/a", ExitCode: 0},
+		{Command: "git  status ", CWD: "/b", ExitCode: 128},
+		{Command: "git status", CWD: "/a", ExitCode: 0},
+		{Command: "git statuses", CWD: "/a", ExitCode: 1},
+	} {
+		if err := s.SaveEntry(e); err != nil {
+			t.Fatalf("SaveEntry failed: %v", err)
+		}
+	}
+
+	summaries, err := s.UniqueCommands(Filter{Query: "git", Limit: 10})
+	if err != nil {
+		t.Fatalf("UniqueCommands failed: %v", err)
+	}
+	if len(summaries) != 2 {
+		t.Fatalf("Expected 2 distinct git commands, got %d: %+v", len(summaries), summaries)
+	}
+
+	// Most recently used first
+	if summaries[0].Command != "git statuses" {
+		t.Errorf("Expected 'git statuses' first, got %+v", summaries[0])
+	}
+	status := summaries[1]
+	if status.Command != "git status" || status.Count != 3 {
+		t.Errorf("Expected 3 runs of 'git status', got %+v", status)
+	}
+	if status.LastExitCode != 0 {
+		t.Errorf("Expected last exit code 0, got %d", status.LastExitCode)
+	}
+	if len(status.Dirs) != 2 {
+		t.Errorf("Expected 2 directories, got %v", status.Dirs)
+	}
+	if status.FirstSeen == "" || status.LastSeen == "" {
+		t.Errorf("Expected first and last seen times, got %+v", status)
+	}
+}
+
+func TestStats(t *testing.T) {
+	s, err := Open(":memory:")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer s.Close()
+
+	if stats, err := s.Stats(Filter{}); err != nil || stats.Commands != 0 || stats.First != "" {
+		t.Fatalf("Expected empty stats, got %+v (%v)", stats, err)
+	}
+
+	for _, e := range []Command{
+		{Command: "make", CWD: "/proj", SessionID: "1", Hostname: "a"},
+		{Command: "make", CWD: "/proj", SessionID: "1", Hostname: "a", ExitCode: 2},
+		{Command: "ls | grep x", CWD: "/tmp", SessionID: "2", Hostname: "b", PipeStatus: []int{0, 1}},
+		{Command: "ls", CWD: "/proj", SessionID: "2", Hostname: "b"},
+	} {
+		if err := s.SaveEntry(e); err != nil {
+			t.Fatalf("SaveEntry failed: %v", err)
+		}
+	}
+	if _, err := s.db.Exec("UPDATE commands SET timestamp = '2024-03-01 09:30:00' WHERE id = 1"); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := s.Stats(Filter{})
+	if err != nil {
+		t.Fatalf("Stats failed: %v", err)
+	}
+	if stats.Commands != 4 || stats.Unique != 3 || stats.Failed != 2 || stats.Sessions != 2 || stats.Hosts != 2 {
+		t.Errorf("Unexpected counts %+v", stats)
+	}
+	if stats.First != "2024-03-01T09:30:00Z" || len(stats.PerDay) != 2 || stats.PerDay[0] != (DayCount{"2024-03-01", 1}) {
+		t.Errorf("Unexpected days %q %v", stats.First, stats.PerDay)
+	}
+	if stats.PerHour[9] != 1 {
+		t.Errorf("Expected one command at 9, got %v", stats.PerHour)
+	}
+	if len(stats.TopCommands) != 3 || stats.TopCommands[0].Command != "make" || stats.TopCommands[0].Count != 2 {
+		t.Errorf("Unexpected top commands %+v", stats.TopCommands)
+	}
+	if len(stats.TopDirs) != 2 || stats.TopDirs[0] != (DirCount{"/proj", 3}) {
+		t.Errorf("Unexpected top directories %v", stats.TopDirs)
+	}
+
+	failed, err := s.Stats(Filter{Failed: true})
+	if err != nil || failed.Commands != 2 {
+		t.Errorf("Expected 2 failed commands, got %+v (%v)", failed, err)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	s, err := Open(":memory:")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer s.Close()
+
+	for _, e := range []Command{
+		{Command: "cd proj", SessionID: "100", Hostname: "laptop", Username: "ann"},
+		{Command: "make", SessionID: "100", Hostname: "server", Username: "ops", ExitCode: 1},
+		{Command: "make", SessionID: "100", Hostname: "laptop", Username: "ann", ExitCode: 2},
+		{Command: "ls", SessionID: "200", Hostname: "laptop", Username: "ann"},
+	} {
+		if err := s.SaveEntry(e); err != nil {
+			t.Fatalf("SaveEntry failed: %v", err)
+		}
+	}
+
+	sessions, err := s.Sessions(Filter{Limit: 10})
+	if err != nil {
+		t.Fatalf("Sessions failed: %v", err)
+	}
+	if len(sessions) != 3 {
+		t.Fatalf("Expected 3 sessions, got %+v", sessions)
+	}
+	if sessions[0].SessionID != "200" || sessions[0].LastCommand != "ls" {
+		t.Errorf("Expected the latest session first, got %+v", sessions[0])
+	}
+	if got := sessions[1]; got.SessionID != "100" || got.Hostname != "laptop" || got.Commands != 2 ||
+		got.Failed != 1 || got.Username != "ann" || got.LastCommand != "make" {
+		t.Errorf("Unexpected session %+v", got)
+	}
+
+	failed, err := s.Sessions(Filter{Limit: 10, Failed: true, Host: "server"})
+	if err != nil || len(failed) != 1 || failed[0].Username != "ops" {
+		t.Errorf("Expected the failed session on server, got %+v (%v)", failed, err)
+	}
+}
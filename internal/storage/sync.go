@@ -0,0 +1,377 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/khelechy/consolidate/internal/ulid"
+)
+
+// loadOrigin reads the origin of a newly opened database, creating it if
+// the database has none yet
+func (s *Store) loadOrigin() error {
+	var value string
+	found, err := getSetting(s.db, "origin", &value)
+	if err != nil {
+		return err
+	}
+	if !found {
+		value = ulid.New(time.Now())
+		if err := putSetting(s.db, "origin", value); err != nil {
+			return err
+		}
+	}
+	s.origin = value
+	return nil
+}
+
+// Origin returns the ID of the database, which identifies the commands
+// logged in it once they are synced elsewhere
+func (s *Store) Origin() string {
+	return s.origin
+}
+
+// backfillUIDs gives rows without a UID one based on their timestamp
+func (s *Store) backfillUIDs() error {
+	rows, err := s.db.Query("SELECT id, timestamp FROM commands WHERE uid IS NULL")
+	if err != nil {
+		return err
+	}
+	uids := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var timestamp sql.NullTime
+		if err := rows.Scan(&id, &timestamp); err != nil {
+			rows.Close()
+			return err
+		}
+		if !timestamp.Valid {
+			timestamp.Time = time.Now()
+		}
+		uids[id] = ulid.New(timestamp.Time)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(uids) == 0 {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for id, uid := range uids {
+		if _, err := tx.Exec("UPDATE commands SET uid = ?, origin = COALESCE(origin, ?) WHERE id = ?", uid, s.origin, id); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// recordSyncTombstones remembers the UIDs of the commands matching the
+// WHERE clause, which are about to be deleted, so the deletion is synced.
+// It runs inside the transaction that deletes them.
+func (s *Store) recordSyncTombstones(q querier, where string, args []interface{}) error {
+	_, err := q.ExecContext(context.Background(), `
+		INSERT OR IGNORE INTO sync_tombstones (uid, origin, deleted_at)
+		SELECT uid, ?, ? FROM commands`+where+` AND uid IS NOT NULL`,
+		append([]interface{}{s.origin, time.Now().UTC().Format(time.RFC3339)}, args...)...)
+	if err != nil {
+		return fmt.Errorf("recording tombstones: %w", err)
+	}
+	return nil
+}
+
+// SyncCursor is a position in the changes of a database: the last command
+// and tombstone handed to a peer
+type SyncCursor struct {
+	Commands   int64 `json:"commands"`
+	Tombstones int64 `json:"tombstones"`
+}
+
+// Tombstone records that a command was deleted by clean
+type Tombstone struct {
+	UID string `json:"uid"`
+	// Origin is the database the command was deleted in
+	Origin    string `json:"origin"`
+	DeletedAt string `json:"deleted_at"`
+}
+
+// Changes is a batch of commands and tombstones for a peer
+type Changes struct {
+	Commands   []Command   `json:"commands"`
+	Tombstones []Tombstone `json:"tombstones"`
+	// Next is the cursor to ask for the following batch with
+	Next SyncCursor `json:"next"`
+	// More is set when the batch was cut short by the limit
+	More bool `json:"more"`
+}
+
+// ChangesSince returns up to limit commands and limit tombstones recorded
+// after the cursor, leaving out those that came from the excluded origins,
+// which already have them
+func (s *Store) ChangesSince(since SyncCursor, limit int, exclude ...string) (*Changes, error) {
+	if s == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+	if limit <= 0 {
+		return nil, fmt.Errorf("limit must be positive")
+	}
+
+	notExcluded := ""
+	var excludeArgs []interface{}
+	if len(exclude) > 0 {
+		notExcluded = " AND origin NOT IN (?" + strings.Repeat(", ?", len(exclude)-1) + ")"
+		for _, o := range exclude {
+			excludeArgs = append(excludeArgs, o)
+		}
+	}
+
+	changes := &Changes{Commands: []Command{}, Tombstones: []Tombstone{}, Next: since}
+	args := append(append([]interface{}{since.Commands}, excludeArgs...), limit)
+	rows, err := s.db.Query(`SELECT `+commandColumns+` FROM commands
+		WHERE id > ? AND uid IS NOT NULL`+notExcluded+`
+		ORDER BY id LIMIT ?`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("reading changes: %w", err)
+	}
+	for rows.Next() {
+		cmd, err := scanCommand(rows)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("reading changes: %w", err)
+		}
+		changes.Commands = append(changes.Commands, cmd)
+		changes.Next.Commands = int64(cmd.ID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading changes: %w", err)
+	}
+
+	args = append(append([]interface{}{since.Tombstones}, excludeArgs...), limit)
+	rows, err = s.db.Query(`SELECT seq, uid, origin, deleted_at FROM sync_tombstones
+		WHERE seq > ?`+notExcluded+` ORDER BY seq LIMIT ?`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("reading tombstones: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t Tombstone
+		if err := rows.Scan(&changes.Next.Tombstones, &t.UID, &t.Origin, &t.DeletedAt); err != nil {
+			return nil, fmt.Errorf("reading tombstones: %w", err)
+		}
+		changes.Tombstones = append(changes.Tombstones, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading tombstones: %w", err)
+	}
+
+	changes.More = len(changes.Commands) == limit || len(changes.Tombstones) == limit
+	return changes, nil
+}
+
+// ApplyChanges adds commands and tombstones received from a peer, keeping
+// their UIDs and origins. Commands that are already present or were deleted
+// are skipped, so applying the same changes twice does nothing. It returns
+// how many commands were added and deleted.
+func (s *Store) ApplyChanges(commands []Command, tombstones []Tombstone) (added, deleted int, err error) {
+	if s == nil {
+		return 0, 0, fmt.Errorf("database not initialized")
+	}
+	k, err := s.writeKeys()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	ctx := context.Background()
+	err = s.withImmediateTx(ctx, func(q querier) error {
+		// Tombstones go first, so a command deleted in the same batch is
+		// never added
+		for _, t := range tombstones {
+			if t.UID == "" || t.Origin == "" {
+				return fmt.Errorf("tombstone without a UID or origin")
+			}
+			if _, err := q.ExecContext(ctx, "INSERT OR IGNORE INTO sync_tombstones (uid, origin, deleted_at) VALUES (?, ?, ?)",
+				t.UID, t.Origin, t.DeletedAt); err != nil {
+				return fmt.Errorf("recording tombstone: %w", err)
+			}
+			if s.audit != nil {
+				if err := s.tombstoneCommands(q, " WHERE uid = ?", []interface{}{t.UID}); err != nil {
+					return err
+				}
+			}
+			result, err := q.ExecContext(ctx, "DELETE FROM commands WHERE uid = ?", t.UID)
+			if err != nil {
+				return fmt.Errorf("deleting command: %w", err)
+			}
+			n, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+			deleted += int(n)
+		}
+
+		for _, cmd := range commands {
+			if cmd.UID == "" || cmd.Origin == "" {
+				return fmt.Errorf("command without a UID or origin")
+			}
+			var exists bool
+			err := q.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM commands WHERE uid = ?)
+				OR EXISTS (SELECT 1 FROM sync_tombstones WHERE uid = ?)`, cmd.UID, cmd.UID).Scan(&exists)
+			if err != nil {
+				return err
+			}
+			if exists {
+				continue
+			}
+
+			id, err := insertCommand(ctx, q, k, cmd)
+			if err != nil {
+				return fmt.Errorf("saving command %s: %w", cmd.UID, err)
+			}
+			if err := insertAnnotations(q, k, id, cmd); err != nil {
+				return err
+			}
+			if s.audit != nil {
+				if err := s.appendToChain(q, int(id)); err != nil {
+					return err
+				}
+			}
+			added++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("applying changes: %w", err)
+	}
+	if deleted > 0 {
+		if err := s.deleteOrphanedAnnotations(); err != nil {
+			return added, deleted, err
+		}
+	}
+	return added, deleted, nil
+}
+
+// insertAnnotations copies the tags and note of a received command to its
+// new row
+func insertAnnotations(q querier, k *keys, id int64, cmd Command) error {
+	ctx := context.Background()
+	for _, tag := range cmd.Tags {
+		if err := ValidateTag(tag); err != nil {
+			return err
+		}
+		if _, err := q.ExecContext(ctx, "INSERT OR IGNORE INTO tags (command_id, tag) VALUES (?, ?)", id, tag); err != nil {
+			return fmt.Errorf("saving tags: %w", err)
+		}
+	}
+	if cmd.Note != "" {
+		if _, err := q.ExecContext(ctx, "INSERT INTO notes (command_id, note) VALUES (?, ?)", id, sealText(k, cmd.Note)); err != nil {
+			return fmt.Errorf("saving note: %w", err)
+		}
+	}
+	return nil
+}
+
+// SyncPeer is what a database remembers about another one it syncs with
+type SyncPeer struct {
+	// Peer is the origin of the other database
+	Peer string
+	// Address is where it was last reached
+	Address string
+	// Pulled is the position reached in the peer's changes
+	Pulled SyncCursor
+	// Pushed is the position reached in this database's changes
+	Pushed SyncCursor
+	// SyncedAt is when the last sync finished, empty if it never did
+	SyncedAt string
+}
+
+// GetSyncPeer returns what is known about the peer, starting from nothing
+// if it has never been synced with
+func (s *Store) GetSyncPeer(peer string) (*SyncPeer, error) {
+	if s == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+	p := &SyncPeer{Peer: peer}
+	err := s.db.QueryRow(`SELECT COALESCE(address, ''), pulled_commands, pulled_tombstones, pushed_commands,
+		pushed_tombstones, COALESCE(synced_at, '') FROM sync_peers WHERE peer = ?`, peer).Scan(
+		&p.Address, &p.Pulled.Commands, &p.Pulled.Tombstones, &p.Pushed.Commands, &p.Pushed.Tombstones, &p.SyncedAt)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("reading sync state: %w", err)
+	}
+	return p, nil
+}
+
+// SaveSyncPeer records the progress made syncing with a peer
+func (s *Store) SaveSyncPeer(p *SyncPeer) error {
+	if s == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	_, err := s.db.Exec(`INSERT INTO sync_peers (peer, address, pulled_commands, pulled_tombstones, pushed_commands,
+			pushed_tombstones, synced_at)
+		VALUES (?, ?, ?, ?, ?, ?, NULLIF(?, ''))
+		ON CONFLICT (peer) DO UPDATE SET address = excluded.address, pulled_commands = excluded.pulled_commands,
+			pulled_tombstones = excluded.pulled_tombstones, pushed_commands = excluded.pushed_commands,
+			pushed_tombstones = excluded.pushed_tombstones, synced_at = excluded.synced_at`,
+		p.Peer, p.Address, p.Pulled.Commands, p.Pulled.Tombstones, p.Pushed.Commands, p.Pushed.Tombstones, p.SyncedAt)
+	if err != nil {
+		return fmt.Errorf("saving sync state: %w", err)
+	}
+	return nil
+}
+
+// ListSyncPeers returns every peer this database has synced with
+func (s *Store) ListSyncPeers() ([]SyncPeer, error) {
+	if s == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+	rows, err := s.db.Query(`SELECT peer, COALESCE(address, ''), pulled_commands, pulled_tombstones, pushed_commands,
+		pushed_tombstones, COALESCE(synced_at, '') FROM sync_peers ORDER BY synced_at DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("reading sync state: %w", err)
+	}
+	defer rows.Close()
+	var peers []SyncPeer
+	for rows.Next() {
+		var p SyncPeer
+		if err := rows.Scan(&p.Peer, &p.Address, &p.Pulled.Commands, &p.Pulled.Tombstones, &p.Pushed.Commands,
+			&p.Pushed.Tombstones, &p.SyncedAt); err != nil {
+			return nil, fmt.Errorf("reading sync state: %w", err)
+		}
+		peers = append(peers, p)
+	}
+	return peers, rows.Err()
+}
+
+// SegmentMark returns the last segment imported from the host's directory
+// in a shared sync directory, 0 if none was
+func (s *Store) SegmentMark(dir, host string) (int64, error) {
+	if s == nil {
+		return 0, fmt.Errorf("database not initialized")
+	}
+	var segment int64
+	err := s.db.QueryRow("SELECT segment FROM sync_segments WHERE dir = ? AND host = ?", dir, host).Scan(&segment)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("reading sync state: %w", err)
+	}
+	return segment, nil
+}
+
+// SaveSegmentMark records that the host's segments up to this one were
+// imported
+func (s *Store) SaveSegmentMark(dir, host string, segment int64) error {
+	if s == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	_, err := s.db.Exec(`INSERT INTO sync_segments (dir, host, segment) VALUES (?, ?, ?)
+		ON CONFLICT (dir, host) DO UPDATE SET segment = excluded.segment`, dir, host, segment)
+	if err != nil {
+		return fmt.Errorf("saving sync state: %w", err)
+	}
+	return nil
+}
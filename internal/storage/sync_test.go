@@ -0,0 +1,168 @@
+//go:build cgo
+
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOriginAndUIDs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	s := openTestStore(t, path)
+
+	first := s.Origin()
+	if first == "" {
+		t.Fatal("Expected an origin")
+	}
+	if err := s.SaveCommand("ls", "s", "/", 0, ""); err != nil {
+		t.Fatalf("SaveCommand failed: %v", err)
+	}
+	// A row from before sync existed gets a UID when the database is opened
+	if _, err := s.db.Exec("INSERT INTO commands (command) VALUES ('old')"); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+
+	s.Close()
+	s = openTestStore(t, path)
+	if s.Origin() != first {
+		t.Errorf("Expected origin %s to persist, got %s", first, s.Origin())
+	}
+	commands, err := s.QueryCommands(Filter{Limit: 10})
+	if err != nil {
+		t.Fatalf("QueryCommands failed: %v", err)
+	}
+	if len(commands) != 2 || commands[0].UID == "" || commands[0].UID == commands[1].UID {
+		t.Fatalf("Expected distinct UIDs, got %+v", commands)
+	}
+	for _, cmd := range commands {
+		if cmd.Origin != first {
+			t.Errorf("Expected origin %s, got %s", first, cmd.Origin)
+		}
+	}
+}
+
+func TestApplyChanges(t *testing.T) {
+	dir := t.TempDir()
+	a, b := openTestStore(t, filepath.Join(dir, "a.db")), openTestStore(t, filepath.Join(dir, "b.db"))
+
+	// Database A logs three commands and annotates one
+	originA := a.Origin()
+	for _, c := range []string{"make", "make test", "make deploy"} {
+		if err := a.SaveCommand(c, "1", "/src", 0, ""); err != nil {
+			t.Fatalf("SaveCommand failed: %v", err)
+		}
+	}
+	if err := a.AddTags(2, "ci"); err != nil {
+		t.Fatalf("AddTags failed: %v", err)
+	}
+	if err := a.SetNote(2, "flaky"); err != nil {
+		t.Fatalf("SetNote failed: %v", err)
+	}
+	changes, err := a.ChangesSince(SyncCursor{}, 2)
+	if err != nil {
+		t.Fatalf("ChangesSince failed: %v", err)
+	}
+	if len(changes.Commands) != 2 || !changes.More || changes.Next.Commands != 2 {
+		t.Fatalf("Expected a first batch of 2, got %+v", changes)
+	}
+	rest, err := a.ChangesSince(changes.Next, 2)
+	if err != nil {
+		t.Fatalf("ChangesSince failed: %v", err)
+	}
+	if len(rest.Commands) != 1 || rest.More {
+		t.Fatalf("Expected a last batch of 1, got %+v", rest)
+	}
+	all := append(changes.Commands, rest.Commands...)
+
+	// Database B receives them twice
+	if err := b.SaveCommand("vim", "1", "/src", 0, ""); err != nil {
+		t.Fatalf("SaveCommand failed: %v", err)
+	}
+	for i, expected := range []int{3, 0} {
+		added, _, err := b.ApplyChanges(all, nil)
+		if err != nil {
+			t.Fatalf("ApplyChanges failed: %v", err)
+		}
+		if added != expected {
+			t.Errorf("Round %d: expected %d added, got %d", i, expected, added)
+		}
+	}
+	got, err := b.QueryCommands(Filter{Query: "make test", Limit: 1})
+	if err != nil || len(got) != 1 {
+		t.Fatalf("Expected the synced command, got %v (%v)", got, err)
+	}
+	if got[0].UID != all[1].UID || got[0].Origin != originA || got[0].Timestamp != all[1].Timestamp ||
+		got[0].Note != "flaky" || len(got[0].Tags) != 1 {
+		t.Errorf("Synced command differs: %+v vs %+v", got[0], all[1])
+	}
+
+	// Changes for A leave out what came from A
+	back, err := b.ChangesSince(SyncCursor{}, 10, originA)
+	if err != nil {
+		t.Fatalf("ChangesSince failed: %v", err)
+	}
+	if len(back.Commands) != 1 || back.Commands[0].Command != "vim" {
+		t.Errorf("Expected only B's own command, got %+v", back.Commands)
+	}
+
+	// A deletes a command; the tombstone removes it from B and keeps it out
+	if _, err := a.CleanCommands(CleanCriteria{From: ptr(time.Now().Add(-time.Hour))}); err != nil {
+		t.Fatalf("CleanCommands failed: %v", err)
+	}
+	tombstones, err := a.ChangesSince(rest.Next, 10)
+	if err != nil {
+		t.Fatalf("ChangesSince failed: %v", err)
+	}
+	if len(tombstones.Tombstones) != 3 || tombstones.Tombstones[0].Origin != originA {
+		t.Fatalf("Expected 3 tombstones, got %+v", tombstones.Tombstones)
+	}
+
+	added, deleted, err := b.ApplyChanges(all, tombstones.Tombstones)
+	if err != nil {
+		t.Fatalf("ApplyChanges failed: %v", err)
+	}
+	if added != 0 || deleted != 3 {
+		t.Errorf("Expected 0 added and 3 deleted, got %d and %d", added, deleted)
+	}
+	left, err := b.QueryCommands(Filter{Limit: 10})
+	if err != nil || len(left) != 1 {
+		t.Errorf("Expected only B's own command left, got %v (%v)", left, err)
+	}
+
+	if _, _, err := b.ApplyChanges([]Command{{Command: "x"}}, nil); err == nil {
+		t.Error("Expected an error for a command without a UID")
+	}
+}
+
+func TestSyncPeer(t *testing.T) {
+	s := openTestStore(t, ":memory:")
+
+	p, err := s.GetSyncPeer("peer")
+	if err != nil {
+		t.Fatalf("GetSyncPeer failed: %v", err)
+	}
+	if p.Pulled != (SyncCursor{}) || p.SyncedAt != "" {
+		t.Errorf("Expected a fresh peer, got %+v", p)
+	}
+
+	p.Address = "http://laptop:8750"
+	p.Pulled = SyncCursor{Commands: 10, Tombstones: 2}
+	p.Pushed = SyncCursor{Commands: 7}
+	p.SyncedAt = "2026-01-01T00:00:00Z"
+	if err := s.SaveSyncPeer(p); err != nil {
+		t.Fatalf("SaveSyncPeer failed: %v", err)
+	}
+	got, err := s.GetSyncPeer("peer")
+	if err != nil {
+		t.Fatalf("GetSyncPeer failed: %v", err)
+	}
+	if *got != *p {
+		t.Errorf("Expected %+v, got %+v", p, got)
+	}
+	peers, err := s.ListSyncPeers()
+	if err != nil || len(peers) != 1 {
+		t.Errorf("Expected one peer, got %v (%v)", peers, err)
+	}
+}
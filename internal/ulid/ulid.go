@@ -0,0 +1,62 @@
+// Package ulid generates ULIDs: 128-bit identifiers made of a millisecond
+// timestamp and 80 random bits, written as 26 characters of Crockford's
+// base32 so they sort by time
+package ulid
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// alphabet is Crockford's base32
+const alphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// New returns a ULID for time t
+func New(t time.Time) string {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(t.UnixMilli())<<16)
+	rand.Read(b[6:])
+
+	hi := binary.BigEndian.Uint64(b[:8])
+	lo := binary.BigEndian.Uint64(b[8:])
+	// The 128 bits are padded to 130 at the front, five bits per character
+	out := make([]byte, 26)
+	for i := range out {
+		shift := uint(125 - 5*i)
+		var v uint64
+		switch {
+		case shift >= 64:
+			v = hi >> (shift - 64)
+		case shift == 0:
+			v = lo
+		default:
+			v = lo>>shift | hi<<(64-shift)
+		}
+		out[i] = alphabet[v&31]
+	}
+	return string(out)
+}
+
+// Time returns the time encoded in a ULID, to the millisecond
+func Time(id string) (time.Time, error) {
+	if len(id) != 26 {
+		return time.Time{}, fmt.Errorf("invalid ULID %q", id)
+	}
+	// The timestamp is the first 48 bits: the first ten characters less
+	// the two bits of padding
+	var ms uint64
+	for _, c := range strings.ToUpper(id[:10]) {
+		i := strings.IndexRune(alphabet, c)
+		if i < 0 {
+			return time.Time{}, fmt.Errorf("invalid ULID %q", id)
+		}
+		ms = ms<<5 | uint64(i)
+	}
+	if ms >= 1<<48 {
+		return time.Time{}, fmt.Errorf("invalid ULID %q", id)
+	}
+	return time.UnixMilli(int64(ms)), nil
+}
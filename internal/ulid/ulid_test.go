@@ -0,0 +1,39 @@
+package ulid
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	now := time.UnixMilli(1760000000123)
+	id := New(now)
+	if len(id) != 26 || strings.Trim(id, alphabet) != "" {
+		t.Fatalf("Malformed ULID %q", id)
+	}
+	// The first character only carries three bits
+	if id[0] > '7' {
+		t.Errorf("ULID %q overflows 128 bits", id)
+	}
+	if got, err := Time(id); err != nil || !got.Equal(now) {
+		t.Errorf("Expected time %v, got %v (%v)", now, got, err)
+	}
+
+	if New(now) == id {
+		t.Error("Expected random bits to differ")
+	}
+	if later := New(now.Add(time.Millisecond)); later <= id {
+		t.Errorf("Expected %q to sort after %q", later, id)
+	}
+}
+
+func TestKnownValue(t *testing.T) {
+	// From the ULID specification's example timestamp
+	if got, err := Time("01ARYZ6S41TSV4RRFFQ69G5FAV"); err != nil || got.UnixMilli() != 1469918176385 {
+		t.Errorf("Unexpected time %v (%v)", got, err)
+	}
+	if _, err := Time("not a ulid"); err == nil {
+		t.Error("Expected an error for an invalid ULID")
+	}
+}
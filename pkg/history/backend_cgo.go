@@ -0,0 +1,7 @@
+//go:build cgo
+
+package history
+
+// DefaultBackend is the backend Open uses when Options.Backend is empty:
+// SQLite, since this build has cgo
+const DefaultBackend = BackendSQLite
@@ -0,0 +1,7 @@
+//go:build !cgo
+
+package history
+
+// DefaultBackend is the backend Open uses when Options.Backend is empty:
+// bolt, since SQLite needs cgo, which this build lacks
+const DefaultBackend = BackendBolt
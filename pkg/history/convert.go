@@ -0,0 +1,136 @@
+package history
+
+import "github.com/khelechy/consolidate/internal/storage"
+
+// The public types are converted field by field, so the storage package can
+// change its own without changing the API
+
+func (c Command) toStorage() storage.Command {
+	return storage.Command{
+		ID:           c.ID,
+		Timestamp:    c.Timestamp,
+		Command:      c.Command,
+		SessionID:    c.SessionID,
+		CWD:          c.CWD,
+		ExitCode:     c.ExitCode,
+		Metadata:     c.Metadata,
+		DurationMs:   c.DurationMs,
+		ErrorType:    c.ErrorType,
+		PipeStatus:   c.PipeStatus,
+		Hostname:     c.Hostname,
+		Username:     c.Username,
+		Shell:        c.Shell,
+		ShellVersion: c.ShellVersion,
+		TTY:          c.TTY,
+		Env:          c.Env,
+		GitRoot:      c.GitRoot,
+		GitRemote:    c.GitRemote,
+		GitBranch:    c.GitBranch,
+		GitCommit:    c.GitCommit,
+		UID:          c.UID,
+		Origin:       c.Origin,
+		Tags:         c.Tags,
+		Note:         c.Note,
+	}
+}
+
+func commandFromStorage(c storage.Command) Command {
+	return Command{
+		ID:           c.ID,
+		Timestamp:    c.Timestamp,
+		Command:      c.Command,
+		SessionID:    c.SessionID,
+		CWD:          c.CWD,
+		ExitCode:     c.ExitCode,
+		Metadata:     c.Metadata,
+		DurationMs:   c.DurationMs,
+		ErrorType:    c.ErrorType,
+		PipeStatus:   c.PipeStatus,
+		Hostname:     c.Hostname,
+		Username:     c.Username,
+		Shell:        c.Shell,
+		ShellVersion: c.ShellVersion,
+		TTY:          c.TTY,
+		Env:          c.Env,
+		GitRoot:      c.GitRoot,
+		GitRemote:    c.GitRemote,
+		GitBranch:    c.GitBranch,
+		GitCommit:    c.GitCommit,
+		UID:          c.UID,
+		Origin:       c.Origin,
+		Tags:         c.Tags,
+		Note:         c.Note,
+	}
+}
+
+func (q Query) toStorage() storage.Filter {
+	return storage.Filter{
+		Query:    q.Query,
+		Limit:    q.Limit,
+		Offset:   q.Offset,
+		Failed:   q.Failed,
+		Session:  q.Session,
+		Host:     q.Host,
+		User:     q.User,
+		Repo:     q.Repo,
+		Branch:   q.Branch,
+		Dir:      q.Dir,
+		Subtree:  q.Subtree,
+		ExitCode: q.ExitCode,
+		From:     q.From,
+		To:       q.To,
+		AfterID:  q.AfterID,
+		BeforeID: q.BeforeID,
+		Tags:     q.Tags,
+		Starred:  q.Starred,
+		Meta:     q.Meta,
+		Reverse:  q.Reverse,
+		Frecency: q.Frecency,
+	}
+}
+
+func summaryFromStorage(s storage.CommandSummary) Summary {
+	return Summary{
+		Command:      s.Command,
+		Count:        s.Count,
+		FirstSeen:    s.FirstSeen,
+		LastSeen:     s.LastSeen,
+		LastExitCode: s.LastExitCode,
+		Dirs:         s.Dirs,
+		Score:        s.Score,
+	}
+}
+
+func summariesFromStorage(summaries []storage.CommandSummary) []Summary {
+	if summaries == nil {
+		return nil
+	}
+	out := make([]Summary, len(summaries))
+	for i, s := range summaries {
+		out[i] = summaryFromStorage(s)
+	}
+	return out
+}
+
+func statsFromStorage(s *storage.HistoryStats) *Stats {
+	stats := &Stats{
+		Commands:    s.Commands,
+		Unique:      s.Unique,
+		Failed:      s.Failed,
+		Sessions:    s.Sessions,
+		Hosts:       s.Hosts,
+		First:       s.First,
+		Last:        s.Last,
+		PerDay:      make([]DayCount, len(s.PerDay)),
+		PerHour:     s.PerHour,
+		TopCommands: summariesFromStorage(s.TopCommands),
+		TopDirs:     make([]DirCount, len(s.TopDirs)),
+	}
+	for i, d := range s.PerDay {
+		stats.PerDay[i] = DayCount{Day: d.Day, Count: d.Count}
+	}
+	for i, d := range s.TopDirs {
+		stats.TopDirs[i] = DirCount{Dir: d.Dir, Count: d.Count}
+	}
+	return stats
+}
@@ -0,0 +1,392 @@
+// Package history records and queries shell history in a consolidate
+// database, for Go programs that log or search commands without running the
+// consolidate binary. A database may be shared with the consolidate command
+// and its shell hooks.
+//
+//	store, err := history.Open(path, history.Options{})
+//	if err != nil {
+//		return err
+//	}
+//	defer store.Close()
+//	err = store.Save(ctx, history.Command{Command: "make test", CWD: dir, ExitCode: 2})
+//	failed, err := store.Query(ctx, history.Query{Dir: dir, Failed: true, Limit: 20})
+package history
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/khelechy/consolidate/internal/storage"
+)
+
+// Command is a recorded command with the details of its run
+type Command struct {
+	ID        int    `json:"id"`
+	Timestamp string `json:"timestamp"`
+	Command   string `json:"command"`
+	SessionID string `json:"session_id"`
+	CWD       string `json:"cwd"`
+	ExitCode  int    `json:"exit_code"`
+	Metadata  string `json:"metadata"`
+	// DurationMs is the wall-clock run time reported by the hook, if any
+	DurationMs int64 `json:"duration_ms"`
+	// ErrorType identifies the kind of failure when the shell reports one,
+	// e.g. the exception type of a PowerShell error record
+	ErrorType string `json:"error_type"`
+	// PipeStatus holds the exit status of every stage of a pipeline, in order
+	PipeStatus []int `json:"pipestatus,omitempty"`
+	// Hostname and Username identify where and by whom the command was run
+	Hostname string `json:"hostname"`
+	Username string `json:"username"`
+	// Shell, ShellVersion and TTY describe the session the command ran in
+	Shell        string `json:"shell"`
+	ShellVersion string `json:"shell_version"`
+	TTY          string `json:"tty"`
+	// Env holds the allowlisted environment variables set at the time
+	Env map[string]string `json:"env,omitempty"`
+	// GitRoot, GitRemote, GitBranch and GitCommit describe the git work tree
+	// the command ran in, if any
+	GitRoot   string `json:"git_root"`
+	GitRemote string `json:"git_remote"`
+	GitBranch string `json:"git_branch"`
+	GitCommit string `json:"git_commit"`
+	// UID identifies the command across synced databases, and Origin is the
+	// database it was first logged in
+	UID    string `json:"uid"`
+	Origin string `json:"origin"`
+	// Tags and Note are added to SQLite databases after the fact to curate
+	// the history
+	Tags []string `json:"tags,omitempty"`
+	Note string   `json:"note,omitempty"`
+}
+
+// Failed reports whether the command or any stage of its pipeline exited
+// with a non-zero status
+func (c Command) Failed() bool {
+	return c.toStorage().Failed()
+}
+
+// Query selects commands. Its zero value matches every command; set Limit,
+// since a zero Limit returns none.
+type Query struct {
+	// Query matches commands containing this text; empty matches everything
+	Query string
+	// Limit is the maximum number of commands returned
+	Limit int
+	// Offset skips this many matching commands before the first one returned
+	Offset int
+	// Failed keeps only commands with a non-zero exit code in any pipeline stage
+	Failed bool
+	// Session keeps only commands logged by this shell session
+	Session string
+	// Host keeps only commands run on this hostname
+	Host string
+	// User keeps only commands run by this user
+	User string
+	// Repo keeps only commands run inside the git work tree with this root
+	Repo string
+	// Branch keeps only commands run while this git branch was checked out
+	Branch string
+	// Dir keeps only commands run in this working directory
+	Dir string
+	// Subtree extends Dir to the directories below it
+	Subtree bool
+	// ExitCode keeps only commands that exited with this status
+	ExitCode *int
+	// From and To keep only commands run in this time range, inclusively
+	From, To *time.Time
+	// AfterID and BeforeID keep only commands with a larger or smaller ID,
+	// for keyset pagination: pass the last ID of one page to get the next
+	AfterID  int
+	BeforeID int
+	// Tags keeps only commands carrying every one of these tags
+	Tags []string
+	// Starred keeps only starred commands
+	Starred bool
+	// Meta keeps only commands whose metadata is a JSON object holding all
+	// of these keys with these values
+	Meta map[string]string
+	// Reverse returns the oldest commands first
+	Reverse bool
+	// Frecency orders commands by how often and how recently their
+	// normalized command text was run, instead of newest first
+	Frecency bool
+}
+
+// Summary describes the runs of one command text
+type Summary struct {
+	// Command is the text of the most recent run
+	Command      string   `json:"command"`
+	Count        int      `json:"count"`
+	FirstSeen    string   `json:"first_seen"`
+	LastSeen     string   `json:"last_seen"`
+	LastExitCode int      `json:"last_exit_code"`
+	Dirs         []string `json:"dirs"`
+	Score        float64  `json:"score"`
+}
+
+// Stats summarizes the commands matching a query
+type Stats struct {
+	Commands int `json:"commands"`
+	// Unique counts the distinct normalized commands
+	Unique int `json:"unique"`
+	// Failed counts the commands that failed in any pipeline stage
+	Failed   int `json:"failed"`
+	Sessions int `json:"sessions"`
+	Hosts    int `json:"hosts"`
+	// First and Last are the timestamps of the oldest and newest command
+	First string `json:"first,omitempty"`
+	Last  string `json:"last,omitempty"`
+	// PerDay counts the commands of every day that has any, oldest first
+	PerDay []DayCount `json:"per_day"`
+	// PerHour counts the commands by hour of the day, in UTC
+	PerHour [24]int `json:"per_hour"`
+	// TopCommands are the most often run commands
+	TopCommands []Summary `json:"top_commands"`
+	// TopDirs are the directories most commands were run in
+	TopDirs []DirCount `json:"top_dirs"`
+}
+
+// DayCount is the number of commands run on a day
+type DayCount struct {
+	// Day is the date in UTC, as YYYY-MM-DD
+	Day   string `json:"day"`
+	Count int    `json:"count"`
+}
+
+// DirCount is the number of commands run in a directory
+type DirCount struct {
+	Dir   string `json:"dir"`
+	Count int    `json:"count"`
+}
+
+// Backends a Store can keep history in
+const (
+	// BackendSQLite has every feature of consolidate but needs cgo
+	BackendSQLite = "sqlite"
+	// BackendBolt is pure Go and keeps the commands alone, without tags,
+	// notes, encryption, audit mode or sync
+	BackendBolt = "bolt"
+)
+
+// Key derivations of encrypted databases, passed to Options.Secret
+const (
+	// KDFPassphrase databases are unlocked with a passphrase
+	KDFPassphrase = storage.KDFArgon2id
+	// KDFKeyFile databases are unlocked with a random 32-byte key
+	KDFKeyFile = storage.KDFKeyFile
+)
+
+// Options configures Open
+type Options struct {
+	// Backend is BackendSQLite or BackendBolt. Empty means DefaultBackend.
+	Backend string
+	// Secret returns the secret of an encrypted database: its passphrase,
+	// or its key when kdf is KDFKeyFile. It is called only if the database
+	// is encrypted, which Open fails to open without it.
+	Secret func(kdf string) ([]byte, error)
+	// KeyCache, if set, is tried before Secret for databases encrypted with
+	// a passphrase, and keeps the key derived from it
+	KeyCache KeyCache
+	// AuditKey returns the key that signs new entries of a database in
+	// audit mode. It is called only if audit mode is on; without it, or if
+	// it returns nil, entries are chained but unsigned.
+	AuditKey func() (ed25519.PrivateKey, error)
+	// SpoolDir, if set, is where Save keeps commands it cannot write while
+	// another process holds the database, sealed if the database is
+	// encrypted. Any Save writes them first.
+	SpoolDir string
+}
+
+// ErrSpooled is returned by Save when the database was busy and the command
+// was spooled in Options.SpoolDir for a later Save to write
+var ErrSpooled = errors.New("database busy; command spooled")
+
+// QuarantineError is returned by Save when it moved spooled commands that
+// can never be saved, such as damaged files or commands sealed with another
+// key, to the quarantine directory of Options.SpoolDir. Its Err is what
+// saving the command itself returned, nil if it was saved.
+type QuarantineError = storage.QuarantineError
+
+// KeyCache keeps the keys derived from passphrases, so that opening a
+// database again skips the deliberately slow derivation
+type KeyCache interface {
+	// Key returns the key cached under id, or nil
+	Key(id string) []byte
+	// SetKey caches key under id
+	SetKey(id string, key []byte)
+}
+
+// Store is an open history database. It is safe for concurrent use.
+type Store struct {
+	b     storage.Backend
+	spool *storage.Spool
+}
+
+// Open opens the database at path, creating it if it does not exist and
+// upgrading it from older versions of consolidate
+func Open(path string, opts Options) (*Store, error) {
+	switch opts.Backend {
+	case "":
+		opts.Backend = DefaultBackend
+	case BackendSQLite, BackendBolt:
+	default:
+		return nil, fmt.Errorf("unknown backend %q (use %s or %s)", opts.Backend, BackendSQLite, BackendBolt)
+	}
+	if opts.Backend == BackendBolt {
+		b, err := storage.OpenBolt(path)
+		if err != nil {
+			return nil, err
+		}
+		store := &Store{b: b}
+		if opts.SpoolDir != "" {
+			store.spool = storage.NewSpool(opts.SpoolDir)
+		}
+		return store, nil
+	}
+
+	s, err := storage.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.Encryption() != nil {
+		if err := s.UnlockWith(opts.Secret, opts.KeyCache); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+
+	if s.Audit() != nil && opts.AuditKey != nil {
+		key, err := opts.AuditKey()
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		if key != nil {
+			s.SetAuditSigner(key)
+		}
+	}
+
+	store := &Store{b: s.Backend()}
+	if opts.SpoolDir != "" {
+		if store.spool, err = s.Spool(opts.SpoolDir); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+// Close closes the database
+func (s *Store) Close() error {
+	return s.b.Close()
+}
+
+// Save records a command. Its ID and Origin are assigned by the store, and
+// its UID and Timestamp too unless they are set; a command whose UID is
+// already saved is skipped. With Options.SpoolDir, commands spooled earlier
+// are saved first, and the command is spooled if the database is busy.
+// Spooled commands that can never be saved are moved aside and reported
+// once, by a *QuarantineError that wraps the outcome of saving cmd.
+func (s *Store) Save(ctx context.Context, cmd Command) error {
+	if s.spool == nil {
+		return s.b.Save(ctx, cmd.toStorage())
+	}
+
+	// Commands spooled earlier go first, keeping the history in order
+	_, drainErr := s.spool.Drain(ctx, s.b.Save)
+	var quarantined *QuarantineError
+	if errors.As(drainErr, &quarantined) {
+		drainErr = quarantined.Err
+	}
+	var err error
+	if IsBusy(drainErr) {
+		err = s.spoolCommand(cmd)
+	} else if err = s.b.Save(ctx, cmd.toStorage()); IsBusy(err) {
+		err = s.spoolCommand(cmd)
+	} else if err == nil && drainErr != nil {
+		err = fmt.Errorf("saving spooled commands: %w", drainErr)
+	}
+	if quarantined != nil {
+		quarantined.Err = err
+		return quarantined
+	}
+	return err
+}
+
+// spoolCommand spools a command that could not be saved, returning
+// ErrSpooled once it is
+func (s *Store) spoolCommand(cmd Command) error {
+	if err := s.spool.Add(cmd.toStorage()); err != nil {
+		return fmt.Errorf("spooling command: %w", err)
+	}
+	return ErrSpooled
+}
+
+// Query returns the commands matching q, newest first unless q asks for
+// another order
+func (s *Store) Query(ctx context.Context, q Query) ([]Command, error) {
+	commands, err := s.b.Query(ctx, q.toStorage())
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Command, len(commands))
+	for i, c := range commands {
+		out[i] = commandFromStorage(c)
+	}
+	return out, nil
+}
+
+// Get returns the command with the given ID
+func (s *Store) Get(ctx context.Context, id int) (*Command, error) {
+	if id > 0 {
+		commands, err := s.Query(ctx, Query{AfterID: id - 1, BeforeID: id + 1, Limit: 1})
+		if err != nil {
+			return nil, err
+		}
+		if len(commands) > 0 {
+			return &commands[0], nil
+		}
+	}
+	return nil, fmt.Errorf("no command with ID %d", id)
+}
+
+// Unique returns the distinct commands matching q, most recently used first
+func (s *Store) Unique(ctx context.Context, q Query) ([]Summary, error) {
+	summaries, err := s.b.Unique(ctx, q.toStorage())
+	return summariesFromStorage(summaries), err
+}
+
+// Frecent returns the distinct commands matching q, ranked by how often and
+// how recently they were run
+func (s *Store) Frecent(ctx context.Context, q Query) ([]Summary, error) {
+	summaries, err := s.b.Frecent(ctx, q.toStorage())
+	return summariesFromStorage(summaries), err
+}
+
+// Delete removes the command with the given ID. In SQLite databases,
+// synced machines delete it too, and in audit mode it leaves a tombstone in
+// the chain.
+func (s *Store) Delete(ctx context.Context, id int) error {
+	return s.b.Delete(ctx, id)
+}
+
+// Stats summarizes the commands matching q, ignoring its Limit, Offset and
+// ordering
+func (s *Store) Stats(ctx context.Context, q Query) (*Stats, error) {
+	stats, err := s.b.Stats(ctx, q.toStorage())
+	if err != nil {
+		return nil, err
+	}
+	return statsFromStorage(stats), nil
+}
+
+// IsBusy reports whether err comes from another process holding the
+// database, so that trying again later may succeed
+func IsBusy(err error) bool {
+	return storage.IsBusy(err)
+}
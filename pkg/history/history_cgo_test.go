@@ -0,0 +1,105 @@
+//go:build cgo
+
+package history
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/khelechy/consolidate/internal/storage"
+)
+
+func TestOpenEncrypted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	key := bytes.Repeat([]byte{7}, storage.KeySize)
+	s, err := storage.Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	settings, _ := storage.NewEncryptionSettings(storage.KDFKeyFile)
+	if err := s.EncryptDatabase(settings, key); err != nil {
+		t.Fatalf("EncryptDatabase failed: %v", err)
+	}
+	if err := s.SaveCommand("vault login", "1", "/", 0, ""); err != nil {
+		t.Fatalf("SaveCommand failed: %v", err)
+	}
+	s.Close()
+
+	if _, err := Open(path, Options{}); err == nil {
+		t.Error("Expected an error opening an encrypted database without a secret")
+	}
+	if _, err := Open(path, Options{Secret: func(string) ([]byte, error) {
+		return bytes.Repeat([]byte{8}, storage.KeySize), nil
+	}}); err == nil {
+		t.Error("Expected an error with the wrong key")
+	}
+
+	var kdf string
+	store, err := Open(path, Options{Secret: func(k string) ([]byte, error) {
+		kdf = k
+		return key, nil
+	}})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+	if kdf != KDFKeyFile {
+		t.Errorf("Expected the secret to be asked for a key file, got %q", kdf)
+	}
+	commands, err := store.Query(context.Background(), Query{Limit: 10})
+	if err != nil || len(commands) != 1 || commands[0].Command != "vault login" {
+		t.Errorf("Expected the decrypted command, got %+v (%v)", commands, err)
+	}
+}
+
+// mapCache is a KeyCache in memory
+type mapCache map[string][]byte
+
+func (c mapCache) Key(id string) []byte         { return c[id] }
+func (c mapCache) SetKey(id string, key []byte) { c[id] = key }
+
+func TestOpenKeyCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	s, err := storage.Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	settings, _ := storage.NewEncryptionSettings(storage.KDFArgon2id)
+	settings.Time, settings.Memory, settings.Threads = 1, 64, 1
+	if err := s.EncryptDatabase(settings, []byte("correct horse")); err != nil {
+		t.Fatalf("EncryptDatabase failed: %v", err)
+	}
+	s.Close()
+
+	asked := 0
+	secret := func(string) ([]byte, error) {
+		asked++
+		return []byte("correct horse"), nil
+	}
+	cache := mapCache{}
+	for range 2 {
+		store, err := Open(path, Options{Secret: secret, KeyCache: cache})
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		store.Close()
+	}
+	if asked != 1 || len(cache) != 1 {
+		t.Errorf("Expected the passphrase asked once and its key cached, asked %d times, cached %d keys", asked, len(cache))
+	}
+
+	// A stale key falls back to the passphrase
+	for id := range cache {
+		cache[id] = bytes.Repeat([]byte{1}, storage.KeySize)
+	}
+	store, err := Open(path, Options{Secret: secret, KeyCache: cache})
+	if err != nil {
+		t.Fatalf("Open with a stale cached key failed: %v", err)
+	}
+	store.Close()
+	if asked != 2 {
+		t.Errorf("Expected the passphrase asked again, asked %d times", asked)
+	}
+}
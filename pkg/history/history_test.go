@@ -0,0 +1,121 @@
+package history
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	store, err := Open(filepath.Join(t.TempDir(), "history.db"), Options{})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+
+	for _, cmd := range []Command{
+		{Command: "make", CWD: "/src", ExitCode: 2},
+		{Command: "make", CWD: "/src"},
+		{Command: "ls", CWD: "/tmp"},
+	} {
+		if err := store.Save(ctx, cmd); err != nil {
+			t.Fatalf("Save failed: %v", err)
+		}
+	}
+
+	commands, err := store.Query(ctx, Query{Dir: "/src", Limit: 10})
+	if err != nil || len(commands) != 2 || commands[0].ID != 2 || commands[0].UID == "" {
+		t.Fatalf("Expected both makes, newest first, got %+v (%v)", commands, err)
+	}
+	unique, err := store.Unique(ctx, Query{Limit: 10})
+	if err != nil || len(unique) != 2 || unique[0].Command != "ls" || unique[1].Count != 2 {
+		t.Errorf("Expected ls and make, got %+v (%v)", unique, err)
+	}
+	frecent, err := store.Frecent(ctx, Query{Limit: 1})
+	if err != nil || len(frecent) != 1 || frecent[0].Command != "make" {
+		t.Errorf("Expected make to rank first, got %+v (%v)", frecent, err)
+	}
+
+	if got, err := store.Get(ctx, 1); err != nil || got.Command != "make" || got.ExitCode != 2 {
+		t.Errorf("Expected the failed make, got %+v (%v)", got, err)
+	}
+
+	if err := store.Delete(ctx, 1); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := store.Get(ctx, 1); err == nil {
+		t.Error("Expected an error getting a deleted command")
+	}
+	if err := store.Delete(ctx, 1); err == nil {
+		t.Error("Expected an error deleting a missing command")
+	}
+	stats, err := store.Stats(ctx, Query{})
+	if err != nil || stats.Commands != 2 || stats.Failed != 0 || len(stats.TopDirs) != 2 {
+		t.Errorf("Unexpected stats %+v (%v)", stats, err)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := store.Query(canceled, Query{Limit: 10}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the canceled context to stop the query, got %v", err)
+	}
+	if err := store.Save(canceled, Command{Command: "late"}); err == nil {
+		t.Error("Expected the canceled context to stop the save")
+	}
+}
+
+func TestOpenBolt(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "history.bolt")
+	store, err := Open(path, Options{Backend: BackendBolt})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if err := store.Save(ctx, Command{Command: "go build", CWD: "/src"}); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	store.Close()
+
+	store, err = Open(path, Options{Backend: BackendBolt})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+	commands, err := store.Query(ctx, Query{Dir: "/src", Limit: 10})
+	if err != nil || len(commands) != 1 || commands[0].Command != "go build" {
+		t.Errorf("Expected the saved command, got %+v (%v)", commands, err)
+	}
+
+	if _, err := Open(path, Options{Backend: "postgres"}); err == nil {
+		t.Error("Expected an error for an unknown backend")
+	}
+}
+
+func TestSaveQuarantinesSpooled(t *testing.T) {
+	ctx := context.Background()
+	spoolDir := t.TempDir()
+	// A spooled command damaged beyond saving
+	if err := os.WriteFile(filepath.Join(spoolDir, "0-damaged.json"), []byte("{"), 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	store, err := Open(filepath.Join(t.TempDir(), "history.bolt"), Options{Backend: BackendBolt, SpoolDir: spoolDir})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+
+	var quarantined *QuarantineError
+	if err := store.Save(ctx, Command{Command: "make"}); !errors.As(err, &quarantined) || quarantined.Err != nil {
+		t.Fatalf("Expected the damaged command reported and make saved, got %v", err)
+	}
+	if err := store.Save(ctx, Command{Command: "make test"}); err != nil {
+		t.Errorf("Expected later saves to succeed, got %v", err)
+	}
+	commands, err := store.Query(ctx, Query{Limit: 10})
+	if err != nil || len(commands) != 2 {
+		t.Errorf("Expected both commands saved, got %+v (%v)", commands, err)
+	}
+}